@@ -0,0 +1,123 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package admin
+
+import (
+	"github.com/golang/glog"
+	"github.com/protogalaxy/service-notify/auth"
+	"github.com/protogalaxy/service-notify/queue"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Admin exposes the state of the message queue and allows operators to
+// control it while the service is running.
+type Admin struct {
+	Queue  *queue.ChannelQueue
+	Worker *queue.Worker
+	// Authenticator identifies the operator. All calls are accepted
+	// anonymously if it is not set.
+	Authenticator auth.Authenticator
+}
+
+func (a *Admin) authenticate(ctx context.Context) (string, error) {
+	if a.Authenticator == nil {
+		return "", nil
+	}
+	operator, err := a.Authenticator.Authenticate(ctx)
+	if err != nil {
+		return "", grpc.Errorf(codes.Unauthenticated, "%s", err)
+	}
+	return operator, nil
+}
+
+func (a *Admin) GetQueueStats(ctx context.Context, req *QueueStatsRequest) (*QueueStats, error) {
+	if _, err := a.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	stats := a.Queue.Stats()
+	return &QueueStats{
+		Depth:       int32(stats.Depth),
+		Capacity:    int32(stats.Capacity),
+		Workers:     int32(stats.Workers),
+		BusyWorkers: int32(a.Worker.Busy()),
+		Paused:      stats.Paused,
+	}, nil
+}
+
+func (a *Admin) Pause(ctx context.Context, req *PauseRequest) (*PauseReply, error) {
+	operator, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.Queue.Pause()
+	glog.Infof("Queue paused by '%s'", operator)
+	return &PauseReply{}, nil
+}
+
+func (a *Admin) Resume(ctx context.Context, req *ResumeRequest) (*ResumeReply, error) {
+	operator, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.Queue.Resume()
+	glog.Infof("Queue resumed by '%s'", operator)
+	return &ResumeReply{}, nil
+}
+
+func (a *Admin) ResizeWorkers(ctx context.Context, req *ResizeWorkersRequest) (*ResizeWorkersReply, error) {
+	operator, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Workers < 1 {
+		return nil, grpc.Errorf(codes.InvalidArgument, "at least one worker is required")
+	}
+	a.Queue.Resize(int(req.Workers))
+	glog.Infof("Queue resized to %d workers by '%s'", req.Workers, operator)
+	return &ResizeWorkersReply{}, nil
+}
+
+func (a *Admin) FlushUser(ctx context.Context, req *UserMessagesRequest) (*UserMessagesReply, error) {
+	operator, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.UserId == "" {
+		return nil, grpc.Errorf(codes.InvalidArgument, "missing user id")
+	}
+	n := a.Queue.Flush(req.UserId)
+	glog.Infof("Flushed %d messages for user '%s' by '%s'", n, req.UserId, operator)
+	return &UserMessagesReply{
+		Count: int32(n),
+	}, nil
+}
+
+func (a *Admin) DropUser(ctx context.Context, req *UserMessagesRequest) (*UserMessagesReply, error) {
+	operator, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.UserId == "" {
+		return nil, grpc.Errorf(codes.InvalidArgument, "missing user id")
+	}
+	n := a.Queue.Drop(req.UserId)
+	glog.Infof("Dropped %d messages for user '%s' by '%s'", n, req.UserId, operator)
+	return &UserMessagesReply{
+		Count: int32(n),
+	}, nil
+}
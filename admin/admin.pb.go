@@ -0,0 +1,310 @@
+// Code generated by protoc-gen-go.
+// source: admin.proto
+// DO NOT EDIT!
+
+/*
+Package admin is a generated protocol buffer package.
+
+It is generated from these files:
+	admin.proto
+
+It has these top-level messages:
+	QueueStatsRequest
+	QueueStats
+	PauseRequest
+	PauseReply
+	ResumeRequest
+	ResumeReply
+	ResizeWorkersRequest
+	ResizeWorkersReply
+	UserMessagesRequest
+	UserMessagesReply
+*/
+package admin
+
+import proto "github.com/golang/protobuf/proto"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+
+type QueueStatsRequest struct {
+}
+
+func (m *QueueStatsRequest) Reset()         { *m = QueueStatsRequest{} }
+func (m *QueueStatsRequest) String() string { return proto.CompactTextString(m) }
+func (*QueueStatsRequest) ProtoMessage()    {}
+
+type QueueStats struct {
+	Depth       int32 `protobuf:"varint,1,opt,name=depth" json:"depth,omitempty"`
+	Capacity    int32 `protobuf:"varint,2,opt,name=capacity" json:"capacity,omitempty"`
+	Workers     int32 `protobuf:"varint,3,opt,name=workers" json:"workers,omitempty"`
+	BusyWorkers int32 `protobuf:"varint,4,opt,name=busy_workers" json:"busy_workers,omitempty"`
+	Paused      bool  `protobuf:"varint,5,opt,name=paused" json:"paused,omitempty"`
+}
+
+func (m *QueueStats) Reset()         { *m = QueueStats{} }
+func (m *QueueStats) String() string { return proto.CompactTextString(m) }
+func (*QueueStats) ProtoMessage()    {}
+
+type PauseRequest struct {
+}
+
+func (m *PauseRequest) Reset()         { *m = PauseRequest{} }
+func (m *PauseRequest) String() string { return proto.CompactTextString(m) }
+func (*PauseRequest) ProtoMessage()    {}
+
+type PauseReply struct {
+}
+
+func (m *PauseReply) Reset()         { *m = PauseReply{} }
+func (m *PauseReply) String() string { return proto.CompactTextString(m) }
+func (*PauseReply) ProtoMessage()    {}
+
+type ResumeRequest struct {
+}
+
+func (m *ResumeRequest) Reset()         { *m = ResumeRequest{} }
+func (m *ResumeRequest) String() string { return proto.CompactTextString(m) }
+func (*ResumeRequest) ProtoMessage()    {}
+
+type ResumeReply struct {
+}
+
+func (m *ResumeReply) Reset()         { *m = ResumeReply{} }
+func (m *ResumeReply) String() string { return proto.CompactTextString(m) }
+func (*ResumeReply) ProtoMessage()    {}
+
+type ResizeWorkersRequest struct {
+	Workers int32 `protobuf:"varint,1,opt,name=workers" json:"workers,omitempty"`
+}
+
+func (m *ResizeWorkersRequest) Reset()         { *m = ResizeWorkersRequest{} }
+func (m *ResizeWorkersRequest) String() string { return proto.CompactTextString(m) }
+func (*ResizeWorkersRequest) ProtoMessage()    {}
+
+type ResizeWorkersReply struct {
+}
+
+func (m *ResizeWorkersReply) Reset()         { *m = ResizeWorkersReply{} }
+func (m *ResizeWorkersReply) String() string { return proto.CompactTextString(m) }
+func (*ResizeWorkersReply) ProtoMessage()    {}
+
+type UserMessagesRequest struct {
+	UserId string `protobuf:"bytes,1,opt,name=user_id" json:"user_id,omitempty"`
+}
+
+func (m *UserMessagesRequest) Reset()         { *m = UserMessagesRequest{} }
+func (m *UserMessagesRequest) String() string { return proto.CompactTextString(m) }
+func (*UserMessagesRequest) ProtoMessage()    {}
+
+type UserMessagesReply struct {
+	Count int32 `protobuf:"varint,1,opt,name=count" json:"count,omitempty"`
+}
+
+func (m *UserMessagesReply) Reset()         { *m = UserMessagesReply{} }
+func (m *UserMessagesReply) String() string { return proto.CompactTextString(m) }
+func (*UserMessagesReply) ProtoMessage()    {}
+
+func init() {
+}
+
+// Client API for Admin service
+
+type AdminClient interface {
+	GetQueueStats(ctx context.Context, in *QueueStatsRequest, opts ...grpc.CallOption) (*QueueStats, error)
+	Pause(ctx context.Context, in *PauseRequest, opts ...grpc.CallOption) (*PauseReply, error)
+	Resume(ctx context.Context, in *ResumeRequest, opts ...grpc.CallOption) (*ResumeReply, error)
+	ResizeWorkers(ctx context.Context, in *ResizeWorkersRequest, opts ...grpc.CallOption) (*ResizeWorkersReply, error)
+	FlushUser(ctx context.Context, in *UserMessagesRequest, opts ...grpc.CallOption) (*UserMessagesReply, error)
+	DropUser(ctx context.Context, in *UserMessagesRequest, opts ...grpc.CallOption) (*UserMessagesReply, error)
+}
+
+type adminClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewAdminClient(cc *grpc.ClientConn) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) GetQueueStats(ctx context.Context, in *QueueStatsRequest, opts ...grpc.CallOption) (*QueueStats, error) {
+	out := new(QueueStats)
+	err := grpc.Invoke(ctx, "/admin.Admin/GetQueueStats", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Pause(ctx context.Context, in *PauseRequest, opts ...grpc.CallOption) (*PauseReply, error) {
+	out := new(PauseReply)
+	err := grpc.Invoke(ctx, "/admin.Admin/Pause", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Resume(ctx context.Context, in *ResumeRequest, opts ...grpc.CallOption) (*ResumeReply, error) {
+	out := new(ResumeReply)
+	err := grpc.Invoke(ctx, "/admin.Admin/Resume", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ResizeWorkers(ctx context.Context, in *ResizeWorkersRequest, opts ...grpc.CallOption) (*ResizeWorkersReply, error) {
+	out := new(ResizeWorkersReply)
+	err := grpc.Invoke(ctx, "/admin.Admin/ResizeWorkers", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) FlushUser(ctx context.Context, in *UserMessagesRequest, opts ...grpc.CallOption) (*UserMessagesReply, error) {
+	out := new(UserMessagesReply)
+	err := grpc.Invoke(ctx, "/admin.Admin/FlushUser", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) DropUser(ctx context.Context, in *UserMessagesRequest, opts ...grpc.CallOption) (*UserMessagesReply, error) {
+	out := new(UserMessagesReply)
+	err := grpc.Invoke(ctx, "/admin.Admin/DropUser", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Admin service
+
+type AdminServer interface {
+	GetQueueStats(context.Context, *QueueStatsRequest) (*QueueStats, error)
+	Pause(context.Context, *PauseRequest) (*PauseReply, error)
+	Resume(context.Context, *ResumeRequest) (*ResumeReply, error)
+	ResizeWorkers(context.Context, *ResizeWorkersRequest) (*ResizeWorkersReply, error)
+	FlushUser(context.Context, *UserMessagesRequest) (*UserMessagesReply, error)
+	DropUser(context.Context, *UserMessagesRequest) (*UserMessagesReply, error)
+}
+
+func RegisterAdminServer(s *grpc.Server, srv AdminServer) {
+	s.RegisterService(&_Admin_serviceDesc, srv)
+}
+
+func _Admin_GetQueueStats_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(QueueStatsRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(AdminServer).GetQueueStats(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Admin_Pause_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(PauseRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(AdminServer).Pause(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Admin_Resume_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(ResumeRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(AdminServer).Resume(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Admin_ResizeWorkers_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(ResizeWorkersRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(AdminServer).ResizeWorkers(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Admin_FlushUser_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(UserMessagesRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(AdminServer).FlushUser(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Admin_DropUser_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(UserMessagesRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(AdminServer).DropUser(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+var _Admin_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "admin.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetQueueStats",
+			Handler:    _Admin_GetQueueStats_Handler,
+		},
+		{
+			MethodName: "Pause",
+			Handler:    _Admin_Pause_Handler,
+		},
+		{
+			MethodName: "Resume",
+			Handler:    _Admin_Resume_Handler,
+		},
+		{
+			MethodName: "ResizeWorkers",
+			Handler:    _Admin_ResizeWorkers_Handler,
+		},
+		{
+			MethodName: "FlushUser",
+			Handler:    _Admin_FlushUser_Handler,
+		},
+		{
+			MethodName: "DropUser",
+			Handler:    _Admin_DropUser_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package admin_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/admin"
+	"github.com/protogalaxy/service-notify/auth"
+	"github.com/protogalaxy/service-notify/queue"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+func newAdmin() (*admin.Admin, func()) {
+	w := &queue.Worker{
+		MessageHandler: func(queue.QueuedMessage) {},
+	}
+	q := queue.NewChannelQueue(w.Do, func(p *queue.Properties) {
+		p.NumWorkers = 2
+		p.QueueSize = 5
+	})
+	go q.Start()
+	<-q.Started()
+	return &admin.Admin{Queue: q, Worker: w}, q.Close
+}
+
+func TestAdminQueueStats(t *testing.T) {
+	a, stop := newAdmin()
+	defer stop()
+	a.Pause(context.Background(), &admin.PauseRequest{})
+
+	stats, err := a.GetQueueStats(context.Background(), &admin.QueueStatsRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if stats.Capacity != 5 {
+		t.Errorf("Wrong capacity: expecting 5 but got %d", stats.Capacity)
+	}
+	if stats.Workers != 2 {
+		t.Errorf("Wrong number of workers: expecting 2 but got %d", stats.Workers)
+	}
+	if !stats.Paused {
+		t.Error("Queue should be reported as paused")
+	}
+}
+
+func TestAdminResizeWorkersInvalid(t *testing.T) {
+	a, stop := newAdmin()
+	defer stop()
+	_, err := a.ResizeWorkers(context.Background(), &admin.ResizeWorkersRequest{Workers: 0})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expecting an invalid argument error when resizing to zero workers but got %v", err)
+	}
+}
+
+func TestAdminDropUser(t *testing.T) {
+	a, stop := newAdmin()
+	defer stop()
+	a.Pause(context.Background(), &admin.PauseRequest{})
+	a.Queue.Messages() <- queue.QueuedMessage{UserId: "u1"}
+	a.Queue.Messages() <- queue.QueuedMessage{UserId: "u1"}
+	deadline := time.Now().Add(time.Second)
+	for a.Queue.Stats().Depth != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Messages were not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	res, err := a.DropUser(context.Background(), &admin.UserMessagesRequest{UserId: "u1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if res.Count != 2 {
+		t.Errorf("Wrong number of dropped messages: expecting 2 but got %d", res.Count)
+	}
+}
+
+func TestAdminMissingUser(t *testing.T) {
+	a, stop := newAdmin()
+	defer stop()
+	if _, err := a.FlushUser(context.Background(), &admin.UserMessagesRequest{}); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expecting an invalid argument error for a missing user id on flush but got %v", err)
+	}
+	if _, err := a.DropUser(context.Background(), &admin.UserMessagesRequest{}); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expecting an invalid argument error for a missing user id on drop but got %v", err)
+	}
+}
+
+func TestAdminRequiresAuthentication(t *testing.T) {
+	a, stop := newAdmin()
+	defer stop()
+	a.Authenticator = auth.StaticTokens{"secret": "operator"}
+
+	if _, err := a.Pause(context.Background(), &admin.PauseRequest{}); grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expecting an unauthenticated error but got %v", err)
+	}
+	if a.Queue.Stats().Paused {
+		t.Error("Queue should not be paused by an unauthenticated call")
+	}
+	ctx := metadata.NewContext(context.Background(), metadata.MD{auth.MetadataKey: "Bearer secret"})
+	if _, err := a.Pause(ctx, &admin.PauseRequest{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !a.Queue.Stats().Paused {
+		t.Error("Queue should be paused")
+	}
+}
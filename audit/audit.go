@@ -0,0 +1,104 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	// EventSend is recorded when a notification is accepted or rejected.
+	EventSend = "send"
+	// EventDelivery is recorded once the notification was fanned out to the
+	// user's devices.
+	EventDelivery = "delivery"
+)
+
+const (
+	DecisionAccepted = "accepted"
+	DecisionRejected = "rejected"
+)
+
+const (
+	ResultDelivered = "delivered"
+	ResultPartial   = "partial"
+	ResultFailed    = "failed"
+	ResultNoDevices = "no_devices"
+	// ResultMuted is recorded if the user muted the notification category.
+	ResultMuted = "muted"
+	// ResultDeferred is recorded if the notification was deferred until the
+	// quiet hours of the user end.
+	ResultDeferred = "deferred"
+)
+
+// Record is a single entry of the audit log.
+type Record struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	MessageId   string    `json:"message_id,omitempty"`
+	Caller      string    `json:"caller,omitempty"`
+	UserId      string    `json:"user_id"`
+	PayloadSize int       `json:"payload_size"`
+	PayloadHash string    `json:"payload_sha256,omitempty"`
+	Payload     []byte    `json:"payload,omitempty"`
+	Decision    string    `json:"decision,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Result      string    `json:"result,omitempty"`
+	Devices     int       `json:"devices,omitempty"`
+	Delivered   int       `json:"delivered,omitempty"`
+	Failed      int       `json:"failed,omitempty"`
+	Stored      bool      `json:"stored,omitempty"`
+	// FallbackStep is the step of the fallback chain that delivered the
+	// notification, counting from one.
+	FallbackStep int `json:"fallback_step,omitempty"`
+}
+
+// NewRecord returns a record for the event with the payload details filled
+// in. Whether the payload itself is written is up to the Logger.
+func NewRecord(event, userID string, payload []byte) Record {
+	r := Record{
+		Time:        time.Now().UTC(),
+		Event:       event,
+		UserId:      userID,
+		PayloadSize: len(payload),
+		Payload:     payload,
+	}
+	if len(payload) > 0 {
+		sum := sha256.Sum256(payload)
+		r.PayloadHash = hex.EncodeToString(sum[:])
+	}
+	return r
+}
+
+// Logger appends records to the audit log.
+type Logger interface {
+	Log(r Record)
+}
+
+// DeliveryResult summarises the outcome of sending to the user's devices.
+func DeliveryResult(devices, delivered int) string {
+	switch {
+	case devices == 0:
+		return ResultNoDevices
+	case delivered == devices:
+		return ResultDelivered
+	case delivered == 0:
+		return ResultFailed
+	}
+	return ResultPartial
+}
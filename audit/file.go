@@ -0,0 +1,165 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Properties configure a FileLogger.
+type Properties struct {
+	// MaxSize is the size in bytes after which the log is rotated. Zero
+	// disables size based rotation.
+	MaxSize int64
+	// MaxAge is the time after which the log is rotated. Zero disables time
+	// based rotation.
+	MaxAge time.Duration
+	// IncludePayload writes the notification payload to the log.
+	IncludePayload bool
+	// Redact, if set, is applied to included payloads before they are
+	// written.
+	Redact func([]byte) []byte
+}
+
+// redacted replaces the values of redacted payload fields.
+const redacted = "[REDACTED]"
+
+// RedactFields returns a Redact function replacing the values of the named
+// top level fields of JSON payloads. Payloads that are not JSON objects are
+// redacted as a whole.
+func RedactFields(fields ...string) func([]byte) []byte {
+	return func(payload []byte) []byte {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(payload, &obj); err != nil {
+			return []byte(redacted)
+		}
+		for _, f := range fields {
+			if _, ok := obj[f]; ok {
+				obj[f] = json.RawMessage(`"` + redacted + `"`)
+			}
+		}
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return []byte(redacted)
+		}
+		return b
+	}
+}
+
+// FileLogger writes records as JSON lines to an append-only file. Rotated
+// logs are renamed with the rotation time as a suffix.
+type FileLogger struct {
+	path       string
+	properties *Properties
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func NewFileLogger(path string, conf ...func(*Properties)) (*FileLogger, error) {
+	p := &Properties{}
+	for _, f := range conf {
+		f(p)
+	}
+	l := &FileLogger{
+		path:       path,
+		properties: p,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *FileLogger) Log(r Record) {
+	if !l.properties.IncludePayload {
+		r.Payload = nil
+	} else if l.properties.Redact != nil {
+		r.Payload = l.properties.Redact(r.Payload)
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		glog.Errorf("Unable to encode audit record: %s", err)
+		return
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.shouldRotate(len(b)) {
+		if err := l.rotate(); err != nil {
+			glog.Errorf("Unable to rotate audit log: %s", err)
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		glog.Errorf("Unable to write audit record: %s", err)
+	}
+}
+
+func (l *FileLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+func (l *FileLogger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = fi.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+func (l *FileLogger) shouldRotate(n int) bool {
+	if l.size == 0 {
+		return false
+	}
+	if l.properties.MaxSize > 0 && l.size+int64(n) > l.properties.MaxSize {
+		return true
+	}
+	return l.properties.MaxAge > 0 && time.Now().Sub(l.opened) >= l.properties.MaxAge
+}
+
+// rotate renames the current log and starts a new one. The current log is
+// kept open if it cannot be renamed.
+func (l *FileLogger) rotate() error {
+	rotated := l.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+	old := l.f
+	if err := l.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
@@ -0,0 +1,183 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package audit_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/audit"
+)
+
+func tempLog(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "audit.log"), func() { os.RemoveAll(dir) }
+}
+
+func readRecords(t *testing.T, name string) []audit.Record {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []audit.Record
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r audit.Record
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("Invalid audit record '%s': %s", s.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestNewRecordHashesPayload(t *testing.T) {
+	r := audit.NewRecord(audit.EventSend, "user1", []byte("data"))
+	if r.PayloadSize != 4 {
+		t.Errorf("Wrong payload size: expecting 4 but got %d", r.PayloadSize)
+	}
+	expected := "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7"
+	if r.PayloadHash != expected {
+		t.Errorf("Wrong payload hash: %s", r.PayloadHash)
+	}
+}
+
+func TestDeliveryResult(t *testing.T) {
+	for _, c := range []struct {
+		devices, delivered int
+		result             string
+	}{
+		{0, 0, audit.ResultNoDevices},
+		{2, 2, audit.ResultDelivered},
+		{2, 1, audit.ResultPartial},
+		{2, 0, audit.ResultFailed},
+	} {
+		if r := audit.DeliveryResult(c.devices, c.delivered); r != c.result {
+			t.Errorf("Wrong result for %d/%d: expecting %s but got %s", c.delivered, c.devices, c.result, r)
+		}
+	}
+}
+
+func TestFileLoggerAppendsRecords(t *testing.T) {
+	name, cleanup := tempLog(t)
+	defer cleanup()
+	l, err := audit.NewFileLogger(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(audit.NewRecord(audit.EventSend, "user1", []byte("secret")))
+	l.Log(audit.NewRecord(audit.EventDelivery, "user1", []byte("secret")))
+	l.Close()
+
+	records := readRecords(t, name)
+	if len(records) != 2 {
+		t.Fatalf("Wrong number of records: expecting 2 but got %d", len(records))
+	}
+	if records[0].Event != audit.EventSend || records[1].Event != audit.EventDelivery {
+		t.Errorf("Wrong records written: %+v", records)
+	}
+	if records[0].Payload != nil {
+		t.Error("Payload must not be written unless enabled")
+	}
+}
+
+func TestFileLoggerRedactsPayload(t *testing.T) {
+	name, cleanup := tempLog(t)
+	defer cleanup()
+	l, err := audit.NewFileLogger(name, func(p *audit.Properties) {
+		p.IncludePayload = true
+		p.Redact = func([]byte) []byte { return []byte("***") }
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(audit.NewRecord(audit.EventSend, "user1", []byte("secret")))
+	l.Close()
+
+	records := readRecords(t, name)
+	if string(records[0].Payload) != "***" {
+		t.Errorf("Payload was not redacted: %s", records[0].Payload)
+	}
+}
+
+func TestRedactFields(t *testing.T) {
+	redact := audit.RedactFields("body", "email")
+	tests := []struct {
+		payload  string
+		expected string
+	}{
+		{`{"body":"secret","email":"a@example.com","id":1}`, `{"body":"[REDACTED]","email":"[REDACTED]","id":1}`},
+		{`{"id":1}`, `{"id":1}`},
+		{`not json`, `[REDACTED]`},
+	}
+	for _, test := range tests {
+		if out := string(redact([]byte(test.payload))); out != test.expected {
+			t.Errorf("Redacting %s: expecting %s but got %s", test.payload, test.expected, out)
+		}
+	}
+}
+
+func TestFileLoggerRotatesBySize(t *testing.T) {
+	name, cleanup := tempLog(t)
+	defer cleanup()
+	l, err := audit.NewFileLogger(name, func(p *audit.Properties) {
+		p.MaxSize = 100
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		l.Log(audit.NewRecord(audit.EventSend, "user1", nil))
+	}
+	l.Close()
+
+	rotated, _ := filepath.Glob(name + ".*")
+	if len(rotated) != 2 {
+		t.Errorf("Wrong number of rotated logs: expecting 2 but got %d", len(rotated))
+	}
+	if records := readRecords(t, name); len(records) != 1 {
+		t.Errorf("Wrong number of records in the current log: %d", len(records))
+	}
+}
+
+func TestFileLoggerRotatesByAge(t *testing.T) {
+	name, cleanup := tempLog(t)
+	defer cleanup()
+	l, err := audit.NewFileLogger(name, func(p *audit.Properties) {
+		p.MaxAge = time.Millisecond
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(audit.NewRecord(audit.EventSend, "user1", nil))
+	time.Sleep(2 * time.Millisecond)
+	l.Log(audit.NewRecord(audit.EventSend, "user1", nil))
+	l.Close()
+
+	rotated, _ := filepath.Glob(name + ".*")
+	if len(rotated) != 1 {
+		t.Errorf("Wrong number of rotated logs: expecting 1 but got %d", len(rotated))
+	}
+}
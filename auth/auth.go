@@ -0,0 +1,87 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// MetadataKey is the request metadata key carrying the caller token.
+const MetadataKey = "authorization"
+
+var (
+	ErrMissingToken = errors.New("missing authorization token")
+	ErrInvalidToken = errors.New("invalid authorization token")
+)
+
+// Authenticator identifies the caller of an RPC. Callers are identified by
+// their bearer token only: the vendored grpc does not expose the peer
+// connection to handlers, so a client certificate verified by the TLS
+// listener cannot name the caller.
+type Authenticator interface {
+	// Authenticate returns the name of the caller or an error if the caller
+	// could not be authenticated.
+	Authenticate(ctx context.Context) (string, error)
+}
+
+// TokenFromContext extracts the bearer token from the request metadata.
+func TokenFromContext(ctx context.Context) (string, error) {
+	md, ok := metadata.FromContext(ctx)
+	if !ok {
+		return "", ErrMissingToken
+	}
+	token := strings.TrimPrefix(md[MetadataKey], "Bearer ")
+	if token == "" {
+		return "", ErrMissingToken
+	}
+	return token, nil
+}
+
+// StaticTokens authenticates callers by a fixed mapping from tokens to
+// caller names.
+type StaticTokens map[string]string
+
+func (s StaticTokens) Authenticate(ctx context.Context) (string, error) {
+	token, err := TokenFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	caller, ok := s[token]
+	if !ok {
+		return "", ErrInvalidToken
+	}
+	return caller, nil
+}
+
+// Chain tries each authenticator in order and returns the first caller that
+// is authenticated.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(ctx context.Context) (string, error) {
+	err := ErrMissingToken
+	for _, a := range c {
+		var caller string
+		caller, err = a.Authenticate(ctx)
+		if err == nil {
+			return caller, nil
+		}
+	}
+	return "", err
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth_test
+
+import (
+	"testing"
+
+	"github.com/protogalaxy/service-notify/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+func withToken(token string) context.Context {
+	return metadata.NewContext(context.Background(), metadata.MD{auth.MetadataKey: "Bearer " + token})
+}
+
+func TestStaticTokens(t *testing.T) {
+	a := auth.StaticTokens{"secret": "game-server"}
+	caller, err := a.Authenticate(withToken("secret"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if caller != "game-server" {
+		t.Errorf("Wrong caller: expecting 'game-server' but got '%s'", caller)
+	}
+}
+
+func TestStaticTokensInvalidToken(t *testing.T) {
+	a := auth.StaticTokens{"secret": "game-server"}
+	if _, err := a.Authenticate(withToken("other")); err != auth.ErrInvalidToken {
+		t.Errorf("Expecting invalid token error but got: %v", err)
+	}
+}
+
+func TestStaticTokensMissingToken(t *testing.T) {
+	a := auth.StaticTokens{"secret": "game-server"}
+	if _, err := a.Authenticate(context.Background()); err != auth.ErrMissingToken {
+		t.Errorf("Expecting missing token error but got: %v", err)
+	}
+}
+
+func TestChainUsesFirstSuccessfulAuthenticator(t *testing.T) {
+	a := auth.Chain{
+		auth.StaticTokens{"one": "first"},
+		auth.StaticTokens{"two": "second"},
+	}
+	caller, err := a.Authenticate(withToken("two"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if caller != "second" {
+		t.Errorf("Wrong caller: expecting 'second' but got '%s'", caller)
+	}
+	if _, err := a.Authenticate(withToken("three")); err == nil {
+		t.Error("Expecting an error for an unknown token")
+	}
+}
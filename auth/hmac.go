@@ -0,0 +1,83 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var ErrExpiredToken = errors.New("expired authorization token")
+
+// HMACTokens authenticates callers by tokens of the form
+// "<caller>.<expiry>.<signature>" where the signature is the HMAC-SHA256 of
+// "<caller>.<expiry>" with a shared key and expiry is a Unix timestamp.
+type HMACTokens struct {
+	Key []byte
+	Now func() time.Time
+}
+
+// Sign issues a token for the caller that is valid until expiry.
+func (h *HMACTokens) Sign(caller string, expiry time.Time) string {
+	payload := caller + "." + strconv.FormatInt(expiry.Unix(), 10)
+	return payload + "." + base64.URLEncoding.EncodeToString(h.mac(payload))
+}
+
+func (h *HMACTokens) Authenticate(ctx context.Context) (string, error) {
+	token, err := TokenFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", ErrInvalidToken
+	}
+	payload := token[:i]
+	sig, err := base64.URLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, h.mac(payload)) {
+		return "", ErrInvalidToken
+	}
+
+	j := strings.LastIndex(payload, ".")
+	if j < 0 {
+		return "", ErrInvalidToken
+	}
+	expiry, err := strconv.ParseInt(payload[j+1:], 10, 64)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	now := time.Now
+	if h.Now != nil {
+		now = h.Now
+	}
+	if now().Unix() > expiry {
+		return "", ErrExpiredToken
+	}
+	return payload[:j], nil
+}
+
+func (h *HMACTokens) mac(payload string) []byte {
+	m := hmac.New(sha256.New, h.Key)
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
@@ -0,0 +1,63 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/auth"
+)
+
+func TestHMACTokens(t *testing.T) {
+	h := &auth.HMACTokens{Key: []byte("key")}
+	token := h.Sign("game.server", time.Now().Add(time.Minute))
+	caller, err := h.Authenticate(withToken(token))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if caller != "game.server" {
+		t.Errorf("Wrong caller: expecting 'game.server' but got '%s'", caller)
+	}
+}
+
+func TestHMACTokensWrongKey(t *testing.T) {
+	token := (&auth.HMACTokens{Key: []byte("other")}).Sign("game", time.Now().Add(time.Minute))
+	h := &auth.HMACTokens{Key: []byte("key")}
+	if _, err := h.Authenticate(withToken(token)); err != auth.ErrInvalidToken {
+		t.Errorf("Expecting invalid token error but got: %v", err)
+	}
+}
+
+func TestHMACTokensExpired(t *testing.T) {
+	h := &auth.HMACTokens{
+		Key: []byte("key"),
+		Now: func() time.Time { return time.Unix(2000, 0) },
+	}
+	token := h.Sign("game", time.Unix(1000, 0))
+	if _, err := h.Authenticate(withToken(token)); err != auth.ErrExpiredToken {
+		t.Errorf("Expecting expired token error but got: %v", err)
+	}
+}
+
+func TestHMACTokensMalformed(t *testing.T) {
+	h := &auth.HMACTokens{Key: []byte("key")}
+	for _, token := range []string{"game", "game.123", "game.123.!!!"} {
+		if _, err := h.Authenticate(withToken(token)); err != auth.ErrInvalidToken {
+			t.Errorf("Expecting invalid token error for '%s' but got: %v", token, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+// Request describes a notification a caller wants to send.
+type Request struct {
+	UserId string
+	// Category is the category of the structured notification, empty for
+	// raw messages and requests that do not send a notification.
+	Category    string
+	PayloadSize int
+}
+
+// Policy decides whether an authenticated caller may send a notification.
+type Policy interface {
+	Authorize(caller string, req Request) error
+}
+
+// Rule allows the caller to send notifications to the users matching any of
+// the patterns. Patterns use path.Match syntax so topic style user ids such
+// as "team:*" can be matched. If Categories is set the request category must
+// match one of its patterns as well; requests without a category only match
+// the pattern "*". A MaxPayloadSize of zero means no limit.
+type Rule struct {
+	Caller         string   `json:"caller"`
+	Users          []string `json:"users"`
+	Categories     []string `json:"categories"`
+	MaxPayloadSize int      `json:"max_payload_size"`
+}
+
+// Rules is a Policy allowing a request if any of the rules for the caller
+// allows it. The caller "*" matches all callers.
+type Rules []Rule
+
+func (r Rules) Authorize(caller string, req Request) error {
+	var err error = fmt.Errorf("caller '%s' may not send notifications", caller)
+	for _, rule := range r {
+		if rule.Caller != caller && rule.Caller != "*" {
+			continue
+		}
+		if !matchAny(rule.Users, req.UserId) {
+			err = fmt.Errorf("caller '%s' may not send notifications to user '%s'", caller, req.UserId)
+			continue
+		}
+		if len(rule.Categories) > 0 && !matchAny(rule.Categories, req.Category) {
+			err = fmt.Errorf("caller '%s' may not send notifications of category '%s'", caller, req.Category)
+			continue
+		}
+		if rule.MaxPayloadSize > 0 && req.PayloadSize > rule.MaxPayloadSize {
+			err = fmt.Errorf("payload of %d bytes exceeds the limit of %d bytes for caller '%s'", req.PayloadSize, rule.MaxPayloadSize, caller)
+			continue
+		}
+		return nil
+	}
+	return err
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadRules reads a JSON encoded list of rules from a file.
+func LoadRules(name string) (Rules, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules Rules
+	if err := json.NewDecoder(f).Decode(&rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
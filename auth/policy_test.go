@@ -0,0 +1,87 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/protogalaxy/service-notify/auth"
+)
+
+var rules = auth.Rules{
+	{Caller: "matchmaker", Users: []string{"*"}, MaxPayloadSize: 10},
+	{Caller: "chat", Users: []string{"room:*"}},
+	{Caller: "shop", Users: []string{"*"}, Categories: []string{"offer", "receipt:*"}},
+}
+
+func TestRulesAllow(t *testing.T) {
+	if err := rules.Authorize("chat", auth.Request{UserId: "room:42", PayloadSize: 100}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := rules.Authorize("matchmaker", auth.Request{UserId: "user1", PayloadSize: 10}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestRulesDenyUser(t *testing.T) {
+	if err := rules.Authorize("chat", auth.Request{UserId: "user1"}); err == nil {
+		t.Error("Expecting chat not to be allowed to send to user1")
+	}
+}
+
+func TestRulesDenyPayloadSize(t *testing.T) {
+	if err := rules.Authorize("matchmaker", auth.Request{UserId: "user1", PayloadSize: 11}); err == nil {
+		t.Error("Expecting payload size limit to be enforced")
+	}
+}
+
+func TestRulesCategories(t *testing.T) {
+	if err := rules.Authorize("shop", auth.Request{UserId: "user1", Category: "receipt:order"}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := rules.Authorize("shop", auth.Request{UserId: "user1", Category: "chat"}); err == nil {
+		t.Error("Expecting shop not to be allowed to send chat notifications")
+	}
+	if err := rules.Authorize("shop", auth.Request{UserId: "user1"}); err == nil {
+		t.Error("Expecting shop not to be allowed to send requests without a category")
+	}
+}
+
+func TestRulesDenyUnknownCaller(t *testing.T) {
+	if err := rules.Authorize("unknown", auth.Request{UserId: "user1"}); err == nil {
+		t.Error("Expecting unknown caller to be denied")
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	f, err := ioutil.TempFile("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"caller": "chat", "users": ["room:*"], "max_payload_size": 5}]`)
+	f.Close()
+
+	r, err := auth.LoadRules(f.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(r) != 1 || r[0].Caller != "chat" || r[0].Users[0] != "room:*" || r[0].MaxPayloadSize != 5 {
+		t.Errorf("Wrong rules loaded: %+v", r)
+	}
+}
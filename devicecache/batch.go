@@ -0,0 +1,179 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package devicecache
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+type BatchProperties struct {
+	// Window is how long a lookup waits for others to join its batch.
+	Window time.Duration
+	// MaxUsers is the largest number of users looked up in one batch.
+	MaxUsers int
+	// Timeout limits a batch lookup.
+	Timeout time.Duration
+}
+
+// Batcher is a PresenceManagerClient that collects the GetDevices calls
+// made within a short window and looks the users up with a single
+// GetUsersDevices call. If the presence service does not implement
+// GetUsersDevices the users are looked up one by one from then on.
+type Batcher struct {
+	devicepresence.PresenceManagerClient
+	properties *BatchProperties
+	// unsupported is set once the presence service reported that it does
+	// not implement GetUsersDevices.
+	unsupported int32
+
+	mu      sync.Mutex
+	waiting map[string][]chan result
+	timer   *time.Timer
+}
+
+type result struct {
+	devices []*devicepresence.Device
+	err     error
+}
+
+func NewBatcher(client devicepresence.PresenceManagerClient, conf ...func(*BatchProperties)) *Batcher {
+	p := &BatchProperties{
+		Window:   2 * time.Millisecond,
+		MaxUsers: 100,
+		Timeout:  5 * time.Second,
+	}
+	for _, f := range conf {
+		f(p)
+	}
+	return &Batcher{
+		PresenceManagerClient: client,
+		properties:            p,
+		waiting:               make(map[string][]chan result),
+	}
+}
+
+func (b *Batcher) GetDevices(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+	if atomic.LoadInt32(&b.unsupported) != 0 {
+		return b.PresenceManagerClient.GetDevices(ctx, in, opts...)
+	}
+	ch := make(chan result, 1)
+	b.mu.Lock()
+	b.waiting[in.UserId] = append(b.waiting[in.UserId], ch)
+	if len(b.waiting) >= b.properties.MaxUsers {
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+		go b.lookup(b.take())
+	} else if len(b.waiting) == 1 && len(b.waiting[in.UserId]) == 1 {
+		b.timer = time.AfterFunc(b.properties.Window, b.flush)
+	}
+	b.mu.Unlock()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return &stream{ctx: ctx, devices: r.devices}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// take returns the waiting lookups and starts a new batch. Must be called
+// with the lock held.
+func (b *Batcher) take() map[string][]chan result {
+	batch := b.waiting
+	b.waiting = make(map[string][]chan result)
+	return batch
+}
+
+func (b *Batcher) flush() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+	if len(batch) > 0 {
+		b.lookup(batch)
+	}
+}
+
+// lookup looks up the users of the batch and hands the devices to the
+// waiting calls.
+func (b *Batcher) lookup(batch map[string][]chan result) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.properties.Timeout)
+	defer cancel()
+	reply := func(userID string, r result) {
+		for _, ch := range batch[userID] {
+			ch <- r
+		}
+		delete(batch, userID)
+	}
+
+	err := b.lookupBatch(ctx, batch, reply)
+	if grpc.Code(err) == codes.Unimplemented {
+		glog.Warning("Presence service does not implement GetUsersDevices, looking up users one by one")
+		atomic.StoreInt32(&b.unsupported, 1)
+		var wg sync.WaitGroup
+		for userID := range batch {
+			wg.Add(1)
+			go func(userID string) {
+				defer wg.Done()
+				devices, err := fetch(ctx, b.PresenceManagerClient, userID, nil)
+				for _, ch := range batch[userID] {
+					ch <- result{devices, err}
+				}
+			}(userID)
+		}
+		wg.Wait()
+		return
+	}
+	for userID := range batch {
+		reply(userID, result{err: err})
+	}
+}
+
+// lookupBatch replies to the users returned by GetUsersDevices. Users left
+// in the batch have no devices unless an error is returned.
+func (b *Batcher) lookupBatch(ctx context.Context, batch map[string][]chan result, reply func(string, result)) error {
+	req := &devicepresence.UsersDevicesRequest{}
+	for userID := range batch {
+		req.UserIds = append(req.UserIds, userID)
+	}
+	stream, err := b.PresenceManagerClient.GetUsersDevices(ctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		u, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, ok := batch[u.UserId]; ok {
+			reply(u.UserId, result{devices: u.Devices})
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package devicecache_test
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/devicecache"
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+type UsersDevicesStream struct {
+	users []*devicepresence.UserDevices
+	err   error
+	grpc.ClientStream
+}
+
+func (s *UsersDevicesStream) Recv() (*devicepresence.UserDevices, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if len(s.users) == 0 {
+		return nil, io.EOF
+	}
+	u := s.users[0]
+	s.users = s.users[1:]
+	return u, nil
+}
+
+// BatchPresenceMock answers batch lookups from the devices of PresenceMock
+// and records the batches.
+type BatchPresenceMock struct {
+	*PresenceMock
+	unimplemented bool
+
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (m *BatchPresenceMock) GetUsersDevices(ctx context.Context, in *devicepresence.UsersDevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetUsersDevicesClient, error) {
+	m.mu.Lock()
+	userIDs := append([]string{}, in.UserIds...)
+	sort.Strings(userIDs)
+	m.batches = append(m.batches, userIDs)
+	m.mu.Unlock()
+	if m.unimplemented {
+		return &UsersDevicesStream{err: grpc.Errorf(codes.Unimplemented, "unknown method")}, nil
+	}
+	var users []*devicepresence.UserDevices
+	for _, userID := range in.UserIds {
+		if devices, ok := m.devices[userID]; ok {
+			users = append(users, &devicepresence.UserDevices{UserId: userID, Devices: devices})
+		}
+	}
+	return &UsersDevicesStream{users: users}, nil
+}
+
+func (m *BatchPresenceMock) Batches() [][]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.batches
+}
+
+func lookupConcurrently(t *testing.T, client devicepresence.PresenceManagerClient, userIDs ...string) map[string][]string {
+	var mu sync.Mutex
+	found := make(map[string][]string)
+	var wg sync.WaitGroup
+	for _, userID := range userIDs {
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+			stream, err := client.GetDevices(context.Background(), &devicepresence.DevicesRequest{UserId: userID})
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err)
+				return
+			}
+			var ids []string
+			for {
+				d, err := stream.Recv()
+				if err != nil {
+					break
+				}
+				ids = append(ids, d.Id)
+			}
+			mu.Lock()
+			found[userID] = ids
+			mu.Unlock()
+		}(userID)
+	}
+	wg.Wait()
+	return found
+}
+
+func TestBatcherBatchesConcurrentLookups(t *testing.T) {
+	p := &BatchPresenceMock{PresenceMock: &PresenceMock{devices: map[string][]*devicepresence.Device{
+		"user1": {{Id: "1"}},
+		"user2": {{Id: "2"}, {Id: "3"}},
+	}}}
+	b := devicecache.NewBatcher(p, func(props *devicecache.BatchProperties) {
+		props.Window = 20 * time.Millisecond
+	})
+	found := lookupConcurrently(t, b, "user1", "user2", "user3", "user1")
+
+	if len(found["user1"]) != 1 || len(found["user2"]) != 2 || len(found["user3"]) != 0 {
+		t.Errorf("Wrong devices: %v", found)
+	}
+	if batches := p.Batches(); len(batches) != 1 || len(batches[0]) != 3 {
+		t.Errorf("Expecting a single batch of 3 users but got %v", batches)
+	}
+	if p.Lookups() != 0 {
+		t.Errorf("Unexpected single user lookups: %d", p.Lookups())
+	}
+}
+
+func TestBatcherLimitsBatchSize(t *testing.T) {
+	p := &BatchPresenceMock{PresenceMock: &PresenceMock{devices: map[string][]*devicepresence.Device{}}}
+	b := devicecache.NewBatcher(p, func(props *devicecache.BatchProperties) {
+		props.Window = time.Hour
+		props.MaxUsers = 2
+	})
+	lookupConcurrently(t, b, "user1", "user2", "user3", "user4")
+
+	if batches := p.Batches(); len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 2 {
+		t.Errorf("Expecting 2 batches of 2 users but got %v", batches)
+	}
+}
+
+func TestBatcherFallsBackToSingleLookups(t *testing.T) {
+	p := &BatchPresenceMock{
+		PresenceMock: &PresenceMock{devices: map[string][]*devicepresence.Device{
+			"user1": {{Id: "1"}},
+			"user2": {{Id: "2"}},
+		}},
+		unimplemented: true,
+	}
+	b := devicecache.NewBatcher(p, func(props *devicecache.BatchProperties) {
+		props.Window = 20 * time.Millisecond
+	})
+	found := lookupConcurrently(t, b, "user1", "user2")
+	if len(found["user1"]) != 1 || len(found["user2"]) != 1 {
+		t.Errorf("Wrong devices: %v", found)
+	}
+	if p.Lookups() != 2 {
+		t.Errorf("Expecting 2 single user lookups but got %d", p.Lookups())
+	}
+
+	lookupConcurrently(t, b, "user1")
+	if len(p.Batches()) != 1 || p.Lookups() != 3 {
+		t.Errorf("Expecting no further batches but got %v", p.Batches())
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package devicecache caches the device lists of users in front of the
+// presence service.
+package devicecache
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+type Properties struct {
+	// TTL is how long the device list of a user is cached.
+	TTL time.Duration
+	// NegativeTTL is how long users without devices are cached.
+	NegativeTTL time.Duration
+	// MaxUsers limits the number of cached device lists.
+	MaxUsers int
+	// Timeout limits a lookup shared by concurrent callers.
+	Timeout time.Duration
+	Now     func() time.Time
+}
+
+// Client is a PresenceManagerClient that caches the device lists returned by
+// GetDevices. Concurrent lookups of the same user share a single call to the
+// presence service. Registering or removing a device through the client
+// invalidates the device list of its user.
+type Client struct {
+	devicepresence.PresenceManagerClient
+	properties *Properties
+
+	mu    sync.Mutex
+	users map[string]entry
+	calls map[string]*call
+}
+
+type entry struct {
+	devices []*devicepresence.Device
+	expires time.Time
+}
+
+// call is a lookup in progress.
+type call struct {
+	done    chan struct{}
+	devices []*devicepresence.Device
+	err     error
+	// stale is set if the user was invalidated during the lookup.
+	stale bool
+}
+
+func NewClient(client devicepresence.PresenceManagerClient, conf ...func(*Properties)) *Client {
+	p := &Properties{
+		TTL:         5 * time.Second,
+		NegativeTTL: time.Second,
+		MaxUsers:    100000,
+		Timeout:     5 * time.Second,
+		Now:         time.Now,
+	}
+	for _, f := range conf {
+		f(p)
+	}
+	return &Client{
+		PresenceManagerClient: client,
+		properties:            p,
+		users:                 make(map[string]entry),
+		calls:                 make(map[string]*call),
+	}
+}
+
+func (c *Client) GetDevices(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+	devices, err := c.Devices(ctx, in.UserId, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &stream{ctx: ctx, devices: devices}, nil
+}
+
+// Devices returns the devices of the user from the cache or the presence
+// service. The devices are shared and must not be modified.
+func (c *Client) Devices(ctx context.Context, userID string, opts ...grpc.CallOption) ([]*devicepresence.Device, error) {
+	c.mu.Lock()
+	if e, ok := c.users[userID]; ok && c.properties.Now().Before(e.expires) {
+		c.mu.Unlock()
+		return e.devices, nil
+	}
+	cl, ok := c.calls[userID]
+	if !ok {
+		cl = &call{done: make(chan struct{})}
+		c.calls[userID] = cl
+		go c.lookup(userID, cl, opts)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-cl.done:
+		return cl.devices, cl.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// lookup fetches the devices of the user and caches them unless the lookup
+// failed or the user was invalidated meanwhile. The lookup is shared, so it
+// does not use the context of the caller that started it.
+func (c *Client) lookup(userID string, cl *call, opts []grpc.CallOption) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.properties.Timeout)
+	defer cancel()
+	cl.devices, cl.err = fetch(ctx, c.PresenceManagerClient, userID, opts)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls[userID] == cl {
+		delete(c.calls, userID)
+	}
+	if cl.err == nil && !cl.stale {
+		ttl := c.properties.TTL
+		if len(cl.devices) == 0 {
+			ttl = c.properties.NegativeTTL
+		}
+		now := c.properties.Now()
+		if _, ok := c.users[userID]; !ok && len(c.users) >= c.properties.MaxUsers {
+			c.evict(now)
+		}
+		c.users[userID] = entry{devices: cl.devices, expires: now.Add(ttl)}
+	}
+	close(cl.done)
+}
+
+// fetch reads all the devices of the user from the presence service.
+func fetch(ctx context.Context, client devicepresence.PresenceManagerClient, userID string, opts []grpc.CallOption) ([]*devicepresence.Device, error) {
+	stream, err := client.GetDevices(ctx, &devicepresence.DevicesRequest{UserId: userID}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var devices []*devicepresence.Device
+	for {
+		device, err := stream.Recv()
+		if err == io.EOF {
+			return devices, nil
+		} else if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+}
+
+// Invalidate drops the cached devices of the user. A lookup in progress is
+// not cached.
+func (c *Client) Invalidate(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.users, userID)
+	if cl, ok := c.calls[userID]; ok {
+		cl.stale = true
+		delete(c.calls, userID)
+	}
+	glog.V(3).Infof("Invalidated cached devices of user %s", userID)
+}
+
+func (c *Client) RegisterDevice(ctx context.Context, in *devicepresence.Device, opts ...grpc.CallOption) (*devicepresence.RegisterDeviceReply, error) {
+	defer c.Invalidate(in.UserId)
+	return c.PresenceManagerClient.RegisterDevice(ctx, in, opts...)
+}
+
+func (c *Client) RemoveDevice(ctx context.Context, in *devicepresence.RemoveDeviceRequest, opts ...grpc.CallOption) (*devicepresence.RemoveDeviceReply, error) {
+	defer c.Invalidate(in.UserId)
+	return c.PresenceManagerClient.RemoveDevice(ctx, in, opts...)
+}
+
+// evict drops expired device lists, or an arbitrary one if none expired.
+// Must be called with the lock held.
+func (c *Client) evict(now time.Time) {
+	for userID, e := range c.users {
+		if !now.Before(e.expires) {
+			delete(c.users, userID)
+		}
+	}
+	for userID := range c.users {
+		if len(c.users) < c.properties.MaxUsers {
+			break
+		}
+		delete(c.users, userID)
+	}
+}
+
+var errSendOnReceiveStream = errors.New("cannot send on a device stream")
+
+// stream replays a cached device list.
+type stream struct {
+	ctx     context.Context
+	devices []*devicepresence.Device
+}
+
+func (s *stream) Recv() (*devicepresence.Device, error) {
+	if len(s.devices) == 0 {
+		return nil, io.EOF
+	}
+	d := s.devices[0]
+	s.devices = s.devices[1:]
+	return d, nil
+}
+
+func (s *stream) RecvProto(m proto.Message) error {
+	d, err := s.Recv()
+	if err != nil {
+		return err
+	}
+	proto.Merge(m, d)
+	return nil
+}
+
+func (s *stream) SendProto(m proto.Message) error { return errSendOnReceiveStream }
+func (s *stream) Context() context.Context        { return s.ctx }
+func (s *stream) Header() (metadata.MD, error)    { return nil, nil }
+func (s *stream) Trailer() metadata.MD            { return nil }
+func (s *stream) CloseSend() error                { return nil }
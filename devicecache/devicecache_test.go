@@ -0,0 +1,240 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package devicecache_test
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/devicecache"
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+type DeviceStream struct {
+	devices []*devicepresence.Device
+	grpc.ClientStream
+}
+
+func (s *DeviceStream) Recv() (*devicepresence.Device, error) {
+	if len(s.devices) == 0 {
+		return nil, io.EOF
+	}
+	d := s.devices[0]
+	s.devices = s.devices[1:]
+	return d, nil
+}
+
+// PresenceMock returns the devices of users and counts the lookups.
+type PresenceMock struct {
+	devicepresence.PresenceManagerClient
+
+	devices map[string][]*devicepresence.Device
+	err     error
+	block   chan struct{}
+	lookups int32
+}
+
+func (m *PresenceMock) GetDevices(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+	atomic.AddInt32(&m.lookups, 1)
+	if m.block != nil {
+		select {
+		case <-m.block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &DeviceStream{devices: append([]*devicepresence.Device{}, m.devices[in.UserId]...)}, nil
+}
+
+func (m *PresenceMock) RegisterDevice(ctx context.Context, in *devicepresence.Device, opts ...grpc.CallOption) (*devicepresence.RegisterDeviceReply, error) {
+	m.devices[in.UserId] = append(m.devices[in.UserId], in)
+	return &devicepresence.RegisterDeviceReply{}, nil
+}
+
+func (m *PresenceMock) Lookups() int {
+	return int(atomic.LoadInt32(&m.lookups))
+}
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time { return c.now }
+
+func newClient(p *PresenceMock, c *clock) *devicecache.Client {
+	return devicecache.NewClient(p, func(props *devicecache.Properties) {
+		props.TTL = 5 * time.Second
+		props.NegativeTTL = time.Second
+		props.Now = c.Now
+	})
+}
+
+func ids(t *testing.T, c *devicecache.Client, userID string) []string {
+	stream, err := c.GetDevices(context.Background(), &devicepresence.DevicesRequest{UserId: userID})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var ids []string
+	for {
+		d, err := stream.Recv()
+		if err == io.EOF {
+			return ids
+		} else if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		ids = append(ids, d.Id)
+	}
+}
+
+func TestClientCachesDevices(t *testing.T) {
+	p := &PresenceMock{devices: map[string][]*devicepresence.Device{
+		"user1": {{Id: "1"}, {Id: "2"}},
+	}}
+	c := &clock{time.Unix(0, 0)}
+	client := newClient(p, c)
+	for i := 0; i < 3; i++ {
+		if got := ids(t, client, "user1"); len(got) != 2 || got[1] != "2" {
+			t.Errorf("Wrong devices: %v", got)
+		}
+	}
+	if p.Lookups() != 1 {
+		t.Errorf("Expecting 1 lookup but got %d", p.Lookups())
+	}
+	c.now = c.now.Add(5 * time.Second)
+	ids(t, client, "user1")
+	if p.Lookups() != 2 {
+		t.Errorf("Expired device list was not looked up again")
+	}
+}
+
+func TestClientCachesUsersWithoutDevicesShortly(t *testing.T) {
+	p := &PresenceMock{devices: map[string][]*devicepresence.Device{}}
+	c := &clock{time.Unix(0, 0)}
+	client := newClient(p, c)
+	ids(t, client, "user1")
+	ids(t, client, "user1")
+	if p.Lookups() != 1 {
+		t.Errorf("Expecting 1 lookup but got %d", p.Lookups())
+	}
+	c.now = c.now.Add(time.Second)
+	ids(t, client, "user1")
+	if p.Lookups() != 2 {
+		t.Errorf("Expecting the negative TTL to apply")
+	}
+}
+
+func TestClientDoesNotCacheErrors(t *testing.T) {
+	p := &PresenceMock{err: errors.New("unavailable")}
+	client := newClient(p, &clock{time.Unix(0, 0)})
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetDevices(context.Background(), &devicepresence.DevicesRequest{UserId: "user1"}); err == nil {
+			t.Error("Expecting an error")
+		}
+	}
+	if p.Lookups() != 2 {
+		t.Errorf("Expecting 2 lookups but got %d", p.Lookups())
+	}
+}
+
+func TestClientCollapsesConcurrentLookups(t *testing.T) {
+	p := &PresenceMock{
+		devices: map[string][]*devicepresence.Device{"user1": {{Id: "1"}}},
+		block:   make(chan struct{}),
+	}
+	client := newClient(p, &clock{time.Unix(0, 0)})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := ids(t, client, "user1"); len(got) != 1 {
+				t.Errorf("Wrong devices: %v", got)
+			}
+		}()
+	}
+	for p.Lookups() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(p.block)
+	wg.Wait()
+	if p.Lookups() != 1 {
+		t.Errorf("Expecting 1 lookup but got %d", p.Lookups())
+	}
+}
+
+func TestClientLookupOutlivesFirstCaller(t *testing.T) {
+	p := &PresenceMock{
+		devices: map[string][]*devicepresence.Device{"user1": {{Id: "1"}}},
+		block:   make(chan struct{}),
+	}
+	client := newClient(p, &clock{time.Unix(0, 0)})
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := client.Devices(ctx, "user1")
+		first <- err
+	}()
+	for p.Lookups() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan []string, 1)
+	go func() {
+		second <- ids(t, client, "user1")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("Expecting the first caller to be canceled but got: %v", err)
+	}
+	close(p.block)
+	if got := <-second; len(got) != 1 {
+		t.Errorf("Expecting the shared lookup to succeed but got %v", got)
+	}
+	if p.Lookups() != 1 {
+		t.Errorf("Expecting 1 lookup but got %d", p.Lookups())
+	}
+}
+
+func TestClientInvalidate(t *testing.T) {
+	p := &PresenceMock{devices: map[string][]*devicepresence.Device{
+		"user1": {{Id: "1"}},
+	}}
+	client := newClient(p, &clock{time.Unix(0, 0)})
+	ids(t, client, "user1")
+	client.Invalidate("user1")
+	ids(t, client, "user1")
+	if p.Lookups() != 2 {
+		t.Errorf("Expecting 2 lookups but got %d", p.Lookups())
+	}
+
+	_, err := client.RegisterDevice(context.Background(), &devicepresence.Device{Id: "2", UserId: "user1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := ids(t, client, "user1"); len(got) != 2 {
+		t.Errorf("Registered device missing: %v", got)
+	}
+}
@@ -10,7 +10,14 @@ It is generated from these files:
 
 It has these top-level messages:
 	DevicesRequest
+	UsersDevicesRequest
+	UserDevices
 	Device
+	RegisterDeviceReply
+	DeviceKeyRequest
+	DeviceKey
+	RemoveDeviceRequest
+	RemoveDeviceReply
 */
 package devicepresence
 
@@ -31,14 +38,29 @@ var _ = proto.Marshal
 type Device_Type int32
 
 const (
-	Device_WS Device_Type = 0
+	Device_WS      Device_Type = 0
+	Device_APNS    Device_Type = 1
+	Device_FCM     Device_Type = 2
+	Device_EMAIL   Device_Type = 3
+	Device_WEBHOOK Device_Type = 4
+	Device_SSE     Device_Type = 5
 )
 
 var Device_Type_name = map[int32]string{
 	0: "WS",
+	1: "APNS",
+	2: "FCM",
+	3: "EMAIL",
+	4: "WEBHOOK",
+	5: "SSE",
 }
 var Device_Type_value = map[string]int32{
-	"WS": 0,
+	"WS":      0,
+	"APNS":    1,
+	"FCM":     2,
+	"EMAIL":   3,
+	"WEBHOOK": 4,
+	"SSE":     5,
 }
 
 func (x Device_Type) String() string {
@@ -73,17 +95,93 @@ func (m *DevicesRequest) Reset()         { *m = DevicesRequest{} }
 func (m *DevicesRequest) String() string { return proto.CompactTextString(m) }
 func (*DevicesRequest) ProtoMessage()    {}
 
+type UsersDevicesRequest struct {
+	UserIds []string `protobuf:"bytes,1,rep,name=user_ids" json:"user_ids,omitempty"`
+}
+
+func (m *UsersDevicesRequest) Reset()         { *m = UsersDevicesRequest{} }
+func (m *UsersDevicesRequest) String() string { return proto.CompactTextString(m) }
+func (*UsersDevicesRequest) ProtoMessage()    {}
+
+type UserDevices struct {
+	UserId  string    `protobuf:"bytes,1,opt,name=user_id" json:"user_id,omitempty"`
+	Devices []*Device `protobuf:"bytes,2,rep,name=devices" json:"devices,omitempty"`
+}
+
+func (m *UserDevices) Reset()         { *m = UserDevices{} }
+func (m *UserDevices) String() string { return proto.CompactTextString(m) }
+func (*UserDevices) ProtoMessage()    {}
+
+func (m *UserDevices) GetDevices() []*Device {
+	if m != nil {
+		return m.Devices
+	}
+	return nil
+}
+
 type Device struct {
 	Id     string        `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
 	Type   Device_Type   `protobuf:"varint,2,opt,name=type,enum=devicepresence.Device_Type" json:"type,omitempty"`
 	UserId string        `protobuf:"bytes,3,opt,name=user_id" json:"user_id,omitempty"`
 	Status Device_Status `protobuf:"varint,4,opt,name=status,enum=devicepresence.Device_Status" json:"status,omitempty"`
+	// Unix time in milliseconds the device was last active.
+	LastActive int64 `protobuf:"varint,5,opt,name=last_active" json:"last_active,omitempty"`
+	// KeyId identifies the current encryption key of the device. Messages to
+	// devices without a key are not encrypted.
+	KeyId string `protobuf:"bytes,6,opt,name=key_id" json:"key_id,omitempty"`
+	// Node is the address of the gateway node holding the socket of a WS
+	// device. The default socket service is used if empty.
+	Node string `protobuf:"bytes,7,opt,name=node" json:"node,omitempty"`
 }
 
 func (m *Device) Reset()         { *m = Device{} }
 func (m *Device) String() string { return proto.CompactTextString(m) }
 func (*Device) ProtoMessage()    {}
 
+type RegisterDeviceReply struct {
+}
+
+func (m *RegisterDeviceReply) Reset()         { *m = RegisterDeviceReply{} }
+func (m *RegisterDeviceReply) String() string { return proto.CompactTextString(m) }
+func (*RegisterDeviceReply) ProtoMessage()    {}
+
+type DeviceKeyRequest struct {
+	UserId   string      `protobuf:"bytes,1,opt,name=user_id" json:"user_id,omitempty"`
+	DeviceId string      `protobuf:"bytes,2,opt,name=device_id" json:"device_id,omitempty"`
+	Type     Device_Type `protobuf:"varint,3,opt,name=type,enum=devicepresence.Device_Type" json:"type,omitempty"`
+}
+
+func (m *DeviceKeyRequest) Reset()         { *m = DeviceKeyRequest{} }
+func (m *DeviceKeyRequest) String() string { return proto.CompactTextString(m) }
+func (*DeviceKeyRequest) ProtoMessage()    {}
+
+// DeviceKey is an X25519 public key.
+type DeviceKey struct {
+	KeyId     string `protobuf:"bytes,1,opt,name=key_id" json:"key_id,omitempty"`
+	PublicKey []byte `protobuf:"bytes,2,opt,name=public_key,proto3" json:"public_key,omitempty"`
+}
+
+func (m *DeviceKey) Reset()         { *m = DeviceKey{} }
+func (m *DeviceKey) String() string { return proto.CompactTextString(m) }
+func (*DeviceKey) ProtoMessage()    {}
+
+type RemoveDeviceRequest struct {
+	UserId   string      `protobuf:"bytes,1,opt,name=user_id" json:"user_id,omitempty"`
+	DeviceId string      `protobuf:"bytes,2,opt,name=device_id" json:"device_id,omitempty"`
+	Type     Device_Type `protobuf:"varint,3,opt,name=type,enum=devicepresence.Device_Type" json:"type,omitempty"`
+}
+
+func (m *RemoveDeviceRequest) Reset()         { *m = RemoveDeviceRequest{} }
+func (m *RemoveDeviceRequest) String() string { return proto.CompactTextString(m) }
+func (*RemoveDeviceRequest) ProtoMessage()    {}
+
+type RemoveDeviceReply struct {
+}
+
+func (m *RemoveDeviceReply) Reset()         { *m = RemoveDeviceReply{} }
+func (m *RemoveDeviceReply) String() string { return proto.CompactTextString(m) }
+func (*RemoveDeviceReply) ProtoMessage()    {}
+
 func init() {
 	proto.RegisterEnum("devicepresence.Device_Type", Device_Type_name, Device_Type_value)
 	proto.RegisterEnum("devicepresence.Device_Status", Device_Status_name, Device_Status_value)
@@ -93,6 +191,14 @@ func init() {
 
 type PresenceManagerClient interface {
 	GetDevices(ctx context.Context, in *DevicesRequest, opts ...grpc.CallOption) (PresenceManager_GetDevicesClient, error)
+	// GetUsersDevices returns the devices of several users, one message per
+	// user.
+	GetUsersDevices(ctx context.Context, in *UsersDevicesRequest, opts ...grpc.CallOption) (PresenceManager_GetUsersDevicesClient, error)
+	RegisterDevice(ctx context.Context, in *Device, opts ...grpc.CallOption) (*RegisterDeviceReply, error)
+	RemoveDevice(ctx context.Context, in *RemoveDeviceRequest, opts ...grpc.CallOption) (*RemoveDeviceReply, error)
+	// GetDeviceKey returns the current public key the device registered for
+	// end-to-end encryption.
+	GetDeviceKey(ctx context.Context, in *DeviceKeyRequest, opts ...grpc.CallOption) (*DeviceKey, error)
 }
 
 type presenceManagerClient struct {
@@ -135,10 +241,77 @@ func (x *presenceManagerGetDevicesClient) Recv() (*Device, error) {
 	return m, nil
 }
 
+func (c *presenceManagerClient) GetUsersDevices(ctx context.Context, in *UsersDevicesRequest, opts ...grpc.CallOption) (PresenceManager_GetUsersDevicesClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_PresenceManager_serviceDesc.Streams[1], c.cc, "/devicepresence.PresenceManager/GetUsersDevices", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &presenceManagerGetUsersDevicesClient{stream}
+	if err := x.ClientStream.SendProto(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type PresenceManager_GetUsersDevicesClient interface {
+	Recv() (*UserDevices, error)
+	grpc.ClientStream
+}
+
+type presenceManagerGetUsersDevicesClient struct {
+	grpc.ClientStream
+}
+
+func (x *presenceManagerGetUsersDevicesClient) Recv() (*UserDevices, error) {
+	m := new(UserDevices)
+	if err := x.ClientStream.RecvProto(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *presenceManagerClient) RegisterDevice(ctx context.Context, in *Device, opts ...grpc.CallOption) (*RegisterDeviceReply, error) {
+	out := new(RegisterDeviceReply)
+	err := grpc.Invoke(ctx, "/devicepresence.PresenceManager/RegisterDevice", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *presenceManagerClient) RemoveDevice(ctx context.Context, in *RemoveDeviceRequest, opts ...grpc.CallOption) (*RemoveDeviceReply, error) {
+	out := new(RemoveDeviceReply)
+	err := grpc.Invoke(ctx, "/devicepresence.PresenceManager/RemoveDevice", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *presenceManagerClient) GetDeviceKey(ctx context.Context, in *DeviceKeyRequest, opts ...grpc.CallOption) (*DeviceKey, error) {
+	out := new(DeviceKey)
+	err := grpc.Invoke(ctx, "/devicepresence.PresenceManager/GetDeviceKey", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for PresenceManager service
 
 type PresenceManagerServer interface {
 	GetDevices(*DevicesRequest, PresenceManager_GetDevicesServer) error
+	// GetUsersDevices returns the devices of several users, one message per
+	// user.
+	GetUsersDevices(*UsersDevicesRequest, PresenceManager_GetUsersDevicesServer) error
+	RegisterDevice(context.Context, *Device) (*RegisterDeviceReply, error)
+	RemoveDevice(context.Context, *RemoveDeviceRequest) (*RemoveDeviceReply, error)
+	// GetDeviceKey returns the current public key the device registered for
+	// end-to-end encryption.
+	GetDeviceKey(context.Context, *DeviceKeyRequest) (*DeviceKey, error)
 }
 
 func RegisterPresenceManagerServer(s *grpc.Server, srv PresenceManagerServer) {
@@ -166,15 +339,90 @@ func (x *presenceManagerGetDevicesServer) Send(m *Device) error {
 	return x.ServerStream.SendProto(m)
 }
 
+func _PresenceManager_GetUsersDevices_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(UsersDevicesRequest)
+	if err := stream.RecvProto(m); err != nil {
+		return err
+	}
+	return srv.(PresenceManagerServer).GetUsersDevices(m, &presenceManagerGetUsersDevicesServer{stream})
+}
+
+type PresenceManager_GetUsersDevicesServer interface {
+	Send(*UserDevices) error
+	grpc.ServerStream
+}
+
+type presenceManagerGetUsersDevicesServer struct {
+	grpc.ServerStream
+}
+
+func (x *presenceManagerGetUsersDevicesServer) Send(m *UserDevices) error {
+	return x.ServerStream.SendProto(m)
+}
+
+func _PresenceManager_RegisterDevice_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(Device)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PresenceManagerServer).RegisterDevice(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PresenceManager_RemoveDevice_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(RemoveDeviceRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PresenceManagerServer).RemoveDevice(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PresenceManager_GetDeviceKey_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(DeviceKeyRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PresenceManagerServer).GetDeviceKey(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 var _PresenceManager_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "devicepresence.PresenceManager",
 	HandlerType: (*PresenceManagerServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RegisterDevice",
+			Handler:    _PresenceManager_RegisterDevice_Handler,
+		},
+		{
+			MethodName: "RemoveDevice",
+			Handler:    _PresenceManager_RemoveDevice_Handler,
+		},
+		{
+			MethodName: "GetDeviceKey",
+			Handler:    _PresenceManager_GetDeviceKey_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "GetDevices",
 			Handler:       _PresenceManager_GetDevices_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "GetUsersDevices",
+			Handler:       _PresenceManager_GetUsersDevices_Handler,
+			ServerStreams: true,
+		},
 	},
 }
@@ -0,0 +1,57 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package health
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Checker implements the grpc.health.v1.Health service. The empty service
+// name reports the health of the server as a whole.
+type Checker struct {
+	mu       sync.Mutex
+	statuses map[string]HealthCheckResponse_ServingStatus
+}
+
+func NewChecker() *Checker {
+	return &Checker{
+		statuses: map[string]HealthCheckResponse_ServingStatus{
+			"": HealthCheckResponse_NOT_SERVING,
+		},
+	}
+}
+
+func (c *Checker) Check(ctx context.Context, req *HealthCheckRequest) (*HealthCheckResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status, ok := c.statuses[req.Service]
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "unknown service %q", req.Service)
+	}
+	return &HealthCheckResponse{
+		Status: status,
+	}, nil
+}
+
+func (c *Checker) SetServingStatus(service string, status HealthCheckResponse_ServingStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statuses[service] = status
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package health_test
+
+import (
+	"testing"
+
+	"github.com/protogalaxy/service-notify/health"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func assertStatus(t *testing.T, c *health.Checker, service string, expected health.HealthCheckResponse_ServingStatus) {
+	res, err := c.Check(context.Background(), &health.HealthCheckRequest{Service: service})
+	if err != nil {
+		t.Fatalf("Unexpected error checking '%s': %s", service, err)
+	}
+	if res.Status != expected {
+		t.Errorf("Wrong status for '%s': expecting %s but got %s", service, expected, res.Status)
+	}
+}
+
+func TestCheckerServerNotServingByDefault(t *testing.T) {
+	assertStatus(t, health.NewChecker(), "", health.HealthCheckResponse_NOT_SERVING)
+}
+
+func TestCheckerSetServingStatus(t *testing.T) {
+	c := health.NewChecker()
+	c.SetServingStatus("notify.Notifier", health.HealthCheckResponse_SERVING)
+	assertStatus(t, c, "notify.Notifier", health.HealthCheckResponse_SERVING)
+}
+
+func TestCheckerUnknownService(t *testing.T) {
+	_, err := health.NewChecker().Check(context.Background(), &health.HealthCheckRequest{Service: "unknown"})
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expecting NotFound error but got: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package health
+
+import (
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Readiness reports SERVING for a set of services only while all of the
+// dependencies it tracks are ready and the server is not draining.
+type Readiness struct {
+	checker  *Checker
+	services []string
+
+	mu       sync.Mutex
+	pending  map[string]bool
+	draining bool
+}
+
+func NewReadiness(checker *Checker, services []string, deps ...string) *Readiness {
+	r := &Readiness{
+		checker:  checker,
+		services: services,
+		pending:  make(map[string]bool),
+	}
+	for _, dep := range deps {
+		r.pending[dep] = true
+	}
+	r.update()
+	return r
+}
+
+// Ready marks the dependency as available.
+func (r *Readiness) Ready(dep string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending[dep] {
+		glog.V(2).Infof("Dependency '%s' is ready", dep)
+	}
+	delete(r.pending, dep)
+	r.update()
+}
+
+// NotReady marks the dependency as unavailable.
+func (r *Readiness) NotReady(dep string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.pending[dep] {
+		glog.Warningf("Dependency '%s' is not ready", dep)
+	}
+	r.pending[dep] = true
+	r.update()
+}
+
+// Drain permanently reports NOT_SERVING regardless of the dependencies.
+func (r *Readiness) Drain() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.draining = true
+	r.update()
+}
+
+func (r *Readiness) update() {
+	status := HealthCheckResponse_SERVING
+	if r.draining || len(r.pending) > 0 {
+		status = HealthCheckResponse_NOT_SERVING
+	}
+	for _, s := range r.services {
+		r.checker.SetServingStatus(s, status)
+	}
+}
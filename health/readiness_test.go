@@ -0,0 +1,53 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package health_test
+
+import (
+	"testing"
+
+	"github.com/protogalaxy/service-notify/health"
+)
+
+func TestReadinessServingWhenAllDependenciesReady(t *testing.T) {
+	c := health.NewChecker()
+	r := health.NewReadiness(c, []string{""}, "presence", "socket")
+	assertStatus(t, c, "", health.HealthCheckResponse_NOT_SERVING)
+	r.Ready("presence")
+	assertStatus(t, c, "", health.HealthCheckResponse_NOT_SERVING)
+	r.Ready("socket")
+	assertStatus(t, c, "", health.HealthCheckResponse_SERVING)
+}
+
+func TestReadinessDependencyLost(t *testing.T) {
+	c := health.NewChecker()
+	r := health.NewReadiness(c, []string{""}, "presence")
+	r.Ready("presence")
+	r.NotReady("presence")
+	assertStatus(t, c, "", health.HealthCheckResponse_NOT_SERVING)
+	r.Ready("presence")
+	assertStatus(t, c, "", health.HealthCheckResponse_SERVING)
+}
+
+func TestReadinessDrain(t *testing.T) {
+	c := health.NewChecker()
+	r := health.NewReadiness(c, []string{"", "notify.Notifier"})
+	assertStatus(t, c, "notify.Notifier", health.HealthCheckResponse_SERVING)
+	r.Drain()
+	assertStatus(t, c, "", health.HealthCheckResponse_NOT_SERVING)
+	assertStatus(t, c, "notify.Notifier", health.HealthCheckResponse_NOT_SERVING)
+	r.Ready("anything")
+	assertStatus(t, c, "notify.Notifier", health.HealthCheckResponse_NOT_SERVING)
+}
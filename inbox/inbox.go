@@ -0,0 +1,185 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package inbox keeps notifications that could not be delivered to any
+// online device until the user comes back.
+package inbox
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/protogalaxy/service-notify/queue"
+)
+
+// Store retains undelivered messages per user.
+type Store interface {
+	Put(msg queue.QueuedMessage)
+	// Take removes and returns the unexpired messages of the user, oldest
+	// first.
+	Take(userID string) []queue.QueuedMessage
+}
+
+type Properties struct {
+	// TTL is how long a message is kept.
+	TTL time.Duration
+	// MaxMessages is the number of messages kept per user. The oldest
+	// messages are dropped first.
+	MaxMessages int
+	// MaxUsers is the number of users with stored messages. The user whose
+	// inbox was updated least recently is dropped first.
+	MaxUsers int
+	// Now returns the current time.
+	Now func() time.Time
+}
+
+// MemoryStore is an in-memory Store.
+type MemoryStore struct {
+	properties *Properties
+
+	mu    sync.Mutex
+	users map[string]*userInbox
+	// updates holds the user ids ordered by the last update of their inbox,
+	// least recent first.
+	updates *list.List
+}
+
+type userInbox struct {
+	messages []entry
+	update   *list.Element
+}
+
+type entry struct {
+	msg     queue.QueuedMessage
+	expires time.Time
+}
+
+func NewMemoryStore(conf ...func(*Properties)) *MemoryStore {
+	p := &Properties{
+		TTL:         24 * time.Hour,
+		MaxMessages: 100,
+		MaxUsers:    100000,
+		Now:         time.Now,
+	}
+	for _, f := range conf {
+		f(p)
+	}
+	return &MemoryStore{
+		properties: p,
+		users:      make(map[string]*userInbox),
+		updates:    list.New(),
+	}
+}
+
+func (s *MemoryStore) Put(msg queue.QueuedMessage) {
+	now := s.properties.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.users[msg.UserId]
+	if u == nil {
+		if len(s.users) >= s.properties.MaxUsers {
+			s.evict()
+		}
+		u = &userInbox{update: s.updates.PushBack(msg.UserId)}
+		s.users[msg.UserId] = u
+	} else {
+		s.updates.MoveToBack(u.update)
+	}
+	u.expire(now)
+	// The message replaces the message it collapses at the end of the inbox
+	// so the messages stay ordered by expiry.
+	for i := range u.messages {
+		if queue.Collapses(u.messages[i].msg, msg) {
+			u.messages = append(u.messages[:i], u.messages[i+1:]...)
+			break
+		}
+	}
+	u.messages = append(u.messages, entry{
+		msg:     msg,
+		expires: now.Add(s.properties.TTL),
+	})
+	if n := len(u.messages) - s.properties.MaxMessages; n > 0 {
+		glog.Warningf("Inbox of user %s full, dropping %d messages", msg.UserId, n)
+		u.messages = u.messages[n:]
+	}
+}
+
+func (s *MemoryStore) Take(userID string) []queue.QueuedMessage {
+	now := s.properties.Now()
+	s.mu.Lock()
+	u := s.users[userID]
+	if u != nil {
+		s.remove(userID, u)
+	}
+	s.mu.Unlock()
+	if u == nil {
+		return nil
+	}
+	u.expire(now)
+	msgs := make([]queue.QueuedMessage, len(u.messages))
+	for i, e := range u.messages {
+		msgs[i] = e.msg
+	}
+	return msgs
+}
+
+// Len returns the number of stored messages of the user.
+func (s *MemoryStore) Len(userID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.users[userID]; u != nil {
+		return len(u.messages)
+	}
+	return 0
+}
+
+// Expire drops expired messages of all users.
+func (s *MemoryStore) Expire() {
+	now := s.properties.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, u := range s.users {
+		u.expire(now)
+		if len(u.messages) == 0 {
+			s.remove(id, u)
+		}
+	}
+}
+
+// evict drops the inbox updated least recently.
+func (s *MemoryStore) evict() {
+	front := s.updates.Front()
+	if front == nil {
+		return
+	}
+	oldest := front.Value.(string)
+	glog.Warningf("Too many inboxes, dropping inbox of user %s", oldest)
+	s.remove(oldest, s.users[oldest])
+}
+
+func (s *MemoryStore) remove(userID string, u *userInbox) {
+	delete(s.users, userID)
+	s.updates.Remove(u.update)
+}
+
+func (u *userInbox) expire(now time.Time) {
+	i := 0
+	for i < len(u.messages) && !now.Before(u.messages[i].expires) {
+		i++
+	}
+	u.messages = u.messages[i:]
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package inbox_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/inbox"
+	"github.com/protogalaxy/service-notify/queue"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time { return c.now }
+
+func newStore(c *clock, maxMessages, maxUsers int) *inbox.MemoryStore {
+	return inbox.NewMemoryStore(func(p *inbox.Properties) {
+		p.TTL = time.Minute
+		p.MaxMessages = maxMessages
+		p.MaxUsers = maxUsers
+		p.Now = c.Now
+	})
+}
+
+func ids(msgs []queue.QueuedMessage) []string {
+	var ids []string
+	for _, m := range msgs {
+		ids = append(ids, m.Id)
+	}
+	return ids
+}
+
+func TestMemoryStoreTakeReturnsMessagesInOrder(t *testing.T) {
+	s := newStore(&clock{time.Unix(0, 0)}, 10, 10)
+	s.Put(queue.QueuedMessage{Id: "1", UserId: "user1"})
+	s.Put(queue.QueuedMessage{Id: "2", UserId: "user2"})
+	s.Put(queue.QueuedMessage{Id: "3", UserId: "user1"})
+
+	if got := ids(s.Take("user1")); len(got) != 2 || got[0] != "1" || got[1] != "3" {
+		t.Errorf("Unexpected messages: %v", got)
+	}
+	if got := s.Take("user1"); len(got) != 0 {
+		t.Errorf("Taken messages must be removed: %v", ids(got))
+	}
+	if s.Len("user2") != 1 {
+		t.Error("Messages of other users must be kept")
+	}
+}
+
+func TestMemoryStoreExpiresMessages(t *testing.T) {
+	c := &clock{time.Unix(0, 0)}
+	s := newStore(c, 10, 10)
+	s.Put(queue.QueuedMessage{Id: "1", UserId: "user1"})
+	c.now = c.now.Add(30 * time.Second)
+	s.Put(queue.QueuedMessage{Id: "2", UserId: "user1"})
+	s.Put(queue.QueuedMessage{Id: "3", UserId: "user2"})
+	c.now = c.now.Add(45 * time.Second)
+
+	if got := ids(s.Take("user1")); len(got) != 1 || got[0] != "2" {
+		t.Errorf("Unexpected messages: %v", got)
+	}
+	c.now = c.now.Add(time.Minute)
+	s.Expire()
+	if s.Len("user2") != 0 {
+		t.Error("Expired messages must be dropped")
+	}
+}
+
+func TestMemoryStoreDropsOldestMessages(t *testing.T) {
+	s := newStore(&clock{time.Unix(0, 0)}, 2, 10)
+	for _, id := range []string{"1", "2", "3"} {
+		s.Put(queue.QueuedMessage{Id: id, UserId: "user1"})
+	}
+	if got := ids(s.Take("user1")); len(got) != 2 || got[0] != "2" || got[1] != "3" {
+		t.Errorf("Unexpected messages: %v", got)
+	}
+}
+
+func TestMemoryStoreDropsLeastRecentlyUpdatedUser(t *testing.T) {
+	c := &clock{time.Unix(0, 0)}
+	s := newStore(c, 10, 2)
+	s.Put(queue.QueuedMessage{Id: "1", UserId: "user1"})
+	c.now = c.now.Add(time.Second)
+	s.Put(queue.QueuedMessage{Id: "2", UserId: "user2"})
+	c.now = c.now.Add(time.Second)
+	s.Put(queue.QueuedMessage{Id: "3", UserId: "user1"})
+	c.now = c.now.Add(time.Second)
+	s.Put(queue.QueuedMessage{Id: "4", UserId: "user3"})
+
+	if s.Len("user2") != 0 {
+		t.Error("Least recently updated inbox must be dropped")
+	}
+	if s.Len("user1") != 2 || s.Len("user3") != 1 {
+		t.Error("Other inboxes must be kept")
+	}
+}
+
+func TestMemoryStoreCollapsesMessages(t *testing.T) {
+	s := newStore(&clock{time.Unix(0, 0)}, 10, 10)
+	s.Put(queue.QueuedMessage{Id: "1", UserId: "user1", CollapseKey: "score"})
+	s.Put(queue.QueuedMessage{Id: "2", UserId: "user1"})
+	s.Put(queue.QueuedMessage{Id: "3", UserId: "user1", CollapseKey: "score"})
+
+	if got := ids(s.Take("user1")); len(got) != 2 || got[0] != "2" || got[1] != "3" {
+		t.Errorf("Unexpected messages: %v", got)
+	}
+}
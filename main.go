@@ -15,51 +15,660 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/smtp"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/protogalaxy/service-notify/admin"
+	"github.com/protogalaxy/service-notify/audit"
+	"github.com/protogalaxy/service-notify/auth"
+	"github.com/protogalaxy/service-notify/devicecache"
 	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/health"
+	"github.com/protogalaxy/service-notify/inbox"
 	"github.com/protogalaxy/service-notify/notify"
+	"github.com/protogalaxy/service-notify/preferences"
 	"github.com/protogalaxy/service-notify/queue"
 	"github.com/protogalaxy/service-notify/socket"
+	"github.com/protogalaxy/service-notify/templates"
+	"github.com/protogalaxy/service-notify/tlsutil"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+var (
+	listenAddr     = flag.String("listen", ":9090", "address the notifier service listens on")
+	adminAddr      = flag.String("admin_listen", "127.0.0.1:9093", "address the admin service listens on")
+	adminTokens    = flag.String("admin_tokens", "", "JSON file mapping operator tokens to operator names, required unless the admin service listens on loopback")
+	presenceAddr   = flag.String("presence", "localhost:9091", "address of the device presence service")
+	socketAddr     = flag.String("socket", "localhost:9092", "address of the socket service for devices without a gateway node")
+	probeInterval  = flag.Duration("probe_interval", 5*time.Second, "how often upstream services are probed for reachability")
+	messageTimeout = flag.Duration("message_timeout", 30*time.Second, "how long delivering a single message to the devices of a user may take")
+	lookupAttempts = flag.Int("lookup_attempts", 5, "how often a message is handled before it is dropped when the devices of the user cannot be looked up")
+	lookupRetry    = flag.Duration("lookup_retry_delay", 5*time.Second, "delay before a message is handled again after its devices could not be looked up, doubled for every attempt")
+	drainTimeout   = flag.Duration("drain_timeout", 5*time.Second, "how long to report NOT_SERVING before shutting down")
+
+	tlsCert           = flag.String("tls_cert", "", "certificate file enabling TLS for the notifier service")
+	tlsKey            = flag.String("tls_key", "", "private key file of the notifier service certificate")
+	tlsClientCA       = flag.String("tls_client_ca", "", "CA file used to require and verify client certificates")
+	upstreamCA        = flag.String("upstream_ca", "", "CA file enabling TLS for the presence and socket connections")
+	upstreamCert      = flag.String("upstream_cert", "", "client certificate file presented to the presence and socket services")
+	upstreamKey       = flag.String("upstream_key", "", "private key file of the upstream client certificate")
+	tlsReloadInterval = flag.Duration("tls_reload_interval", time.Minute, "how often certificate files are checked for changes")
+
+	authTokens  = flag.String("auth_tokens", "", "JSON file mapping static caller tokens to caller names")
+	authHMACKey = flag.String("auth_hmac_key", "", "file containing the key used to verify HMAC signed caller tokens")
+	authPolicy  = flag.String("auth_policy", "", "JSON file with the rules deciding which callers may notify which users")
+
+	auditLog     = flag.String("audit_log", "", "file the audit log of notifications is appended to")
+	auditMaxSize = flag.Int64("audit_max_size", 100<<20, "size in bytes after which the audit log is rotated")
+	auditMaxAge  = flag.Duration("audit_max_age", 24*time.Hour, "age after which the audit log is rotated")
+	auditPayload = flag.Bool("audit_payload", false, "include notification payloads in the audit log")
+	auditRedact  = flag.String("audit_redact", "", "comma separated top level JSON fields redacted from payloads in the audit log")
+
+	maxPayloadSize  = flag.Int("max_payload_size", 256<<10, "maximum size in bytes of a notification payload, zero disables the limit")
+	socketEncoding  = flag.String("socket_encoding", "", "compression applied to WebSocket payloads, e.g. gzip")
+	webhookEncoding = flag.String("webhook_encoding", "", "compression applied to webhook request bodies, e.g. gzip")
+	compressMinSize = flag.Int("compress_min_size", 1024, "size in bytes from which payloads are compressed")
+	deviceKeyTTL    = flag.Duration("device_key_ttl", time.Hour, "how long device encryption keys are cached, zero disables end-to-end encryption")
+
+	inboxTTL         = flag.Duration("inbox_ttl", 24*time.Hour, "how long messages for users without online devices are kept, zero disables the inbox")
+	inboxMaxMessages = flag.Int("inbox_max_messages", 100, "number of stored messages kept per user")
+	inboxMaxUsers    = flag.Int("inbox_max_users", 100000, "number of users with stored messages")
+
+	deviceCacheTTL         = flag.Duration("device_cache_ttl", 5*time.Second, "how long device lists of users are cached, zero disables the cache")
+	deviceCacheNegativeTTL = flag.Duration("device_cache_negative_ttl", time.Second, "how long users without devices are cached")
+
+	presenceBatchWindow = flag.Duration("presence_batch_window", 2*time.Millisecond, "how long device lookups wait to be batched with lookups of other users, zero disables batching")
+	presenceBatchSize   = flag.Int("presence_batch_size", 100, "largest number of users looked up in one batch")
+
+	socketIdleTimeout  = flag.Duration("socket_idle_timeout", 5*time.Minute, "how long connections to gateway nodes are kept without sends")
+	socketDialTimeout  = flag.Duration("socket_dial_timeout", 5*time.Second, "how long connecting to a gateway node may take")
+	socketTimeout      = flag.Duration("socket_timeout", 10*time.Second, "timeout of a single WebSocket send")
+	socketBatchWindow  = flag.Duration("socket_batch_window", 2*time.Millisecond, "how long WebSocket sends wait to be batched with other sends, zero disables batching")
+	socketBatchSize    = flag.Int("socket_batch_size", 100, "largest number of messages sent to the socket service in one batch")
+	socketBatchTimeout = flag.Duration("socket_batch_timeout", 5*time.Second, "timeout of a single batch send to the socket service")
+
+	preferenceDefaults = flag.String("preference_defaults", "", "JSON file with the default preferences per notification category")
+
+	digestPolicies     = flag.String("digest_policies", "", "JSON file with the notification categories batched into periodic digests")
+	digestMaxPending   = flag.Int("digest_max_pending", 100000, "maximum number of digests held at once, one per user and category, zero disables the limit")
+	digestFlushTimeout = flag.Duration("digest_flush_timeout", 10*time.Second, "how long queueing the pending digests may take on shutdown")
+
+	fallbackPolicies = flag.String("fallback_policies", "", "JSON file with the named fallback chains requests may refer to")
+
+	templatesDir = flag.String("templates", "", "directory of notification templates named <template id>.<locale>.tmpl")
+	userLocales  = flag.String("user_locales", "", "JSON file mapping user ids to the locale templates are rendered in")
+
+	webhookKey     = flag.String("webhook_key", "", "file containing the key used to sign webhook requests, enables webhook devices")
+	webhookTimeout = flag.Duration("webhook_timeout", 10*time.Second, "timeout of a single webhook request")
+	webhookRetries = flag.Int("webhook_retries", 3, "how many times a webhook request is retried on 5xx and 429 responses")
+	webhookHosts   = flag.String("webhook_allowed_hosts", "", "comma separated host patterns webhook urls may point to, any public host if empty")
+
+	pushTitle      = flag.String("push_title", "", "title shown above the body of push notifications")
+	apnsKey        = flag.String("apns_key", "", "file containing the APNs token signing key, enables APNs devices")
+	apnsKeyID      = flag.String("apns_key_id", "", "id of the APNs signing key")
+	apnsTeamID     = flag.String("apns_team_id", "", "Apple developer team id")
+	apnsTopic      = flag.String("apns_topic", "", "bundle id of the app receiving APNs notifications")
+	apnsEndpoint   = flag.String("apns_endpoint", transport.APNSEndpoint, "base URL of the APNs service")
+	fcmCredentials = flag.String("fcm_credentials", "", "service account JSON file used for FCM, enables FCM devices")
+	fcmProject     = flag.String("fcm_project", "", "Firebase project id, defaults to the project of the service account")
+
+	smtpAddr       = flag.String("smtp", "", "address of the SMTP server, enables email devices")
+	smtpUser       = flag.String("smtp_user", "", "user name used to authenticate with the SMTP server")
+	smtpPassword   = flag.String("smtp_password", "", "file containing the password used to authenticate with the SMTP server")
+	smtpRequireTLS = flag.Bool("smtp_require_tls", true, "refuse to send email if the SMTP server does not offer STARTTLS")
+	emailFrom      = flag.String("email_from", "", "sender address of notification emails")
+	emailSubject   = flag.String("email_subject", transport.DefaultEmailSubject, "template of the notification email subject")
+	emailBody      = flag.String("email_body", "", "file containing the template of the notification email body")
+
+	sseAddr    = flag.String("sse_listen", "", "address the Server-Sent Events endpoint listens on, enables SSE devices and requires running a single instance")
+	sseHMACKey = flag.String("sse_hmac_key", "", "file containing the key used to verify HMAC signed user tokens of SSE clients")
+	sseReplay  = flag.Int("sse_replay", 32, "number of recent messages kept per user for resuming SSE clients")
+	sseLinger  = flag.Duration("sse_linger", 30*time.Second, "how long messages are buffered for a disconnected SSE client")
+)
+
+const (
+	depPresence = "presence"
+	depSocket   = "socket"
+	depWorkers  = "workers"
 )
 
 func main() {
 	flag.Parse()
 	rand.Seed(time.Now().UnixNano())
 
-	conn, err := grpc.Dial("localhost:9091")
+	checker := health.NewChecker()
+	readiness := health.NewReadiness(checker, []string{"", "notify.Notifier"}, depPresence, depSocket, depWorkers)
+
+	s, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		glog.Fatalf("failed to listen: %v", err)
+	}
+	var serverCreds credentials.TransportAuthenticator
+	if *tlsCert != "" {
+		r := newReloader(tlsutil.Files{CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsClientCA})
+		serverCreds = tlsutil.NewServerCredentials(r, *tlsClientCA != "")
+		s = serverCreds.NewListener(s)
+	} else if *tlsClientCA != "" {
+		glog.Fatal("client certificate verification requires TLS")
+	}
+
+	var dialOpts []grpc.DialOption
+	if *upstreamCA != "" || *upstreamCert != "" {
+		r := newReloader(tlsutil.Files{CertFile: *upstreamCert, KeyFile: *upstreamKey, CAFile: *upstreamCA})
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(tlsutil.NewClientCredentials(r, "")))
+	}
+
+	// Messages accepted before the upstream connections are established are
+	// buffered by the queue until the workers are started.
+	worker := &queue.Worker{}
+	q := queue.NewChannelQueue(worker.Do)
+
+	var auditLogger audit.Logger
+	if *auditLog != "" {
+		l, err := audit.NewFileLogger(*auditLog, func(p *audit.Properties) {
+			p.MaxSize = *auditMaxSize
+			p.MaxAge = *auditMaxAge
+			p.IncludePayload = *auditPayload
+			if *auditRedact != "" {
+				p.Redact = audit.RedactFields(strings.Split(*auditRedact, ",")...)
+			}
+		})
+		if err != nil {
+			glog.Fatalf("could not open audit log: %v", err)
+		}
+		defer l.Close()
+		auditLogger = l
+	}
+
+	var store inbox.Store
+	if *inboxTTL > 0 {
+		s := inbox.NewMemoryStore(func(p *inbox.Properties) {
+			p.TTL = *inboxTTL
+			p.MaxMessages = *inboxMaxMessages
+			p.MaxUsers = *inboxMaxUsers
+		})
+		go func() {
+			for range time.Tick(time.Minute) {
+				s.Expire()
+			}
+		}()
+		store = s
+	}
+
+	var defaults preferences.Defaults
+	if *preferenceDefaults != "" {
+		d, err := preferences.LoadDefaults(*preferenceDefaults)
+		if err != nil {
+			glog.Fatalf("could not load default preferences: %v", err)
+		}
+		defaults = d
+	}
+	prefs := preferences.NewMemoryStore(defaults)
+
+	coalescer := queue.NewCoalescer(q, func(p *queue.CoalescerProperties) {
+		p.MaxPayloadSize = *maxPayloadSize
+	})
+
+	grpcServer := grpc.NewServer()
+	health.RegisterHealthServer(grpcServer, checker)
+	notifier := &notify.Notifier{
+		Queue:          q,
+		Audit:          auditLogger,
+		Inbox:          store,
+		Preferences:    prefs,
+		Coalescer:      coalescer,
+		MaxPayloadSize: *maxPayloadSize,
+	}
+	configureAuth(notifier)
+	registry := templates.NewRegistry()
+	if *templatesDir != "" {
+		if err := registry.LoadDir(*templatesDir); err != nil {
+			glog.Fatalf("could not load templates: %v", err)
+		}
+	}
+	notifier.Templates = registry
+	if *userLocales != "" {
+		locales, err := templates.LoadUserLocales(*userLocales)
+		if err != nil {
+			glog.Fatalf("could not load user locales: %v", err)
+		}
+		notifier.Locales = locales
+	}
+	if *fallbackPolicies != "" {
+		policies, err := notify.LoadFallbackPolicies(*fallbackPolicies)
+		if err != nil {
+			glog.Fatalf("could not load fallback policies: %v", err)
+		}
+		notifier.FallbackPolicies = policies
+	}
+	if *digestPolicies != "" {
+		policies, err := notify.LoadDigestPolicies(*digestPolicies)
+		if err != nil {
+			glog.Fatalf("could not load digest policies: %v", err)
+		}
+		notifier.DigestPolicies = policies
+		notifier.MaxPendingDigests = *digestMaxPending
+	}
+	stopDigests := make(chan struct{})
+	digestsStopped := make(chan struct{})
+	go func() {
+		defer close(digestsStopped)
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				notifier.FlushDigests(now)
+			case <-stopDigests:
+				return
+			}
+		}
+	}()
+	notify.RegisterNotifierServer(grpcServer, notifier)
+	go grpcServer.Serve(s)
+
+	as, err := net.Listen("tcp", *adminAddr)
 	if err != nil {
-		glog.Fatalf("could not connect: %v", err)
+		glog.Fatalf("failed to listen: %v", err)
+	}
+	if serverCreds != nil {
+		as = serverCreds.NewListener(as)
+	}
+	operators := adminAuthenticator()
+	adminServer := grpc.NewServer()
+	admin.RegisterAdminServer(adminServer, &admin.Admin{
+		Queue:         q,
+		Worker:        worker,
+		Authenticator: operators,
+	})
+	templates.RegisterTemplatesServer(adminServer, &templates.Service{
+		Registry:      registry,
+		Authenticator: operators,
+	})
+	go adminServer.Serve(as)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	presenceConns := dialUpstream(readiness, depPresence, *presenceAddr, dialOpts...)
+	socketConns := dialUpstream(readiness, depSocket, *socketAddr, dialOpts...)
+	var presenceConn, socketConn *grpc.ClientConn
+	for presenceConn == nil || socketConn == nil {
+		select {
+		case presenceConn = <-presenceConns:
+		case socketConn = <-socketConns:
+		case s := <-sig:
+			glog.Infof("Received %s while connecting to upstream services, exiting", s)
+			grpcServer.Stop()
+			adminServer.Stop()
+			return
+		}
+	}
+	defer presenceConn.Close()
+	defer socketConn.Close()
+
+	var presence devicepresence.PresenceManagerClient = devicepresence.NewPresenceManagerClient(presenceConn)
+	if *presenceBatchWindow > 0 {
+		presence = devicecache.NewBatcher(presence, func(p *devicecache.BatchProperties) {
+			p.Window = *presenceBatchWindow
+			p.MaxUsers = *presenceBatchSize
+		})
+	}
+	// Device keys sit below the device cache so devices registered or
+	// removed through it have their cached key dropped as well.
+	var keys *transport.DeviceKeys
+	if *deviceKeyTTL > 0 {
+		keys = transport.NewDeviceKeys(presence, func(p *transport.DeviceKeysProperties) {
+			p.TTL = *deviceKeyTTL
+		})
+		presence = keys
+	}
+	if *deviceCacheTTL > 0 {
+		presence = devicecache.NewClient(presence, func(p *devicecache.Properties) {
+			p.TTL = *deviceCacheTTL
+			p.NegativeTTL = *deviceCacheNegativeTTL
+		})
+	}
+	nodes := transport.NewSocketPool(func(node string) (socket.SenderClient, func(), error) {
+		// grpc.Dial keeps retrying unreachable addresses so probe the node
+		// first.
+		c, err := net.DialTimeout("tcp", node, *socketDialTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.Close()
+		conn, err := grpc.Dial(node, dialOpts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newSender(conn), conn.Close, nil
+	}, func(p *transport.SocketPoolProperties) {
+		p.IdleTimeout = *socketIdleTimeout
+		p.DialTimeout = *socketDialTimeout
+	})
+	defer nodes.Close()
+	go func() {
+		for range time.Tick(time.Minute) {
+			nodes.Expire()
+		}
+	}()
+	transports := newTransports(newSender(socketConn), nodes, keys)
+	if email, ok := transports[devicepresence.Device_EMAIL].(*transport.Email); ok {
+		defer email.Close()
+	}
+	if *sseAddr != "" {
+		sse := serveSSE(presence)
+		defer sse.Close()
+		transports[devicepresence.Device_SSE] = sse
+	}
+	scheduler := queue.NewScheduler(q)
+	go scheduler.Run()
+	handler := &queue.Handler{
+		Presence:    presence,
+		Transports:  transports,
+		Fallbacks:   fallbackTransports(transports),
+		Inbox:       store,
+		Audit:       auditLogger,
+		Preferences: prefs,
+		Scheduler:   scheduler,
+		Timeout:     *messageTimeout,
+		MaxAttempts: *lookupAttempts,
+		RetryDelay:  *lookupRetry,
 	}
-	defer conn.Close()
-	dpc := devicepresence.NewPresenceManagerClient(conn)
+	worker.MessageHandler = handler.Handle
+	stopped := make(chan struct{})
+	go func() {
+		q.Start()
+		close(stopped)
+	}()
+	<-q.Started()
+	readiness.Ready(depWorkers)
 
-	conn2, err := grpc.Dial("localhost:9092")
+	glog.Infof("Received %s, draining", <-sig)
+	readiness.Drain()
+	time.Sleep(*drainTimeout)
+	grpcServer.Stop()
+	adminServer.Stop()
+	scheduler.Close()
+	coalescer.Close()
+	close(stopDigests)
+	<-digestsStopped
+	ctx, cancel := context.WithTimeout(context.Background(), *digestFlushTimeout)
+	if n := notifier.FlushAllDigests(ctx); n > 0 {
+		glog.Infof("Queued %d pending digests", n)
+	}
+	cancel()
+	q.Close()
+	<-stopped
+}
+
+// dialUpstream connects to addr in the background and sends the connection
+// once it is established. The dependency is not ready until then. The
+// address keeps being probed afterwards so losing the upstream flips
+// readiness.
+func dialUpstream(readiness *health.Readiness, dep, addr string, opts ...grpc.DialOption) <-chan *grpc.ClientConn {
+	conns := make(chan *grpc.ClientConn, 1)
+	go func() {
+		glog.Infof("Connecting to %s at %s", dep, addr)
+		conn, err := grpc.Dial(addr, opts...)
+		if err != nil {
+			glog.Fatalf("could not connect to %s: %v", dep, err)
+		}
+		readiness.Ready(dep)
+		conns <- conn
+		for range time.Tick(*probeInterval) {
+			c, err := net.DialTimeout("tcp", addr, *probeInterval)
+			if err != nil {
+				glog.Errorf("Unable to reach %s at %s: %s", dep, addr, err)
+				readiness.NotReady(dep)
+				continue
+			}
+			c.Close()
+			readiness.Ready(dep)
+		}
+	}()
+	return conns
+}
+
+// newReloader loads the certificate files and keeps reloading them when they
+// change on disk.
+func newReloader(files tlsutil.Files) *tlsutil.Reloader {
+	r, err := tlsutil.NewReloader(files)
 	if err != nil {
-		glog.Fatalf("could not connect: %v", err)
+		glog.Fatalf("could not load certificates: %v", err)
+	}
+	go r.Watch(*tlsReloadInterval, nil)
+	return r
+}
+
+// newSender returns the client of a socket service connection, batching
+// sends if enabled.
+func newSender(conn *grpc.ClientConn) socket.SenderClient {
+	sender := socket.NewSenderClient(conn)
+	if *socketBatchWindow <= 0 {
+		return sender
 	}
-	defer conn.Close()
-	sc := socket.NewSenderClient(conn2)
+	return transport.NewSocketBatcher(sender, func(p *transport.SocketBatchProperties) {
+		p.Window = *socketBatchWindow
+		p.MaxMessages = *socketBatchSize
+		p.Timeout = *socketBatchTimeout
+	})
+}
 
-	worker := &queue.Worker{
-		MessageHandler: queue.MessageHandler(dpc, sc),
+// newTransports registers the transport of every enabled device type. WS
+// devices on a gateway node are sent to through the node pool.
+func newTransports(socketClient socket.SenderClient, nodes *transport.SocketPool, keys *transport.DeviceKeys) transport.Registry {
+	for _, e := range []string{*socketEncoding, *webhookEncoding} {
+		if err := transport.CheckEncoding(e); err != nil {
+			glog.Fatal(err)
+		}
+	}
+	r := transport.Registry{
+		devicepresence.Device_WS: &transport.Socket{
+			Client:          socketClient,
+			Nodes:           nodes,
+			Encoding:        *socketEncoding,
+			MinCompressSize: *compressMinSize,
+			Timeout:         *socketTimeout,
+			Keys:            keys,
+		},
+	}
+	if *webhookKey != "" {
+		key, err := ioutil.ReadFile(*webhookKey)
+		if err != nil {
+			glog.Fatalf("could not read webhook key: %v", err)
+		}
+		r[devicepresence.Device_WEBHOOK] = transport.NewWebhook(bytes.TrimSpace(key), func(p *transport.WebhookProperties) {
+			p.Timeout = *webhookTimeout
+			p.MaxRetries = *webhookRetries
+			if *webhookHosts != "" {
+				p.AllowedHosts = strings.Split(*webhookHosts, ",")
+			}
+			p.Encoding = *webhookEncoding
+			p.MinCompressSize = *compressMinSize
+		})
+	}
+	if *apnsKey != "" {
+		key, err := transport.LoadAPNSKey(*apnsKey)
+		if err != nil {
+			glog.Fatalf("could not load APNs key: %v", err)
+		}
+		r[devicepresence.Device_APNS] = transport.NewAPNS(*apnsKeyID, *apnsTeamID, key, func(p *transport.APNSProperties) {
+			p.Endpoint = *apnsEndpoint
+			p.Topic = *apnsTopic
+			p.Title = *pushTitle
+		})
 	}
-	queue := queue.NewChannelQueue(worker.Do)
-	go queue.Start()
+	if *fcmCredentials != "" {
+		b, err := ioutil.ReadFile(*fcmCredentials)
+		if err != nil {
+			glog.Fatalf("could not read FCM credentials: %v", err)
+		}
+		conf, err := google.JWTConfigFromJSON(b, transport.FCMScope)
+		if err != nil {
+			glog.Fatalf("could not parse FCM credentials: %v", err)
+		}
+		project := *fcmProject
+		if project == "" {
+			var account struct {
+				ProjectId string `json:"project_id"`
+			}
+			json.Unmarshal(b, &account)
+			project = account.ProjectId
+		}
+		r[devicepresence.Device_FCM] = transport.NewFCM(project, conf.TokenSource(oauth2.NoContext), func(p *transport.FCMProperties) {
+			p.Title = *pushTitle
+		})
+	}
+	if *smtpAddr != "" {
+		r[devicepresence.Device_EMAIL] = newEmail()
+	}
+	return r
+}
+
+// fallbackTransports returns the transports able to reach offline devices.
+func fallbackTransports(transports transport.Registry) transport.Registry {
+	r := transport.Registry{}
+	for _, t := range []devicepresence.Device_Type{
+		devicepresence.Device_APNS,
+		devicepresence.Device_FCM,
+		devicepresence.Device_EMAIL,
+		devicepresence.Device_WEBHOOK,
+	} {
+		if transports[t] != nil {
+			r[t] = transports[t]
+		}
+	}
+	return r
+}
 
-	s, err := net.Listen("tcp", ":9090")
+// serveSSE starts the Server-Sent Events endpoint clients subscribe to with
+// HMAC signed tokens identifying their user.
+func serveSSE(presence devicepresence.PresenceManagerClient) *transport.SSE {
+	key, err := ioutil.ReadFile(*sseHMACKey)
+	if err != nil {
+		glog.Fatalf("could not read SSE HMAC key: %v", err)
+	}
+	sse := transport.NewSSE(&auth.HMACTokens{Key: bytes.TrimSpace(key)}, presence, func(p *transport.SSEProperties) {
+		p.ReplaySize = *sseReplay
+		p.Linger = *sseLinger
+	})
+	l, err := net.Listen("tcp", *sseAddr)
 	if err != nil {
 		glog.Fatalf("failed to listen: %v", err)
 	}
+	go func() {
+		if err := sse.Serve(l); err != nil {
+			glog.Fatal(err)
+		}
+	}()
+	return sse
+}
 
-	grpcServer := grpc.NewServer()
-	notify.RegisterNotifierServer(grpcServer, &notify.Notifier{
-		Queue: queue,
+func newEmail() *transport.Email {
+	var body string
+	if *emailBody != "" {
+		b, err := ioutil.ReadFile(*emailBody)
+		if err != nil {
+			glog.Fatalf("could not read email template: %v", err)
+		}
+		body = string(b)
+	}
+	var smtpAuth smtp.Auth
+	if *smtpUser != "" {
+		password, err := ioutil.ReadFile(*smtpPassword)
+		if err != nil {
+			glog.Fatalf("could not read SMTP password: %v", err)
+		}
+		host, _, _ := net.SplitHostPort(*smtpAddr)
+		smtpAuth = smtp.PlainAuth("", *smtpUser, string(bytes.TrimSpace(password)), host)
+	}
+	e, err := transport.NewEmail(*smtpAddr, func(p *transport.EmailProperties) {
+		p.From = *emailFrom
+		p.Subject = *emailSubject
+		if body != "" {
+			p.Body = body
+		}
+		p.Auth = smtpAuth
+		p.RequireTLS = *smtpRequireTLS
 	})
-	grpcServer.Serve(s)
+	if err != nil {
+		glog.Fatalf("could not parse email templates: %v", err)
+	}
+	return e
+}
+
+// adminAuthenticator returns the authenticator for the admin service. The
+// admin service may only run without authentication if it cannot be reached
+// from other hosts.
+func adminAuthenticator() auth.Authenticator {
+	if *adminTokens != "" {
+		return loadTokens(*adminTokens)
+	}
+	host, _, err := net.SplitHostPort(*adminAddr)
+	if err != nil {
+		glog.Fatalf("invalid admin address: %v", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		glog.Fatal("an admin service not listening on loopback requires operator tokens")
+	}
+	return nil
+}
+
+// loadTokens reads a JSON file mapping static tokens to names.
+func loadTokens(name string) auth.StaticTokens {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		glog.Fatalf("could not read tokens: %v", err)
+	}
+	var tokens auth.StaticTokens
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		glog.Fatalf("could not parse tokens: %v", err)
+	}
+	return tokens
+}
+
+// configureAuth sets up caller authentication and authorization for the
+// notifier if any of the auth flags is set.
+func configureAuth(n *notify.Notifier) {
+	var chain auth.Chain
+	if *authTokens != "" {
+		chain = append(chain, loadTokens(*authTokens))
+	}
+	if *authHMACKey != "" {
+		key, err := ioutil.ReadFile(*authHMACKey)
+		if err != nil {
+			glog.Fatalf("could not read HMAC key: %v", err)
+		}
+		chain = append(chain, &auth.HMACTokens{Key: bytes.TrimSpace(key)})
+	}
+	if len(chain) > 0 {
+		n.Authenticator = chain
+	}
+	if *authPolicy != "" {
+		if n.Authenticator == nil {
+			glog.Fatal("an authorization policy requires caller authentication")
+		}
+		rules, err := auth.LoadRules(*authPolicy)
+		if err != nil {
+			glog.Fatalf("could not load authorization policy: %v", err)
+		}
+		n.Policy = rules
+	}
 }
@@ -0,0 +1,276 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/protogalaxy/service-notify/audit"
+	"github.com/protogalaxy/service-notify/queue"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+)
+
+// maxDigestMessages limits the messages kept per digest when the notifier
+// has no MaxPayloadSize. The oldest messages are dropped first.
+const maxDigestMessages = 100
+
+// DigestPolicy batches the notifications of a category into a digest sent
+// once per cadence.
+type DigestPolicy struct {
+	// Cadence is the period digests are sent at, aligned to UTC, e.g. every
+	// hour on the hour.
+	Cadence time.Duration
+	// Title is the title of the digest notification. Its first %d is
+	// replaced by the number of notifications.
+	Title string
+	// Template renders the body of the digest if set. It is given the
+	// params "category", "count" and "summary", the titles of the
+	// notifications one per line.
+	Template string
+}
+
+// DigestPolicies are the digest policies by notification category.
+type DigestPolicies map[string]DigestPolicy
+
+type digestPolicy struct {
+	Cadence  string `json:"cadence"`
+	Title    string `json:"title"`
+	Template string `json:"template"`
+}
+
+// LoadDigestPolicies reads the policies from a JSON file mapping categories
+// to policies, e.g.
+//
+//	{"promotions": {"cadence": "24h", "title": "%d new offers"},
+//	 "friends": {"cadence": "1h", "template": "friends_digest"}}
+func LoadDigestPolicies(name string) (DigestPolicies, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var raw map[string]digestPolicy
+	if err := json.NewDecoder(f).Decode(&raw); err != nil {
+		return nil, err
+	}
+	policies := make(DigestPolicies)
+	for category, p := range raw {
+		cadence, err := time.ParseDuration(p.Cadence)
+		if err != nil {
+			return nil, fmt.Errorf("category %s: %s", category, err)
+		}
+		if cadence <= 0 {
+			return nil, fmt.Errorf("category %s: cadence must be positive", category)
+		}
+		policies[category] = DigestPolicy{
+			Cadence:  cadence,
+			Title:    p.Title,
+			Template: p.Template,
+		}
+	}
+	return policies, nil
+}
+
+type digestKey struct {
+	userID   string
+	category string
+}
+
+type pendingDigest struct {
+	messages []queue.QueuedMessage
+	due      time.Time
+}
+
+// digests accumulates the notifications of digest categories per user.
+type digests struct {
+	mu      sync.Mutex
+	pending map[digestKey]*pendingDigest
+}
+
+// digestPolicy returns the digest policy the message is batched by.
+func (n *Notifier) digestPolicy(msg queue.QueuedMessage) (DigestPolicy, bool) {
+	if msg.Urgent || msg.Notification == nil {
+		return DigestPolicy{}, false
+	}
+	p, ok := n.DigestPolicies[msg.Notification.Category]
+	return p, ok
+}
+
+// addDigest holds the message until the digest of its category is due and
+// reports whether it did. Messages are not held once MaxPendingDigests
+// digests are pending.
+func (n *Notifier) addDigest(msg queue.QueuedMessage, p DigestPolicy, now time.Time) bool {
+	key := digestKey{msg.UserId, msg.Notification.Category}
+	n.digests.mu.Lock()
+	defer n.digests.mu.Unlock()
+	if n.digests.pending == nil {
+		n.digests.pending = make(map[digestKey]*pendingDigest)
+	}
+	d := n.digests.pending[key]
+	if d == nil {
+		if n.MaxPendingDigests > 0 && len(n.digests.pending) >= n.MaxPendingDigests {
+			glog.Warningf("%d digests pending, not holding the %s notification for user '%s'", len(n.digests.pending), key.category, key.userID)
+			return false
+		}
+		d = &pendingDigest{due: now.UTC().Truncate(p.Cadence).Add(p.Cadence)}
+		n.digests.pending[key] = d
+	}
+	d.messages = append(d.messages, msg)
+	if n.MaxPayloadSize > 0 {
+		d.messages = queue.TrimDigest(d.messages, n.MaxPayloadSize)
+	} else if len(d.messages) > maxDigestMessages {
+		d.messages = d.messages[len(d.messages)-maxDigestMessages:]
+	}
+	return true
+}
+
+// FlushDigests queues the digests that are due at the given time and
+// returns their number. It is meant to be called periodically.
+func (n *Notifier) FlushDigests(now time.Time) int {
+	return n.flushDigests(context.Background(), func(d *pendingDigest) bool {
+		return !now.Before(d.due)
+	})
+}
+
+// FlushAllDigests queues all the pending digests, due or not, and returns
+// their number. It is meant to be called on shutdown. Digests the queue
+// does not take before ctx is done are dropped.
+func (n *Notifier) FlushAllDigests(ctx context.Context) int {
+	return n.flushDigests(ctx, func(*pendingDigest) bool {
+		return true
+	})
+}
+
+// flushDigests queues the pending digests selected by due.
+func (n *Notifier) flushDigests(ctx context.Context, due func(*pendingDigest) bool) int {
+	n.digests.mu.Lock()
+	var keys []digestKey
+	var msgs [][]queue.QueuedMessage
+	for key, d := range n.digests.pending {
+		if due(d) {
+			keys = append(keys, key)
+			msgs = append(msgs, d.messages)
+			delete(n.digests.pending, key)
+		}
+	}
+	n.digests.mu.Unlock()
+
+	for i, key := range keys {
+		msg, err := n.digest(key, msgs[i])
+		if err != nil {
+			glog.Errorf("Unable to render digest of %s notifications for user '%s', queueing them one by one: %s", key.category, key.userID, err)
+			for _, m := range msgs[i] {
+				n.queueDigest(ctx, m)
+			}
+			continue
+		}
+		if n.queueDigest(ctx, msg) {
+			n.audit(msg, audit.DecisionAccepted, nil)
+			glog.V(3).Infof("Digest of %d %s notifications for user '%s' queued", len(msgs[i]), key.category, key.userID)
+		}
+	}
+	return len(keys)
+}
+
+// queueDigest queues the message unless ctx is done first and reports
+// whether it did. Dropped messages are audited as rejected.
+func (n *Notifier) queueDigest(ctx context.Context, msg queue.QueuedMessage) bool {
+	select {
+	case n.Queue.Messages() <- msg:
+		return true
+	case <-ctx.Done():
+		glog.Errorf("Dropping message %s for user '%s': %s", msg.Id, msg.UserId, ctx.Err())
+		n.audit(msg, audit.DecisionRejected, ctx.Err())
+		return false
+	}
+}
+
+// digest renders the notifications into one message.
+func (n *Notifier) digest(key digestKey, msgs []queue.QueuedMessage) (queue.QueuedMessage, error) {
+	p := n.DigestPolicies[key.category]
+	msg := msgs[len(msgs)-1]
+	msg.Id = newMessageId()
+	msg.CollapseKey = ""
+	data, err := queue.DigestData(msgs)
+	if err != nil {
+		return queue.QueuedMessage{}, err
+	}
+	msg.Data = data
+
+	var titles []string
+	for _, m := range msgs {
+		titles = append(titles, notificationTitle(m.Notification))
+	}
+	title := p.Title
+	if title == "" {
+		title = "%d new notifications"
+	}
+	title = strings.Replace(title, "%d", strconv.Itoa(len(msgs)), 1)
+	notification := &transport.Notification{
+		Title:    title,
+		Body:     strings.Join(titles, "\n"),
+		Category: key.category,
+		Data:     map[string]string{queue.DigestCountKey: strconv.Itoa(len(msgs))},
+	}
+	if p.Template != "" && n.Templates != nil {
+		var locale string
+		if n.Locales != nil {
+			locale = n.Locales.Locale(key.userID)
+		}
+		body, _, err := n.Templates.Render(p.Template, locale, 0, map[string]string{
+			"category": key.category,
+			"count":    strconv.Itoa(len(msgs)),
+			"summary":  notification.Body,
+		})
+		if err != nil {
+			glog.Errorf("Unable to render digest template %s: %s", p.Template, err)
+		} else {
+			notification.Body = string(body)
+		}
+	}
+	msg.Notification = notification
+	if size := digestSize(msg); n.MaxPayloadSize > 0 && size > n.MaxPayloadSize {
+		return queue.QueuedMessage{}, fmt.Errorf("digest of %d bytes exceeds the limit of %d bytes", size, n.MaxPayloadSize)
+	}
+	return msg, nil
+}
+
+// digestSize is the encoded size of the raw and structured digest, see
+// payloadSize.
+func digestSize(msg queue.QueuedMessage) int {
+	return len(msg.Data) + proto.Size(&Notification{
+		Title:    msg.Notification.Title,
+		Body:     msg.Notification.Body,
+		Category: msg.Notification.Category,
+		Data:     msg.Notification.Data,
+	})
+}
+
+func notificationTitle(n *transport.Notification) string {
+	if n.Title != "" {
+		return n.Title
+	}
+	return n.Body
+}
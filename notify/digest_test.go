@@ -0,0 +1,208 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package notify_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/audit"
+	"github.com/protogalaxy/service-notify/notify"
+	"github.com/protogalaxy/service-notify/queue"
+	"github.com/protogalaxy/service-notify/templates"
+	"golang.org/x/net/context"
+)
+
+func sendCategory(t *testing.T, n *notify.Notifier, userID, category, title string, priority notify.Priority) {
+	_, err := n.Send(context.Background(), &notify.SendRequest{
+		UserId:       userID,
+		Notification: &notify.Notification{Title: title, Category: category},
+		Priority:     priority,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func TestNotifierFlushDigests(t *testing.T) {
+	q := NewQueueMock()
+	n := &notify.Notifier{
+		Queue: q,
+		DigestPolicies: notify.DigestPolicies{
+			"promotions": {Cadence: time.Hour, Title: "%d new offers"},
+		},
+	}
+	sendCategory(t, n, "user1", "promotions", "Sale", notify.Priority_NORMAL)
+	sendCategory(t, n, "user1", "promotions", "Bundle", notify.Priority_NORMAL)
+	sendCategory(t, n, "user1", "friends", "Friend request", notify.Priority_NORMAL)
+	sendCategory(t, n, "user1", "promotions", "Flash sale", notify.Priority_URGENT)
+
+	for _, title := range []string{"Friend request", "Flash sale"} {
+		if msg := <-q.messages; msg.Notification.Title != title {
+			t.Errorf("Expecting %s to be queued right away but got %+v", title, msg.Notification)
+		}
+	}
+	if n.FlushDigests(time.Now()) != 0 {
+		t.Error("Digest flushed before it was due")
+	}
+	if n.FlushDigests(time.Now().Add(time.Hour)) != 1 {
+		t.Fatal("Expecting the digest to be flushed")
+	}
+	msg := <-q.messages
+	if msg.UserId != "user1" || msg.Notification.Title != "2 new offers" || msg.Notification.Body != "Sale\nBundle" {
+		t.Errorf("Wrong digest: %+v", msg.Notification)
+	}
+	if msg.Notification.Category != "promotions" || msg.Notification.Data[queue.DigestCountKey] != "2" {
+		t.Errorf("Wrong digest: %+v", msg.Notification)
+	}
+	if n.FlushDigests(time.Now().Add(2*time.Hour)) != 0 {
+		t.Error("Digest flushed twice")
+	}
+}
+
+func TestNotifierFlushAllDigests(t *testing.T) {
+	q := NewQueueMock()
+	n := &notify.Notifier{
+		Queue: q,
+		DigestPolicies: notify.DigestPolicies{
+			"promotions": {Cadence: 24 * time.Hour},
+		},
+	}
+	sendCategory(t, n, "user1", "promotions", "Sale", notify.Priority_NORMAL)
+	sendCategory(t, n, "user2", "promotions", "Sale", notify.Priority_NORMAL)
+	if n.FlushAllDigests(context.Background()) != 2 {
+		t.Fatal("Expecting all pending digests to be flushed")
+	}
+	for i := 0; i < 2; i++ {
+		if msg := <-q.messages; msg.Notification.Category != "promotions" {
+			t.Errorf("Wrong digest: %+v", msg.Notification)
+		}
+	}
+	if n.FlushAllDigests(context.Background()) != 0 {
+		t.Error("Digests flushed twice")
+	}
+}
+
+func TestNotifierLimitsPendingDigests(t *testing.T) {
+	q := NewQueueMock()
+	n := &notify.Notifier{
+		Queue: q,
+		DigestPolicies: notify.DigestPolicies{
+			"promotions": {Cadence: time.Hour},
+		},
+		MaxPendingDigests: 1,
+	}
+	sendCategory(t, n, "user1", "promotions", "Sale", notify.Priority_NORMAL)
+	sendCategory(t, n, "user1", "promotions", "Bundle", notify.Priority_NORMAL)
+	sendCategory(t, n, "user2", "promotions", "Sale", notify.Priority_NORMAL)
+
+	if msg := <-q.messages; msg.UserId != "user2" {
+		t.Errorf("Expecting the message beyond the limit to be queued right away but got %+v", msg)
+	}
+	if n.FlushDigests(time.Now().Add(time.Hour)) != 1 {
+		t.Fatal("Expecting the pending digest to be flushed")
+	}
+	if msg := <-q.messages; msg.UserId != "user1" || msg.Notification.Data[queue.DigestCountKey] != "2" {
+		t.Errorf("Wrong digest: %+v", msg.Notification)
+	}
+}
+
+func TestNotifierDigestHonorsMaxPayloadSize(t *testing.T) {
+	q := NewQueueMock()
+	n := &notify.Notifier{
+		Queue: q,
+		DigestPolicies: notify.DigestPolicies{
+			"promotions": {Cadence: time.Hour},
+		},
+		MaxPayloadSize: 30,
+	}
+	sendCategory(t, n, "user1", "promotions", "Sale", notify.Priority_NORMAL)
+	sendCategory(t, n, "user1", "promotions", "Bundle", notify.Priority_NORMAL)
+	if n.FlushDigests(time.Now().Add(time.Hour)) != 1 {
+		t.Fatal("Expecting the pending digest to be flushed")
+	}
+	if msg := <-q.messages; msg.Notification.Title != "Bundle" {
+		t.Errorf("Expecting the newest message queued as is but got %+v", msg.Notification)
+	}
+	select {
+	case msg := <-q.messages:
+		t.Errorf("Expecting the oldest message to be dropped but got %+v", msg.Notification)
+	default:
+	}
+}
+
+func TestNotifierFlushAllDigestsHonorsContext(t *testing.T) {
+	a := &AuditMock{}
+	n := &notify.Notifier{
+		Queue: &QueueMock{messages: make(chan queue.QueuedMessage)},
+		DigestPolicies: notify.DigestPolicies{
+			"promotions": {Cadence: time.Hour},
+		},
+		Audit: a,
+	}
+	sendCategory(t, n, "user1", "promotions", "Sale", notify.Priority_NORMAL)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n.FlushAllDigests(ctx) != 1 {
+		t.Fatal("Expecting the pending digest to be flushed")
+	}
+	if r := a.records[len(a.records)-1]; r.Decision != audit.DecisionRejected {
+		t.Errorf("Dropped digest must be audited as rejected: %+v", r)
+	}
+}
+
+func TestNotifierDigestTemplate(t *testing.T) {
+	q := NewQueueMock()
+	r := templates.NewRegistry()
+	r.Put("offers", "fr", "{{.count}} offres:\n{{.summary}}")
+	n := &notify.Notifier{
+		Queue:     q,
+		Templates: r,
+		Locales:   templates.UserLocales{"user1": "fr"},
+		DigestPolicies: notify.DigestPolicies{
+			"promotions": {Cadence: time.Hour, Template: "offers"},
+		},
+	}
+	sendCategory(t, n, "user1", "promotions", "Soldes", notify.Priority_NORMAL)
+	n.FlushDigests(time.Now().Add(time.Hour))
+	msg := <-q.messages
+	if msg.Notification.Body != "1 offres:\nSoldes" {
+		t.Errorf("Wrong digest body: %q", msg.Notification.Body)
+	}
+}
+
+func TestLoadDigestPolicies(t *testing.T) {
+	f, err := ioutil.TempFile("", "digests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"promotions": {"cadence": "24h", "title": "%d new offers"}, "friends": {"cadence": "1h", "template": "friends"}}`)
+	f.Close()
+
+	policies, err := notify.LoadDigestPolicies(f.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if p := policies["promotions"]; p.Cadence != 24*time.Hour || p.Title != "%d new offers" {
+		t.Errorf("Wrong promotions policy: %+v", p)
+	}
+	if p := policies["friends"]; p.Cadence != time.Hour || p.Template != "friends" {
+		t.Errorf("Wrong friends policy: %+v", p)
+	}
+}
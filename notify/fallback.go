@@ -0,0 +1,114 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/preferences"
+	"github.com/protogalaxy/service-notify/queue"
+)
+
+// FallbackPolicies are fallback chains configured on the server, referred
+// to by name in requests.
+type FallbackPolicies map[string][]queue.FallbackStep
+
+type fallbackStep struct {
+	DeviceTypes []string `json:"device_types"`
+	OnlineOnly  bool     `json:"online_only"`
+	Timeout     string   `json:"timeout"`
+}
+
+// LoadFallbackPolicies reads the policies from a JSON file mapping policy
+// names to lists of steps, e.g.
+//
+//	{"turn": [
+//		{"device_types": ["WS", "SSE"], "online_only": true, "timeout": "5s"},
+//		{"device_types": ["APNS", "FCM"]},
+//		{"device_types": ["EMAIL"]}
+//	]}
+func LoadFallbackPolicies(name string) (FallbackPolicies, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var raw map[string][]fallbackStep
+	if err := json.NewDecoder(f).Decode(&raw); err != nil {
+		return nil, err
+	}
+	policies := make(FallbackPolicies)
+	for name, steps := range raw {
+		for i, s := range steps {
+			types, err := deviceTypes(s.DeviceTypes)
+			if err != nil {
+				return nil, fmt.Errorf("policy %s step %d: %s", name, i+1, err)
+			}
+			var timeout time.Duration
+			if s.Timeout != "" {
+				if timeout, err = time.ParseDuration(s.Timeout); err != nil {
+					return nil, fmt.Errorf("policy %s step %d: %s", name, i+1, err)
+				}
+			}
+			policies[name] = append(policies[name], queue.FallbackStep{
+				Types:      types,
+				OnlineOnly: s.OnlineOnly,
+				Timeout:    timeout,
+			})
+		}
+	}
+	return policies, nil
+}
+
+// fallback returns the fallback chain of the request, either given inline
+// or by policy name.
+func (n *Notifier) fallback(req *SendRequest) ([]queue.FallbackStep, error) {
+	if len(req.Fallback) == 0 {
+		if req.FallbackPolicy == "" {
+			return nil, nil
+		}
+		steps, ok := n.FallbackPolicies[req.FallbackPolicy]
+		if !ok {
+			return nil, fmt.Errorf("unknown fallback policy: %s", req.FallbackPolicy)
+		}
+		return steps, nil
+	}
+	steps := make([]queue.FallbackStep, len(req.Fallback))
+	for i, s := range req.Fallback {
+		types, err := deviceTypes(s.DeviceTypes)
+		if err != nil {
+			return nil, fmt.Errorf("fallback step %d: %s", i+1, err)
+		}
+		steps[i] = queue.FallbackStep{
+			Types:      types,
+			OnlineOnly: s.OnlineOnly,
+			Timeout:    time.Duration(s.TimeoutMs) * time.Millisecond,
+		}
+	}
+	return steps, nil
+}
+
+func deviceTypes(names []string) ([]devicepresence.Device_Type, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no device types")
+	}
+	return preferences.Channels(names)
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package notify_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/notify"
+	"golang.org/x/net/context"
+)
+
+func TestNotifierSendInlineFallback(t *testing.T) {
+	q := NewQueueMock()
+	n := &notify.Notifier{Queue: q}
+	_, err := n.Send(context.Background(), &notify.SendRequest{
+		UserId: "user1",
+		Data:   []byte("data"),
+		Fallback: []*notify.FallbackStep{
+			{DeviceTypes: []string{"WS", "SSE"}, OnlineOnly: true, TimeoutMs: 5000},
+			{DeviceTypes: []string{"EMAIL"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	msg := <-q.messages
+	if len(msg.Fallback) != 2 {
+		t.Fatalf("Expecting 2 fallback steps but got %d", len(msg.Fallback))
+	}
+	step := msg.Fallback[0]
+	if len(step.Types) != 2 || step.Types[1] != devicepresence.Device_SSE || !step.OnlineOnly || step.Timeout != 5*time.Second {
+		t.Errorf("Wrong fallback step: %+v", step)
+	}
+}
+
+func TestNotifierSendFallbackPolicy(t *testing.T) {
+	q := NewQueueMock()
+	n := &notify.Notifier{
+		Queue: q,
+		FallbackPolicies: notify.FallbackPolicies{
+			"turn": {{Types: []devicepresence.Device_Type{devicepresence.Device_APNS}}},
+		},
+	}
+	_, err := n.Send(context.Background(), &notify.SendRequest{UserId: "user1", Data: []byte("data"), FallbackPolicy: "turn"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if msg := <-q.messages; len(msg.Fallback) != 1 {
+		t.Errorf("Policy steps not attached: %+v", msg.Fallback)
+	}
+
+	_, err = n.Send(context.Background(), &notify.SendRequest{UserId: "user1", Data: []byte("data"), FallbackPolicy: "unknown"})
+	if err == nil {
+		t.Error("Expecting an error for an unknown policy")
+	}
+}
+
+func TestNotifierSendUnknownFallbackDeviceType(t *testing.T) {
+	n := &notify.Notifier{Queue: NewQueueMock()}
+	_, err := n.Send(context.Background(), &notify.SendRequest{
+		UserId:   "user1",
+		Data:     []byte("data"),
+		Fallback: []*notify.FallbackStep{{DeviceTypes: []string{"PIGEON"}}},
+	})
+	if err == nil {
+		t.Error("Expecting an error for an unknown device type")
+	}
+}
+
+func TestLoadFallbackPolicies(t *testing.T) {
+	f, err := ioutil.TempFile("", "fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"turn": [
+		{"device_types": ["WS"], "online_only": true, "timeout": "5s"},
+		{"device_types": ["APNS", "FCM"]}
+	]}`)
+	f.Close()
+
+	policies, err := notify.LoadFallbackPolicies(f.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	steps := policies["turn"]
+	if len(steps) != 2 || steps[0].Timeout != 5*time.Second || len(steps[1].Types) != 2 {
+		t.Errorf("Unexpected steps: %+v", steps)
+	}
+}
@@ -18,42 +18,304 @@
 package notify
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/protogalaxy/service-notify/audit"
+	"github.com/protogalaxy/service-notify/auth"
+	"github.com/protogalaxy/service-notify/inbox"
+	"github.com/protogalaxy/service-notify/preferences"
 	"github.com/protogalaxy/service-notify/queue"
+	"github.com/protogalaxy/service-notify/templates"
+	"github.com/protogalaxy/service-notify/transport"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 type Notifier struct {
 	Queue queue.MessageQueue
+	// Authenticator identifies the caller. All calls are accepted
+	// anonymously if it is not set.
+	Authenticator auth.Authenticator
+	// Policy decides which notifications an authenticated caller may send.
+	// All notifications are allowed if it is not set.
+	Policy auth.Policy
+	// Audit records accepted and rejected notifications if set.
+	Audit audit.Logger
+	// Inbox holds the messages requeued by FlushInbox.
+	Inbox inbox.Store
+	// FallbackPolicies are the fallback chains requests may refer to.
+	FallbackPolicies FallbackPolicies
+	// Templates render the payloads of SendTemplate.
+	Templates *templates.Registry
+	// Locales resolve the locale templates are rendered in if set.
+	Locales templates.Locales
+	// Preferences are managed through GetPreferences and SetPreferences if
+	// set.
+	Preferences preferences.Store
+	// Coalescer merges the messages of requests with a coalescing window
+	// into digests. Coalescing is rejected if it is not set.
+	Coalescer *queue.Coalescer
+	// DigestPolicies batch the notifications of their categories that are
+	// not urgent into periodic digests, see FlushDigests.
+	DigestPolicies DigestPolicies
+	// MaxPayloadSize limits the encoded size of the raw and structured
+	// message. Zero means no limit.
+	MaxPayloadSize int
+	// MaxPendingDigests limits the digests held at once, one per user and
+	// category. Notifications that would start a digest beyond the limit
+	// are queued right away. Zero means no limit.
+	MaxPendingDigests int
+
+	digests digests
 }
 
 func (n *Notifier) Send(ctx context.Context, req *SendRequest) (*SendReply, error) {
+	caller, err := n.authenticate(ctx)
+	if err != nil {
+		n.audit(newMessage(req), audit.DecisionRejected, err)
+		return nil, err
+	}
+	return n.send(ctx, caller, req)
+}
+
+// send queues the message of an authenticated caller.
+func (n *Notifier) send(ctx context.Context, caller string, req *SendRequest) (*SendReply, error) {
+	msg := newMessage(req)
+	msg.Caller = caller
+	err := n.accept(caller, req)
+	if err == nil {
+		msg.Fallback, err = n.fallback(req)
+	}
+	if err == nil && req.CoalesceMs > 0 && n.Coalescer == nil {
+		err = errors.New("coalescing is not enabled")
+	}
+	if err != nil {
+		n.audit(msg, audit.DecisionRejected, err)
+		return nil, err
+	}
+
+	p, digest := n.digestPolicy(msg)
+	switch {
+	case digest && n.addDigest(msg, p, time.Now()):
+		glog.V(3).Infof("Message for user '%s' from '%s' held for the %s digest", req.UserId, caller, msg.Notification.Category)
+	case req.CoalesceMs > 0:
+		if err := n.Coalescer.Add(ctx, msg, time.Duration(req.CoalesceMs)*time.Millisecond); err != nil {
+			n.audit(msg, audit.DecisionRejected, err)
+			return nil, err
+		}
+		glog.V(3).Infof("Message for user '%s' from '%s' held for coalescing", req.UserId, caller)
+	default:
+		select {
+		case n.Queue.Messages() <- msg:
+			glog.V(3).Infof("Message for user '%s' from '%s' queued", req.UserId, caller)
+		case <-ctx.Done():
+			n.audit(msg, audit.DecisionRejected, ctx.Err())
+			return nil, ctx.Err()
+		}
+	}
+	n.audit(msg, audit.DecisionAccepted, nil)
+
+	return &SendReply{}, nil
+}
+
+func (n *Notifier) SendTemplate(ctx context.Context, req *SendTemplateRequest) (*SendReply, error) {
+	caller, err := n.authenticate(ctx)
+	if err != nil {
+		n.audit(queue.QueuedMessage{UserId: req.UserId}, audit.DecisionRejected, err)
+		return nil, err
+	}
+	if n.Templates == nil {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "templates are not enabled")
+	}
+	if req.TemplateId == "" {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", templates.ErrMissingId)
+	}
+	locale := req.Locale
+	if locale == "" && n.Locales != nil {
+		locale = n.Locales.Locale(req.UserId)
+	}
+	data, t, err := n.Templates.Render(req.TemplateId, locale, int(req.TemplateVersion), req.Params)
+	if err != nil {
+		return nil, grpc.Errorf(templates.Code(err), "%s", err)
+	}
+	glog.V(3).Infof("Rendered version %d of template %s in locale %s for user '%s'", t.Version, t.Id, t.Locale, req.UserId)
+	return n.send(ctx, caller, &SendRequest{
+		UserId:         req.UserId,
+		Data:           data,
+		Routing:        req.Routing,
+		Fallback:       req.Fallback,
+		FallbackPolicy: req.FallbackPolicy,
+		Priority:       req.Priority,
+		CollapseKey:    req.CollapseKey,
+		CoalesceMs:     req.CoalesceMs,
+		Notification:   req.Notification,
+	})
+}
+
+// accept validates the request and checks the caller may send it.
+func (n *Notifier) accept(caller string, req *SendRequest) error {
 	if err := validateRequest(req); err != nil {
+		return err
+	}
+	size := payloadSize(req)
+	if n.MaxPayloadSize > 0 && size > n.MaxPayloadSize {
+		return grpc.Errorf(codes.InvalidArgument, "payload of %d bytes exceeds the limit of %d bytes", size, n.MaxPayloadSize)
+	}
+	r := auth.Request{
+		UserId:      req.UserId,
+		PayloadSize: size,
+	}
+	if req.Notification != nil {
+		r.Category = req.Notification.Category
+	}
+	return n.authorize(caller, r)
+}
+
+func (n *Notifier) FlushInbox(ctx context.Context, req *FlushInboxRequest) (*FlushInboxReply, error) {
+	caller, err := n.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.UserId == "" {
+		return nil, errors.New("missing user id")
+	}
+	if err := n.authorize(caller, auth.Request{UserId: req.UserId}); err != nil {
 		return nil, err
 	}
+	if n.Inbox == nil {
+		return &FlushInboxReply{}, nil
+	}
+	msgs := n.Inbox.Take(req.UserId)
+	for i, msg := range msgs {
+		select {
+		case n.Queue.Messages() <- msg:
+		case <-ctx.Done():
+			for _, msg := range msgs[i:] {
+				n.Inbox.Put(msg)
+			}
+			return nil, ctx.Err()
+		}
+	}
+	glog.V(3).Infof("Flushed %d stored messages of user '%s'", len(msgs), req.UserId)
+	return &FlushInboxReply{Count: int32(len(msgs))}, nil
+}
+
+func (n *Notifier) audit(msg queue.QueuedMessage, decision string, reason error) {
+	if n.Audit == nil {
+		return
+	}
+	r := audit.NewRecord(audit.EventSend, msg.UserId, msg.Payload())
+	r.MessageId = msg.Id
+	r.Caller = msg.Caller
+	r.Decision = decision
+	if reason != nil {
+		r.Reason = reason.Error()
+	}
+	n.Audit.Log(r)
+}
+
+// newMessage returns the queued message of the request.
+func newMessage(req *SendRequest) queue.QueuedMessage {
 	msg := queue.QueuedMessage{
-		UserId: req.UserId,
-		Data:   req.Data,
+		Id:          newMessageId(),
+		UserId:      req.UserId,
+		Data:        req.Data,
+		Routing:     routings[req.Routing],
+		Urgent:      req.Priority == Priority_URGENT,
+		CollapseKey: req.CollapseKey,
 	}
+	if n := req.Notification; n != nil {
+		msg.Notification = &transport.Notification{
+			Title:       n.Title,
+			Body:        n.Body,
+			Category:    n.Category,
+			ContentType: n.ContentType,
+			Data:        n.Data,
+			CollapseKey: n.CollapseKey,
+			Badge:       int(n.Badge),
+		}
+	}
+	return msg
+}
 
-	select {
-	case n.Queue.Messages() <- msg:
-		glog.V(3).Infof("Message for user '%s' queued", req.UserId)
-	case <-ctx.Done():
-		return nil, ctx.Err()
+func newMessageId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		glog.Errorf("Unable to generate message id: %s", err)
 	}
+	return hex.EncodeToString(b)
+}
 
-	return &SendReply{}, nil
+// payloadSize is the encoded size of the raw and structured message.
+func payloadSize(req *SendRequest) int {
+	n := len(req.Data)
+	if req.Notification != nil {
+		n += proto.Size(req.Notification)
+	}
+	return n
+}
+
+// maxCoalesceWindow limits how long messages are held for coalescing.
+const maxCoalesceWindow = time.Minute
+
+var routings = map[SendRequest_Routing]queue.Routing{
+	SendRequest_ALL:              queue.RouteAll,
+	SendRequest_SKIP_OFFLINE:     queue.RouteSkipOffline,
+	SendRequest_OFFLINE_FALLBACK: queue.RouteOfflineFallback,
+	SendRequest_MOST_RECENT:      queue.RouteMostRecent,
 }
 
 func validateRequest(req *SendRequest) error {
 	if req.UserId == "" {
 		return errors.New("missing user id")
 	}
-	if len(req.Data) == 0 {
+	if len(req.Data) == 0 && req.Notification == nil {
 		return errors.New("empty message")
 	}
+	if _, ok := routings[req.Routing]; !ok {
+		return errors.New("unknown routing")
+	}
+	if _, ok := Priority_name[int32(req.Priority)]; !ok {
+		return errors.New("unknown priority")
+	}
+	if req.CoalesceMs > 0 && req.CollapseKey == "" {
+		return errors.New("coalescing requires a collapse key")
+	}
+	if time.Duration(req.CoalesceMs)*time.Millisecond > maxCoalesceWindow {
+		return fmt.Errorf("coalescing window exceeds %s", maxCoalesceWindow)
+	}
+	return nil
+}
+
+// authenticate identifies the caller. Every handler calls it before looking
+// at the request.
+func (n *Notifier) authenticate(ctx context.Context) (string, error) {
+	if n.Authenticator == nil {
+		return "", nil
+	}
+	caller, err := n.Authenticator.Authenticate(ctx)
+	if err != nil {
+		return "", grpc.Errorf(codes.Unauthenticated, "%s", err)
+	}
+	return caller, nil
+}
+
+// authorize checks the policy allows the authenticated caller to make the
+// request.
+func (n *Notifier) authorize(caller string, req auth.Request) error {
+	if n.Authenticator == nil || n.Policy == nil {
+		return nil
+	}
+	if err := n.Policy.Authorize(caller, req); err != nil {
+		glog.Warningf("Denied notification for user '%s' from '%s': %s", req.UserId, caller, err)
+		return grpc.Errorf(codes.PermissionDenied, "%s", err)
+	}
 	return nil
 }
@@ -0,0 +1,427 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package notify_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/audit"
+	"github.com/protogalaxy/service-notify/auth"
+	"github.com/protogalaxy/service-notify/inbox"
+	"github.com/protogalaxy/service-notify/notify"
+	"github.com/protogalaxy/service-notify/queue"
+	"github.com/protogalaxy/service-notify/templates"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+type QueueMock struct {
+	messages chan queue.QueuedMessage
+}
+
+func NewQueueMock() *QueueMock {
+	return &QueueMock{
+		messages: make(chan queue.QueuedMessage, 10),
+	}
+}
+
+func (q *QueueMock) Messages() chan<- queue.QueuedMessage {
+	return q.messages
+}
+
+func withToken(token string) context.Context {
+	return metadata.NewContext(context.Background(), metadata.MD{auth.MetadataKey: "Bearer " + token})
+}
+
+func TestNotifierSendQueuesMessage(t *testing.T) {
+	q := NewQueueMock()
+	n := &notify.Notifier{Queue: q}
+	_, err := n.Send(context.Background(), &notify.SendRequest{UserId: "user1", Data: []byte("data")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	select {
+	case msg := <-q.messages:
+		if msg.UserId != "user1" || string(msg.Data) != "data" {
+			t.Errorf("Wrong message queued: %+v", msg)
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatal("Message was not queued")
+	}
+}
+
+func TestNotifierSendInvalidRequest(t *testing.T) {
+	n := &notify.Notifier{Queue: NewQueueMock()}
+	if _, err := n.Send(context.Background(), &notify.SendRequest{Data: []byte("data")}); err == nil {
+		t.Error("Expecting an error for a missing user id")
+	}
+	if _, err := n.Send(context.Background(), &notify.SendRequest{UserId: "user1"}); err == nil {
+		t.Error("Expecting an error for an empty message")
+	}
+}
+
+func TestNotifierSendUnauthenticated(t *testing.T) {
+	n := &notify.Notifier{
+		Queue:         NewQueueMock(),
+		Authenticator: auth.StaticTokens{"secret": "game"},
+	}
+	_, err := n.Send(withToken("wrong"), &notify.SendRequest{UserId: "user1", Data: []byte("data")})
+	if grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expecting Unauthenticated error but got: %v", err)
+	}
+}
+
+func TestNotifierSendPermissionDenied(t *testing.T) {
+	n := &notify.Notifier{
+		Queue:         NewQueueMock(),
+		Authenticator: auth.StaticTokens{"secret": "game"},
+		Policy:        auth.Rules{{Caller: "game", Users: []string{"player:*"}}},
+	}
+	_, err := n.Send(withToken("secret"), &notify.SendRequest{UserId: "admin", Data: []byte("data")})
+	if grpc.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expecting PermissionDenied error but got: %v", err)
+	}
+}
+
+func TestNotifierSendCategoryDenied(t *testing.T) {
+	n := &notify.Notifier{
+		Queue:         NewQueueMock(),
+		Authenticator: auth.StaticTokens{"secret": "game"},
+		Policy:        auth.Rules{{Caller: "game", Users: []string{"*"}, Categories: []string{"match"}}},
+	}
+	_, err := n.Send(withToken("secret"), &notify.SendRequest{
+		UserId:       "player:1",
+		Notification: &notify.Notification{Title: "Sale", Category: "offer"},
+	})
+	if grpc.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expecting PermissionDenied error but got: %v", err)
+	}
+}
+
+func TestNotifierSendTemplateAuthenticatesFirst(t *testing.T) {
+	n := &notify.Notifier{
+		Queue:         NewQueueMock(),
+		Authenticator: auth.StaticTokens{"secret": "game"},
+	}
+	_, err := n.SendTemplate(withToken("wrong"), &notify.SendTemplateRequest{UserId: "player:1"})
+	if grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expecting Unauthenticated error but got: %v", err)
+	}
+}
+
+func TestNotifierSendRecordsCaller(t *testing.T) {
+	q := NewQueueMock()
+	n := &notify.Notifier{
+		Queue:         q,
+		Authenticator: auth.StaticTokens{"secret": "game"},
+		Policy:        auth.Rules{{Caller: "game", Users: []string{"player:*"}}},
+	}
+	_, err := n.Send(withToken("secret"), &notify.SendRequest{UserId: "player:1", Data: []byte("data")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	msg := <-q.messages
+	if msg.Caller != "game" {
+		t.Errorf("Wrong caller recorded: expecting 'game' but got '%s'", msg.Caller)
+	}
+}
+
+type AuditMock struct {
+	records []audit.Record
+}
+
+func (a *AuditMock) Log(r audit.Record) {
+	a.records = append(a.records, r)
+}
+
+func TestNotifierAuditsDecisions(t *testing.T) {
+	a := &AuditMock{}
+	n := &notify.Notifier{
+		Queue:         NewQueueMock(),
+		Authenticator: auth.StaticTokens{"secret": "game"},
+		Policy:        auth.Rules{{Caller: "game", Users: []string{"player:*"}}},
+		Audit:         a,
+	}
+	n.Send(withToken("secret"), &notify.SendRequest{UserId: "player:1", Data: []byte("data")})
+	n.Send(withToken("secret"), &notify.SendRequest{UserId: "admin", Data: []byte("data")})
+
+	if len(a.records) != 2 {
+		t.Fatalf("Wrong number of audit records: %d", len(a.records))
+	}
+	if r := a.records[0]; r.Decision != audit.DecisionAccepted || r.Caller != "game" || r.UserId != "player:1" || r.MessageId == "" {
+		t.Errorf("Wrong record for accepted notification: %+v", r)
+	}
+	if r := a.records[1]; r.Decision != audit.DecisionRejected || r.Caller != "game" || r.Reason == "" {
+		t.Errorf("Wrong record for rejected notification: %+v", r)
+	}
+}
+
+func TestNotifierFlushInboxRequeuesStoredMessages(t *testing.T) {
+	q := NewQueueMock()
+	store := inbox.NewMemoryStore()
+	store.Put(queue.QueuedMessage{Id: "1", UserId: "user1"})
+	store.Put(queue.QueuedMessage{Id: "2", UserId: "user1"})
+	n := &notify.Notifier{Queue: q, Inbox: store}
+
+	res, err := n.FlushInbox(context.Background(), &notify.FlushInboxRequest{UserId: "user1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if res.Count != 2 {
+		t.Errorf("Expecting 2 flushed messages but got %d", res.Count)
+	}
+	for _, id := range []string{"1", "2"} {
+		if msg := <-q.messages; msg.Id != id {
+			t.Errorf("Expecting message %s but got %s", id, msg.Id)
+		}
+	}
+	if store.Len("user1") != 0 {
+		t.Error("Flushed messages must be removed from the inbox")
+	}
+}
+
+func TestNotifierFlushInboxRequiresAuthorization(t *testing.T) {
+	store := inbox.NewMemoryStore()
+	store.Put(queue.QueuedMessage{Id: "1", UserId: "user1"})
+	n := &notify.Notifier{
+		Queue:         NewQueueMock(),
+		Inbox:         store,
+		Authenticator: auth.StaticTokens{"token1": "game"},
+	}
+	_, err := n.FlushInbox(context.Background(), &notify.FlushInboxRequest{UserId: "user1"})
+	if grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expecting unauthenticated error but got: %v", err)
+	}
+	if store.Len("user1") != 1 {
+		t.Error("Inbox must not be flushed for rejected calls")
+	}
+}
+
+func TestNotifierSendRouting(t *testing.T) {
+	q := NewQueueMock()
+	n := &notify.Notifier{Queue: q}
+	_, err := n.Send(context.Background(), &notify.SendRequest{
+		UserId:  "user1",
+		Data:    []byte("data"),
+		Routing: notify.SendRequest_MOST_RECENT,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if msg := <-q.messages; msg.Routing != queue.RouteMostRecent {
+		t.Errorf("Wrong routing queued: %d", msg.Routing)
+	}
+
+	_, err = n.Send(context.Background(), &notify.SendRequest{
+		UserId:  "user1",
+		Data:    []byte("data"),
+		Routing: notify.SendRequest_Routing(42),
+	})
+	if err == nil {
+		t.Error("Expecting an error for an unknown routing")
+	}
+}
+
+func TestNotifierSendTemplateUsesUserLocale(t *testing.T) {
+	q := NewQueueMock()
+	r := templates.NewRegistry()
+	r.Put("turn", "en", "Your turn, {{.player}}")
+	r.Put("turn", "fr", "A toi, {{.player}}")
+	n := &notify.Notifier{
+		Queue:     q,
+		Templates: r,
+		Locales:   templates.UserLocales{"user1": "fr"},
+	}
+	_, err := n.SendTemplate(context.Background(), &notify.SendTemplateRequest{
+		UserId:     "user1",
+		TemplateId: "turn",
+		Params:     map[string]string{"player": "Alice"},
+		Routing:    notify.SendRequest_SKIP_OFFLINE,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	msg := <-q.messages
+	if string(msg.Data) != "A toi, Alice" || msg.Routing != queue.RouteSkipOffline {
+		t.Errorf("Wrong message queued: %+v", msg)
+	}
+
+	_, err = n.SendTemplate(context.Background(), &notify.SendTemplateRequest{
+		UserId:     "user1",
+		TemplateId: "turn",
+		Locale:     "en",
+		Params:     map[string]string{"player": "Alice"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if msg := <-q.messages; string(msg.Data) != "Your turn, Alice" {
+		t.Errorf("Locale override ignored: %s", msg.Data)
+	}
+}
+
+func TestNotifierSendTemplateMissingParameter(t *testing.T) {
+	r := templates.NewRegistry()
+	r.Put("turn", "en", "Your turn, {{.player}}")
+	n := &notify.Notifier{Queue: NewQueueMock(), Templates: r}
+	_, err := n.SendTemplate(context.Background(), &notify.SendTemplateRequest{UserId: "user1", TemplateId: "turn"})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expecting invalid argument error for a missing parameter but got: %v", err)
+	}
+}
+
+func TestNotifierSendTemplatePassesNotification(t *testing.T) {
+	r := templates.NewRegistry()
+	r.Put("turn", "en", "Your turn")
+	q := NewQueueMock()
+	a := &AuditMock{}
+	n := &notify.Notifier{
+		Queue:         q,
+		Templates:     r,
+		Authenticator: auth.StaticTokens{"secret": "game"},
+		Policy:        auth.Rules{{Caller: "game", Users: []string{"*"}, Categories: []string{"turn"}}},
+		Audit:         a,
+	}
+	_, err := n.SendTemplate(withToken("secret"), &notify.SendTemplateRequest{
+		UserId:       "user1",
+		TemplateId:   "turn",
+		Notification: &notify.Notification{Title: "Chess", Category: "turn"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	msg := <-q.messages
+	if string(msg.Data) != "Your turn" || msg.Notification == nil || msg.Notification.Category != "turn" {
+		t.Errorf("Wrong message queued: %+v", msg)
+	}
+	if r := a.records[0]; r.PayloadSize <= len(msg.Data) {
+		t.Errorf("Audited payload must cover the notification: %+v", r)
+	}
+}
+
+func TestNotifierSendTemplateErrorCodes(t *testing.T) {
+	n := &notify.Notifier{Queue: NewQueueMock()}
+	_, err := n.SendTemplate(context.Background(), &notify.SendTemplateRequest{UserId: "user1", TemplateId: "turn"})
+	if grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expecting failed precondition error without templates but got: %v", err)
+	}
+	n.Templates = templates.NewRegistry()
+	_, err = n.SendTemplate(context.Background(), &notify.SendTemplateRequest{UserId: "user1"})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expecting invalid argument error for a missing template id but got: %v", err)
+	}
+	_, err = n.SendTemplate(context.Background(), &notify.SendTemplateRequest{UserId: "user1", TemplateId: "turn"})
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expecting not found error for an unknown template but got: %v", err)
+	}
+}
+
+func TestNotifierSendStructuredNotification(t *testing.T) {
+	q := NewQueueMock()
+	n := &notify.Notifier{Queue: q}
+	_, err := n.Send(context.Background(), &notify.SendRequest{
+		UserId: "user1",
+		Notification: &notify.Notification{
+			Title:       "Your turn",
+			Body:        "Alice played",
+			Data:        map[string]string{"game": "42"},
+			CollapseKey: "game-42",
+			Badge:       1,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	msg := <-q.messages
+	if msg.Notification == nil {
+		t.Fatal("Notification not queued")
+	}
+	if msg.Notification.Title != "Your turn" || msg.Notification.Data["game"] != "42" || msg.Notification.Badge != 1 {
+		t.Errorf("Wrong notification queued: %+v", msg.Notification)
+	}
+}
+
+func TestNotifierSendPayloadTooLarge(t *testing.T) {
+	n := &notify.Notifier{Queue: NewQueueMock(), MaxPayloadSize: 8}
+	if _, err := n.Send(context.Background(), &notify.SendRequest{UserId: "user1", Data: []byte("12345678")}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	_, err := n.Send(context.Background(), &notify.SendRequest{UserId: "user1", Data: []byte("123456789")})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expecting invalid argument error but got: %v", err)
+	}
+	_, err = n.Send(context.Background(), &notify.SendRequest{
+		UserId:       "user1",
+		Data:         []byte("1234"),
+		Notification: &notify.Notification{Title: "title"},
+	})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Notification must count towards the payload size: %v", err)
+	}
+}
+
+func TestNotifierSendCoalescingAuditsCanceledRequest(t *testing.T) {
+	q := &QueueMock{messages: make(chan queue.QueuedMessage)}
+	c := queue.NewCoalescer(q)
+	c.Close()
+	a := &AuditMock{}
+	n := &notify.Notifier{Queue: q, Coalescer: c, Audit: a}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := n.Send(ctx, &notify.SendRequest{UserId: "user1", Data: []byte("data"), CollapseKey: "score", CoalesceMs: 10})
+	if err != context.Canceled {
+		t.Errorf("Expecting the context error but got %v", err)
+	}
+	if len(a.records) != 1 || a.records[0].Decision != audit.DecisionRejected {
+		t.Errorf("Canceled request must be audited as rejected: %+v", a.records)
+	}
+}
+
+func TestNotifierSendCoalescing(t *testing.T) {
+	q := NewQueueMock()
+	n := &notify.Notifier{Queue: q, Coalescer: queue.NewCoalescer(q)}
+	for _, req := range []*notify.SendRequest{
+		{UserId: "user1", Data: []byte("data"), CoalesceMs: 100},
+		{UserId: "user1", Data: []byte("data"), CollapseKey: "score", CoalesceMs: 120000},
+	} {
+		if _, err := n.Send(context.Background(), req); err == nil {
+			t.Errorf("Expecting an error for %+v", req)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		_, err := n.Send(context.Background(), &notify.SendRequest{UserId: "user1", Data: []byte("data"), CollapseKey: "score", CoalesceMs: 10})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	select {
+	case msg := <-q.messages:
+		if msg.CollapseKey != "score" || msg.Notification != nil {
+			t.Errorf("Wrong digest: %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Digest was not queued")
+	}
+	select {
+	case msg := <-q.messages:
+		t.Errorf("Expecting a single digest but got %+v", msg)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
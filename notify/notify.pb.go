@@ -10,7 +10,18 @@ It is generated from these files:
 
 It has these top-level messages:
 	SendRequest
+	Notification
+	FallbackStep
+	SendTemplateRequest
 	SendReply
+	FlushInboxRequest
+	FlushInboxReply
+	CategoryPreference
+	GetPreferencesRequest
+	QuietHours
+	GetPreferencesReply
+	SetPreferencesRequest
+	SetPreferencesReply
 */
 package notify
 
@@ -28,15 +39,172 @@ var _ grpc.ClientConn
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
 
+type Priority int32
+
+const (
+	Priority_NORMAL Priority = 0
+	// Urgent messages are delivered during the quiet hours of the user.
+	Priority_URGENT Priority = 1
+)
+
+var Priority_name = map[int32]string{
+	0: "NORMAL",
+	1: "URGENT",
+}
+var Priority_value = map[string]int32{
+	"NORMAL": 0,
+	"URGENT": 1,
+}
+
+func (x Priority) String() string {
+	return proto.EnumName(Priority_name, int32(x))
+}
+
+// Routing selects which of the user's devices receive the message.
+type SendRequest_Routing int32
+
+const (
+	// Send to every device regardless of its status.
+	SendRequest_ALL SendRequest_Routing = 0
+	// Send to online devices only.
+	SendRequest_SKIP_OFFLINE SendRequest_Routing = 1
+	// Send to online devices and to offline devices through the fallback
+	// transport of their type, e.g. push or email.
+	SendRequest_OFFLINE_FALLBACK SendRequest_Routing = 2
+	// Send only to the most recently active device, preferring online ones.
+	SendRequest_MOST_RECENT SendRequest_Routing = 3
+)
+
+var SendRequest_Routing_name = map[int32]string{
+	0: "ALL",
+	1: "SKIP_OFFLINE",
+	2: "OFFLINE_FALLBACK",
+	3: "MOST_RECENT",
+}
+var SendRequest_Routing_value = map[string]int32{
+	"ALL":              0,
+	"SKIP_OFFLINE":     1,
+	"OFFLINE_FALLBACK": 2,
+	"MOST_RECENT":      3,
+}
+
+func (x SendRequest_Routing) String() string {
+	return proto.EnumName(SendRequest_Routing_name, int32(x))
+}
+
 type SendRequest struct {
-	UserId string `protobuf:"bytes,1,opt,name=user_id" json:"user_id,omitempty"`
-	Data   []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	UserId  string              `protobuf:"bytes,1,opt,name=user_id" json:"user_id,omitempty"`
+	Data    []byte              `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Routing SendRequest_Routing `protobuf:"varint,3,opt,name=routing,enum=notify.SendRequest_Routing" json:"routing,omitempty"`
+	// Fallback lists delivery steps tried in order until one of them delivers
+	// the message. It overrides the routing.
+	Fallback []*FallbackStep `protobuf:"bytes,4,rep,name=fallback" json:"fallback,omitempty"`
+	// FallbackPolicy names a fallback chain configured on the server. It is
+	// used if no fallback steps are given.
+	FallbackPolicy string `protobuf:"bytes,5,opt,name=fallback_policy" json:"fallback_policy,omitempty"`
+	// Notification is the structured form of the message. Transports map it
+	// to their format, e.g. a push alert or an email. Data, if also given, is
+	// passed along as the raw payload.
+	Notification *Notification `protobuf:"bytes,6,opt,name=notification" json:"notification,omitempty"`
+	Priority     Priority      `protobuf:"varint,7,opt,name=priority,enum=notify.Priority" json:"priority,omitempty"`
+	// CollapseKey lets the message replace a queued message of the user with
+	// the same key that has not been delivered yet.
+	CollapseKey string `protobuf:"bytes,8,opt,name=collapse_key" json:"collapse_key,omitempty"`
+	// CoalesceMs holds the message for the window given in milliseconds and
+	// merges all the messages with the same collapse key that arrive in the
+	// window into one digest. It requires a collapse key.
+	CoalesceMs uint32 `protobuf:"varint,9,opt,name=coalesce_ms" json:"coalesce_ms,omitempty"`
 }
 
 func (m *SendRequest) Reset()         { *m = SendRequest{} }
 func (m *SendRequest) String() string { return proto.CompactTextString(m) }
 func (*SendRequest) ProtoMessage()    {}
 
+func (m *SendRequest) GetFallback() []*FallbackStep {
+	if m != nil {
+		return m.Fallback
+	}
+	return nil
+}
+
+func (m *SendRequest) GetNotification() *Notification {
+	if m != nil {
+		return m.Notification
+	}
+	return nil
+}
+
+type Notification struct {
+	Title    string `protobuf:"bytes,1,opt,name=title" json:"title,omitempty"`
+	Body     string `protobuf:"bytes,2,opt,name=body" json:"body,omitempty"`
+	Category string `protobuf:"bytes,3,opt,name=category" json:"category,omitempty"`
+	// ContentType is the MIME type of the body, text/plain if empty.
+	ContentType string `protobuf:"bytes,4,opt,name=content_type" json:"content_type,omitempty"`
+	// Data is custom key/value data passed to the client application.
+	Data map[string]string `protobuf:"bytes,5,rep,name=data" json:"data,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// CollapseKey lets push services replace an older notification with the
+	// same key.
+	CollapseKey string `protobuf:"bytes,6,opt,name=collapse_key" json:"collapse_key,omitempty"`
+	Badge       int32  `protobuf:"varint,7,opt,name=badge" json:"badge,omitempty"`
+}
+
+func (m *Notification) Reset()         { *m = Notification{} }
+func (m *Notification) String() string { return proto.CompactTextString(m) }
+func (*Notification) ProtoMessage()    {}
+
+// FallbackStep is a single step of a fallback chain. The step succeeds if
+// the message is delivered to at least one of the selected devices within
+// the timeout.
+type FallbackStep struct {
+	// DeviceTypes selects the devices by the names of their type, e.g. "WS"
+	// or "APNS".
+	DeviceTypes []string `protobuf:"bytes,1,rep,name=device_types" json:"device_types,omitempty"`
+	// OnlineOnly skips offline devices.
+	OnlineOnly bool   `protobuf:"varint,2,opt,name=online_only" json:"online_only,omitempty"`
+	TimeoutMs  uint32 `protobuf:"varint,3,opt,name=timeout_ms" json:"timeout_ms,omitempty"`
+}
+
+func (m *FallbackStep) Reset()         { *m = FallbackStep{} }
+func (m *FallbackStep) String() string { return proto.CompactTextString(m) }
+func (*FallbackStep) ProtoMessage()    {}
+
+type SendTemplateRequest struct {
+	UserId     string            `protobuf:"bytes,1,opt,name=user_id" json:"user_id,omitempty"`
+	TemplateId string            `protobuf:"bytes,2,opt,name=template_id" json:"template_id,omitempty"`
+	Params     map[string]string `protobuf:"bytes,3,rep,name=params" json:"params,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Locale overrides the locale of the user.
+	Locale string `protobuf:"bytes,4,opt,name=locale" json:"locale,omitempty"`
+	// TemplateVersion pins the template version, the latest is used if zero.
+	TemplateVersion int32               `protobuf:"varint,5,opt,name=template_version" json:"template_version,omitempty"`
+	Routing         SendRequest_Routing `protobuf:"varint,6,opt,name=routing,enum=notify.SendRequest_Routing" json:"routing,omitempty"`
+	Fallback        []*FallbackStep     `protobuf:"bytes,7,rep,name=fallback" json:"fallback,omitempty"`
+	FallbackPolicy  string              `protobuf:"bytes,8,opt,name=fallback_policy" json:"fallback_policy,omitempty"`
+	Priority        Priority            `protobuf:"varint,9,opt,name=priority,enum=notify.Priority" json:"priority,omitempty"`
+	CollapseKey     string              `protobuf:"bytes,10,opt,name=collapse_key" json:"collapse_key,omitempty"`
+	CoalesceMs      uint32              `protobuf:"varint,11,opt,name=coalesce_ms" json:"coalesce_ms,omitempty"`
+	// Notification is sent along with the rendered template as its raw
+	// data, e.g. to set the category.
+	Notification *Notification `protobuf:"bytes,12,opt,name=notification" json:"notification,omitempty"`
+}
+
+func (m *SendTemplateRequest) Reset()         { *m = SendTemplateRequest{} }
+func (m *SendTemplateRequest) String() string { return proto.CompactTextString(m) }
+func (*SendTemplateRequest) ProtoMessage()    {}
+
+func (m *SendTemplateRequest) GetFallback() []*FallbackStep {
+	if m != nil {
+		return m.Fallback
+	}
+	return nil
+}
+
+func (m *SendTemplateRequest) GetNotification() *Notification {
+	if m != nil {
+		return m.Notification
+	}
+	return nil
+}
+
 type SendReply struct {
 }
 
@@ -44,13 +212,139 @@ func (m *SendReply) Reset()         { *m = SendReply{} }
 func (m *SendReply) String() string { return proto.CompactTextString(m) }
 func (*SendReply) ProtoMessage()    {}
 
+type FlushInboxRequest struct {
+	UserId string `protobuf:"bytes,1,opt,name=user_id" json:"user_id,omitempty"`
+}
+
+func (m *FlushInboxRequest) Reset()         { *m = FlushInboxRequest{} }
+func (m *FlushInboxRequest) String() string { return proto.CompactTextString(m) }
+func (*FlushInboxRequest) ProtoMessage()    {}
+
+type FlushInboxReply struct {
+	Count int32 `protobuf:"varint,1,opt,name=count" json:"count,omitempty"`
+}
+
+func (m *FlushInboxReply) Reset()         { *m = FlushInboxReply{} }
+func (m *FlushInboxReply) String() string { return proto.CompactTextString(m) }
+func (*FlushInboxReply) ProtoMessage()    {}
+
+// CategoryPreference mutes a notification category or some of its
+// channels. The empty category applies to messages without a category.
+type CategoryPreference struct {
+	Category string `protobuf:"bytes,1,opt,name=category" json:"category,omitempty"`
+	Muted    bool   `protobuf:"varint,2,opt,name=muted" json:"muted,omitempty"`
+	// MutedChannels are the names of the device types the category is not
+	// delivered to, e.g. "EMAIL".
+	MutedChannels []string `protobuf:"bytes,3,rep,name=muted_channels" json:"muted_channels,omitempty"`
+	// IsDefault is set on preferences the user has not set.
+	IsDefault bool `protobuf:"varint,4,opt,name=is_default" json:"is_default,omitempty"`
+}
+
+func (m *CategoryPreference) Reset()         { *m = CategoryPreference{} }
+func (m *CategoryPreference) String() string { return proto.CompactTextString(m) }
+func (*CategoryPreference) ProtoMessage()    {}
+
+type GetPreferencesRequest struct {
+	UserId string `protobuf:"bytes,1,opt,name=user_id" json:"user_id,omitempty"`
+}
+
+func (m *GetPreferencesRequest) Reset()         { *m = GetPreferencesRequest{} }
+func (m *GetPreferencesRequest) String() string { return proto.CompactTextString(m) }
+func (*GetPreferencesRequest) ProtoMessage()    {}
+
+// QuietHours is a daily window during which notifications that are not
+// urgent are deferred until the window ends.
+type QuietHours struct {
+	// Start and end of the window as times of day, e.g. "22:00" and "07:00".
+	Start string `protobuf:"bytes,1,opt,name=start" json:"start,omitempty"`
+	End   string `protobuf:"bytes,2,opt,name=end" json:"end,omitempty"`
+	// TimeZone is the IANA name of the time zone of the user, e.g.
+	// "Europe/Berlin". UTC is used if empty.
+	TimeZone string `protobuf:"bytes,3,opt,name=time_zone" json:"time_zone,omitempty"`
+}
+
+func (m *QuietHours) Reset()         { *m = QuietHours{} }
+func (m *QuietHours) String() string { return proto.CompactTextString(m) }
+func (*QuietHours) ProtoMessage()    {}
+
+type GetPreferencesReply struct {
+	Preferences []*CategoryPreference `protobuf:"bytes,1,rep,name=preferences" json:"preferences,omitempty"`
+	QuietHours  *QuietHours           `protobuf:"bytes,2,opt,name=quiet_hours" json:"quiet_hours,omitempty"`
+}
+
+func (m *GetPreferencesReply) Reset()         { *m = GetPreferencesReply{} }
+func (m *GetPreferencesReply) String() string { return proto.CompactTextString(m) }
+func (*GetPreferencesReply) ProtoMessage()    {}
+
+func (m *GetPreferencesReply) GetPreferences() []*CategoryPreference {
+	if m != nil {
+		return m.Preferences
+	}
+	return nil
+}
+
+func (m *GetPreferencesReply) GetQuietHours() *QuietHours {
+	if m != nil {
+		return m.QuietHours
+	}
+	return nil
+}
+
+type SetPreferencesRequest struct {
+	UserId      string                `protobuf:"bytes,1,opt,name=user_id" json:"user_id,omitempty"`
+	Preferences []*CategoryPreference `protobuf:"bytes,2,rep,name=preferences" json:"preferences,omitempty"`
+	// QuietHours replace the quiet hours of the user if set. They are kept
+	// unchanged if not set, unless clear_quiet_hours is set.
+	QuietHours      *QuietHours `protobuf:"bytes,3,opt,name=quiet_hours" json:"quiet_hours,omitempty"`
+	ClearQuietHours bool        `protobuf:"varint,4,opt,name=clear_quiet_hours" json:"clear_quiet_hours,omitempty"`
+}
+
+func (m *SetPreferencesRequest) Reset()         { *m = SetPreferencesRequest{} }
+func (m *SetPreferencesRequest) String() string { return proto.CompactTextString(m) }
+func (*SetPreferencesRequest) ProtoMessage()    {}
+
+func (m *SetPreferencesRequest) GetPreferences() []*CategoryPreference {
+	if m != nil {
+		return m.Preferences
+	}
+	return nil
+}
+
+func (m *SetPreferencesRequest) GetQuietHours() *QuietHours {
+	if m != nil {
+		return m.QuietHours
+	}
+	return nil
+}
+
+type SetPreferencesReply struct {
+}
+
+func (m *SetPreferencesReply) Reset()         { *m = SetPreferencesReply{} }
+func (m *SetPreferencesReply) String() string { return proto.CompactTextString(m) }
+func (*SetPreferencesReply) ProtoMessage()    {}
+
 func init() {
+	proto.RegisterEnum("notify.Priority", Priority_name, Priority_value)
+	proto.RegisterEnum("notify.SendRequest_Routing", SendRequest_Routing_name, SendRequest_Routing_value)
 }
 
 // Client API for Notifier service
 
 type NotifierClient interface {
 	Send(ctx context.Context, in *SendRequest, opts ...grpc.CallOption) (*SendReply, error)
+	// SendTemplate renders a template in the locale of the user and sends
+	// the result like Send.
+	SendTemplate(ctx context.Context, in *SendTemplateRequest, opts ...grpc.CallOption) (*SendReply, error)
+	// FlushInbox requeues the messages stored while the user had no online
+	// device. It is called when one of the user's devices comes online.
+	FlushInbox(ctx context.Context, in *FlushInboxRequest, opts ...grpc.CallOption) (*FlushInboxReply, error)
+	// GetPreferences returns the notification preferences of the user,
+	// including the defaults of categories the user has not set.
+	GetPreferences(ctx context.Context, in *GetPreferencesRequest, opts ...grpc.CallOption) (*GetPreferencesReply, error)
+	// SetPreferences replaces the notification preferences and quiet hours of
+	// the user.
+	SetPreferences(ctx context.Context, in *SetPreferencesRequest, opts ...grpc.CallOption) (*SetPreferencesReply, error)
 }
 
 type notifierClient struct {
@@ -70,10 +364,58 @@ func (c *notifierClient) Send(ctx context.Context, in *SendRequest, opts ...grpc
 	return out, nil
 }
 
+func (c *notifierClient) SendTemplate(ctx context.Context, in *SendTemplateRequest, opts ...grpc.CallOption) (*SendReply, error) {
+	out := new(SendReply)
+	err := grpc.Invoke(ctx, "/notify.Notifier/SendTemplate", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *notifierClient) FlushInbox(ctx context.Context, in *FlushInboxRequest, opts ...grpc.CallOption) (*FlushInboxReply, error) {
+	out := new(FlushInboxReply)
+	err := grpc.Invoke(ctx, "/notify.Notifier/FlushInbox", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *notifierClient) GetPreferences(ctx context.Context, in *GetPreferencesRequest, opts ...grpc.CallOption) (*GetPreferencesReply, error) {
+	out := new(GetPreferencesReply)
+	err := grpc.Invoke(ctx, "/notify.Notifier/GetPreferences", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *notifierClient) SetPreferences(ctx context.Context, in *SetPreferencesRequest, opts ...grpc.CallOption) (*SetPreferencesReply, error) {
+	out := new(SetPreferencesReply)
+	err := grpc.Invoke(ctx, "/notify.Notifier/SetPreferences", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for Notifier service
 
 type NotifierServer interface {
 	Send(context.Context, *SendRequest) (*SendReply, error)
+	// SendTemplate renders a template in the locale of the user and sends
+	// the result like Send.
+	SendTemplate(context.Context, *SendTemplateRequest) (*SendReply, error)
+	// FlushInbox requeues the messages stored while the user had no online
+	// device. It is called when one of the user's devices comes online.
+	FlushInbox(context.Context, *FlushInboxRequest) (*FlushInboxReply, error)
+	// GetPreferences returns the notification preferences of the user,
+	// including the defaults of categories the user has not set.
+	GetPreferences(context.Context, *GetPreferencesRequest) (*GetPreferencesReply, error)
+	// SetPreferences replaces the notification preferences and quiet hours of
+	// the user.
+	SetPreferences(context.Context, *SetPreferencesRequest) (*SetPreferencesReply, error)
 }
 
 func RegisterNotifierServer(s *grpc.Server, srv NotifierServer) {
@@ -92,6 +434,54 @@ func _Notifier_Send_Handler(srv interface{}, ctx context.Context, buf []byte) (p
 	return out, nil
 }
 
+func _Notifier_SendTemplate_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(SendTemplateRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(NotifierServer).SendTemplate(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Notifier_FlushInbox_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(FlushInboxRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(NotifierServer).FlushInbox(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Notifier_GetPreferences_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(GetPreferencesRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(NotifierServer).GetPreferences(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Notifier_SetPreferences_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(SetPreferencesRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(NotifierServer).SetPreferences(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 var _Notifier_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "notify.Notifier",
 	HandlerType: (*NotifierServer)(nil),
@@ -100,6 +490,22 @@ var _Notifier_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Send",
 			Handler:    _Notifier_Send_Handler,
 		},
+		{
+			MethodName: "SendTemplate",
+			Handler:    _Notifier_SendTemplate_Handler,
+		},
+		{
+			MethodName: "FlushInbox",
+			Handler:    _Notifier_FlushInbox_Handler,
+		},
+		{
+			MethodName: "GetPreferences",
+			Handler:    _Notifier_GetPreferences_Handler,
+		},
+		{
+			MethodName: "SetPreferences",
+			Handler:    _Notifier_SetPreferences_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{},
 }
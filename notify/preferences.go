@@ -0,0 +1,119 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/protogalaxy/service-notify/auth"
+	"github.com/protogalaxy/service-notify/preferences"
+	"golang.org/x/net/context"
+)
+
+func (n *Notifier) GetPreferences(ctx context.Context, req *GetPreferencesRequest) (*GetPreferencesReply, error) {
+	caller, err := n.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.UserId == "" {
+		return nil, errors.New("missing user id")
+	}
+	if err := n.authorize(caller, auth.Request{UserId: req.UserId}); err != nil {
+		return nil, err
+	}
+	if n.Preferences == nil {
+		return &GetPreferencesReply{}, nil
+	}
+	var res GetPreferencesReply
+	user := n.Preferences.Get(req.UserId)
+	for category, p := range user {
+		res.Preferences = append(res.Preferences, categoryPreference(category, p, false))
+	}
+	if q := n.Preferences.QuietHours(req.UserId); q != nil {
+		res.QuietHours = &QuietHours{TimeZone: q.Location.String()}
+		res.QuietHours.Start, res.QuietHours.End = q.Window()
+	}
+	for category, p := range n.Preferences.Defaults() {
+		if _, ok := user[category]; !ok {
+			res.Preferences = append(res.Preferences, categoryPreference(category, p, true))
+		}
+	}
+	sort.Slice(res.Preferences, func(i, j int) bool {
+		return res.Preferences[i].Category < res.Preferences[j].Category
+	})
+	return &res, nil
+}
+
+func (n *Notifier) SetPreferences(ctx context.Context, req *SetPreferencesRequest) (*SetPreferencesReply, error) {
+	caller, err := n.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.UserId == "" {
+		return nil, errors.New("missing user id")
+	}
+	if err := n.authorize(caller, auth.Request{UserId: req.UserId}); err != nil {
+		return nil, err
+	}
+	if n.Preferences == nil {
+		return nil, errors.New("preferences are not enabled")
+	}
+	prefs := make(map[string]preferences.Preference, len(req.Preferences))
+	for _, p := range req.Preferences {
+		if _, ok := prefs[p.Category]; ok {
+			return nil, fmt.Errorf("duplicate category: %s", p.Category)
+		}
+		channels, err := preferences.Channels(p.MutedChannels)
+		if err != nil {
+			return nil, fmt.Errorf("category %s: %s", p.Category, err)
+		}
+		prefs[p.Category] = preferences.Preference{
+			Muted:         p.Muted,
+			MutedChannels: channels,
+		}
+	}
+	var quiet *preferences.QuietHours
+	if q := req.QuietHours; q != nil {
+		if req.ClearQuietHours {
+			return nil, errors.New("quiet hours cannot be set and cleared at once")
+		}
+		var err error
+		if quiet, err = preferences.ParseQuietHours(q.Start, q.End, q.TimeZone); err != nil {
+			return nil, fmt.Errorf("quiet hours: %s", err)
+		}
+	}
+	n.Preferences.Set(req.UserId, prefs)
+	if quiet != nil || req.ClearQuietHours {
+		n.Preferences.SetQuietHours(req.UserId, quiet)
+	}
+	glog.V(3).Infof("Set %d preferences of user '%s'", len(prefs), req.UserId)
+	return &SetPreferencesReply{}, nil
+}
+
+func categoryPreference(category string, p preferences.Preference, isDefault bool) *CategoryPreference {
+	c := &CategoryPreference{
+		Category:  category,
+		Muted:     p.Muted,
+		IsDefault: isDefault,
+	}
+	for _, t := range p.MutedChannels {
+		c.MutedChannels = append(c.MutedChannels, t.String())
+	}
+	return c
+}
@@ -0,0 +1,158 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package notify_test
+
+import (
+	"testing"
+
+	"github.com/protogalaxy/service-notify/auth"
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/notify"
+	"github.com/protogalaxy/service-notify/preferences"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestNotifierSetPreferences(t *testing.T) {
+	store := preferences.NewMemoryStore(preferences.Defaults{
+		"promotions": {Muted: true},
+		"friends":    {},
+	})
+	n := &notify.Notifier{Preferences: store}
+	_, err := n.SetPreferences(context.Background(), &notify.SetPreferencesRequest{
+		UserId: "user1",
+		Preferences: []*notify.CategoryPreference{
+			{Category: "friends", MutedChannels: []string{"EMAIL"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if p := store.Preference("user1", "friends"); p.Allows(devicepresence.Device_EMAIL) || !p.Allows(devicepresence.Device_WS) {
+		t.Errorf("Preference not stored: %+v", p)
+	}
+
+	res, err := n.GetPreferences(context.Background(), &notify.GetPreferencesRequest{UserId: "user1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(res.Preferences) != 2 {
+		t.Fatalf("Expecting 2 preferences but got %d", len(res.Preferences))
+	}
+	friends, promotions := res.Preferences[0], res.Preferences[1]
+	if friends.Category != "friends" || friends.IsDefault || len(friends.MutedChannels) != 1 || friends.MutedChannels[0] != "EMAIL" {
+		t.Errorf("Wrong user preference: %+v", friends)
+	}
+	if promotions.Category != "promotions" || !promotions.IsDefault || !promotions.Muted {
+		t.Errorf("Wrong default preference: %+v", promotions)
+	}
+}
+
+func TestNotifierSetPreferencesInvalidChannel(t *testing.T) {
+	n := &notify.Notifier{Preferences: preferences.NewMemoryStore(nil)}
+	_, err := n.SetPreferences(context.Background(), &notify.SetPreferencesRequest{
+		UserId: "user1",
+		Preferences: []*notify.CategoryPreference{
+			{Category: "friends", MutedChannels: []string{"PIGEON"}},
+		},
+	})
+	if err == nil {
+		t.Error("Expecting an error for an unknown channel")
+	}
+}
+
+func TestNotifierSetPreferencesRequiresAuthorization(t *testing.T) {
+	store := preferences.NewMemoryStore(nil)
+	n := &notify.Notifier{
+		Preferences:   store,
+		Authenticator: auth.StaticTokens{"token1": "game"},
+	}
+	_, err := n.SetPreferences(context.Background(), &notify.SetPreferencesRequest{
+		UserId:      "user1",
+		Preferences: []*notify.CategoryPreference{{Category: "friends", Muted: true}},
+	})
+	if grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expecting unauthenticated error but got: %v", err)
+	}
+	if len(store.Get("user1")) != 0 {
+		t.Error("Preferences must not be set for rejected calls")
+	}
+}
+
+func TestNotifierSetQuietHours(t *testing.T) {
+	n := &notify.Notifier{Preferences: preferences.NewMemoryStore(nil)}
+	quiet := &notify.QuietHours{Start: "22:00", End: "07:30", TimeZone: "Europe/Berlin"}
+	_, err := n.SetPreferences(context.Background(), &notify.SetPreferencesRequest{UserId: "user1", QuietHours: quiet})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	res, err := n.GetPreferences(context.Background(), &notify.GetPreferencesRequest{UserId: "user1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if q := res.QuietHours; q == nil || *q != *quiet {
+		t.Errorf("Expecting %+v but got %+v", quiet, q)
+	}
+
+	quiet.TimeZone = "Nowhere/Special"
+	_, err = n.SetPreferences(context.Background(), &notify.SetPreferencesRequest{UserId: "user1", QuietHours: quiet})
+	if err == nil {
+		t.Error("Expecting an error for an unknown time zone")
+	}
+}
+
+func TestNotifierKeepsQuietHoursUntilCleared(t *testing.T) {
+	store := preferences.NewMemoryStore(nil)
+	n := &notify.Notifier{Preferences: store}
+	quiet := &notify.QuietHours{Start: "22:00", End: "07:00", TimeZone: "UTC"}
+	n.SetPreferences(context.Background(), &notify.SetPreferencesRequest{UserId: "user1", QuietHours: quiet})
+
+	_, err := n.SetPreferences(context.Background(), &notify.SetPreferencesRequest{
+		UserId:      "user1",
+		Preferences: []*notify.CategoryPreference{{Category: "chat", Muted: true}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if store.QuietHours("user1") == nil {
+		t.Error("Quiet hours must be kept when not given")
+	}
+
+	_, err = n.SetPreferences(context.Background(), &notify.SetPreferencesRequest{UserId: "user1", QuietHours: quiet, ClearQuietHours: true})
+	if err == nil {
+		t.Error("Expecting an error when setting and clearing quiet hours at once")
+	}
+	_, err = n.SetPreferences(context.Background(), &notify.SetPreferencesRequest{UserId: "user1", ClearQuietHours: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if store.QuietHours("user1") != nil {
+		t.Error("Quiet hours must be cleared")
+	}
+}
+
+func TestNotifierSendUrgent(t *testing.T) {
+	q := NewQueueMock()
+	n := &notify.Notifier{Queue: q}
+	_, err := n.Send(context.Background(), &notify.SendRequest{UserId: "user1", Data: []byte("data"), Priority: notify.Priority_URGENT})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if msg := <-q.messages; !msg.Urgent {
+		t.Error("Message should be urgent")
+	}
+}
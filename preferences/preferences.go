@@ -0,0 +1,189 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package preferences keeps the notification settings of users, such as
+// muted categories and channels.
+package preferences
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+)
+
+// Preference is the setting of a user for a notification category.
+type Preference struct {
+	// Muted drops all the notifications of the category.
+	Muted bool
+	// MutedChannels are the device types the notifications of the category
+	// are not delivered to.
+	MutedChannels []devicepresence.Device_Type
+}
+
+// Allows reports whether notifications may be delivered to devices of the
+// type.
+func (p Preference) Allows(t devicepresence.Device_Type) bool {
+	if p.Muted {
+		return false
+	}
+	for _, muted := range p.MutedChannels {
+		if muted == t {
+			return false
+		}
+	}
+	return true
+}
+
+// Store keeps the preferences of users by category. Messages without a
+// category use the preference of the empty category.
+type Store interface {
+	// Get returns the preferences the user has set.
+	Get(userID string) map[string]Preference
+	// Set replaces all the preferences of the user.
+	Set(userID string, prefs map[string]Preference)
+	// Preference returns the preference of the user for the category,
+	// falling back to the default of the category.
+	Preference(userID, category string) Preference
+	// Defaults returns the preferences of users who have not set their own.
+	Defaults() Defaults
+	// QuietHours returns the quiet hours of the user, nil if none are set.
+	QuietHours(userID string) *QuietHours
+	// SetQuietHours replaces the quiet hours of the user, nil removes them.
+	SetQuietHours(userID string, q *QuietHours)
+}
+
+// Defaults are the preferences of users who have not set their own.
+type Defaults map[string]Preference
+
+type preference struct {
+	Muted         bool     `json:"muted"`
+	MutedChannels []string `json:"muted_channels"`
+}
+
+// LoadDefaults reads the default preferences from a JSON file mapping
+// categories to preferences, e.g.
+//
+//	{"promotions": {"muted_channels": ["APNS", "FCM"]},
+//	 "newsletter": {"muted": true}}
+func LoadDefaults(name string) (Defaults, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var raw map[string]preference
+	if err := json.NewDecoder(f).Decode(&raw); err != nil {
+		return nil, err
+	}
+	defaults := make(Defaults)
+	for category, p := range raw {
+		channels, err := Channels(p.MutedChannels)
+		if err != nil {
+			return nil, fmt.Errorf("category %s: %s", category, err)
+		}
+		defaults[category] = Preference{
+			Muted:         p.Muted,
+			MutedChannels: channels,
+		}
+	}
+	return defaults, nil
+}
+
+// Channels parses device type names such as "WS" or "EMAIL".
+func Channels(names []string) ([]devicepresence.Device_Type, error) {
+	var types []devicepresence.Device_Type
+	for _, name := range names {
+		t, ok := devicepresence.Device_Type_value[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown device type: %s", name)
+		}
+		types = append(types, devicepresence.Device_Type(t))
+	}
+	return types, nil
+}
+
+// MemoryStore is an in-memory Store.
+type MemoryStore struct {
+	defaults Defaults
+
+	mu    sync.RWMutex
+	users map[string]map[string]Preference
+	quiet map[string]*QuietHours
+}
+
+func NewMemoryStore(defaults Defaults) *MemoryStore {
+	return &MemoryStore{
+		defaults: defaults,
+		users:    make(map[string]map[string]Preference),
+		quiet:    make(map[string]*QuietHours),
+	}
+}
+
+func (s *MemoryStore) Get(userID string) map[string]Preference {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prefs := make(map[string]Preference, len(s.users[userID]))
+	for category, p := range s.users[userID] {
+		prefs[category] = p
+	}
+	return prefs
+}
+
+func (s *MemoryStore) Set(userID string, prefs map[string]Preference) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(prefs) == 0 {
+		delete(s.users, userID)
+		return
+	}
+	user := make(map[string]Preference, len(prefs))
+	for category, p := range prefs {
+		user[category] = p
+	}
+	s.users[userID] = user
+}
+
+func (s *MemoryStore) Preference(userID, category string) Preference {
+	s.mu.RLock()
+	p, ok := s.users[userID][category]
+	s.mu.RUnlock()
+	if ok {
+		return p
+	}
+	return s.defaults[category]
+}
+
+func (s *MemoryStore) Defaults() Defaults {
+	return s.defaults
+}
+
+func (s *MemoryStore) QuietHours(userID string) *QuietHours {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.quiet[userID]
+}
+
+func (s *MemoryStore) SetQuietHours(userID string, q *QuietHours) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if q == nil {
+		delete(s.quiet, userID)
+		return
+	}
+	s.quiet[userID] = q
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package preferences_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/preferences"
+)
+
+func TestMemoryStoreFallsBackToDefaults(t *testing.T) {
+	s := preferences.NewMemoryStore(preferences.Defaults{
+		"promotions": {Muted: true},
+	})
+	if !s.Preference("user1", "promotions").Muted {
+		t.Error("Expecting the default preference")
+	}
+	s.Set("user1", map[string]preferences.Preference{"promotions": {}})
+	if s.Preference("user1", "promotions").Muted {
+		t.Error("Expecting the user preference")
+	}
+	if !s.Preference("user2", "promotions").Muted {
+		t.Error("Preferences of other users must not change")
+	}
+	s.Set("user1", nil)
+	if !s.Preference("user1", "promotions").Muted {
+		t.Error("Expecting the default preference after reset")
+	}
+}
+
+func TestPreferenceAllows(t *testing.T) {
+	p := preferences.Preference{MutedChannels: []devicepresence.Device_Type{devicepresence.Device_EMAIL}}
+	if p.Allows(devicepresence.Device_EMAIL) || !p.Allows(devicepresence.Device_WS) {
+		t.Errorf("Wrong channels allowed: %+v", p)
+	}
+	if (preferences.Preference{Muted: true}).Allows(devicepresence.Device_WS) {
+		t.Error("Muted preferences allow no channel")
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	f, err := ioutil.TempFile("", "preferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"promotions": {"muted_channels": ["APNS", "FCM"]}, "newsletter": {"muted": true}}`)
+	f.Close()
+
+	defaults, err := preferences.LoadDefaults(f.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if p := defaults["promotions"]; len(p.MutedChannels) != 2 || p.MutedChannels[1] != devicepresence.Device_FCM {
+		t.Errorf("Wrong promotions default: %+v", p)
+	}
+	if !defaults["newsletter"].Muted {
+		t.Errorf("Wrong newsletter default: %+v", defaults["newsletter"])
+	}
+}
+
+func TestLoadDefaultsUnknownChannel(t *testing.T) {
+	f, err := ioutil.TempFile("", "preferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"promotions": {"muted_channels": ["PIGEON"]}}`)
+	f.Close()
+
+	if _, err := preferences.LoadDefaults(f.Name()); err == nil {
+		t.Error("Expecting an error for an unknown channel")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package preferences
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+)
+
+// QuietHours is a daily window in the time zone of the user during which
+// non-urgent notifications are deferred on deferrable channels.
+type QuietHours struct {
+	// Start and End are the times of day the window starts and ends. The
+	// window spans midnight if End is not after Start.
+	Start    time.Duration
+	End      time.Duration
+	Location *time.Location
+}
+
+// Deferrable reports whether quiet hours hold back notifications on the
+// channel. Only push and email notifications alert the user, messages to
+// connected apps and webhooks are delivered right away.
+func Deferrable(t devicepresence.Device_Type) bool {
+	switch t {
+	case devicepresence.Device_APNS, devicepresence.Device_FCM, devicepresence.Device_EMAIL:
+		return true
+	}
+	return false
+}
+
+// ParseQuietHours parses a window given as "15:04" times of day in the
+// named time zone. The empty time zone is UTC.
+func ParseQuietHours(start, end, timeZone string) (*QuietHours, error) {
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, err
+	}
+	q := &QuietHours{Location: loc}
+	if q.Start, err = timeOfDay(start); err != nil {
+		return nil, err
+	}
+	if q.End, err = timeOfDay(end); err != nil {
+		return nil, err
+	}
+	if q.Start == q.End {
+		return nil, fmt.Errorf("empty quiet hours: %s-%s", start, end)
+	}
+	return q, nil
+}
+
+func timeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day: %s", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Until returns the end of the window if t falls inside it.
+func (q *QuietHours) Until(t time.Time) (time.Time, bool) {
+	local := t.In(q.Location)
+	// The window containing t started either today or, if it spans
+	// midnight, yesterday.
+	for _, days := range []int{0, -1} {
+		start := q.at(local, days, q.Start)
+		end := q.at(local, days, q.End)
+		if !end.After(start) {
+			end = q.at(local, days+1, q.End)
+		}
+		if !t.Before(start) && t.Before(end) {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// at returns the time of day on the date days after the date of t.
+func (q *QuietHours) at(t time.Time, days int, offset time.Duration) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d+days, int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, q.Location)
+}
+
+// Window returns the start and end of the window formatted like
+// ParseQuietHours expects them.
+func (q *QuietHours) Window() (start, end string) {
+	return clock(q.Start), clock(q.End)
+}
+
+func clock(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+}
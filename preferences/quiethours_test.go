@@ -0,0 +1,75 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package preferences_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/preferences"
+)
+
+func TestQuietHoursUntil(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	q := &preferences.QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour, Location: loc}
+	tests := []struct {
+		at    time.Time
+		quiet bool
+		until time.Time
+	}{
+		{time.Date(2016, 3, 1, 21, 59, 0, 0, loc), false, time.Time{}},
+		{time.Date(2016, 3, 1, 22, 0, 0, 0, loc), true, time.Date(2016, 3, 2, 7, 0, 0, 0, loc)},
+		{time.Date(2016, 3, 2, 3, 0, 0, 0, loc), true, time.Date(2016, 3, 2, 7, 0, 0, 0, loc)},
+		{time.Date(2016, 3, 2, 1, 0, 0, 0, time.UTC), true, time.Date(2016, 3, 2, 7, 0, 0, 0, loc)},
+		{time.Date(2016, 3, 2, 7, 0, 0, 0, loc), false, time.Time{}},
+		{time.Date(2016, 3, 2, 12, 0, 0, 0, loc), false, time.Time{}},
+	}
+	for _, test := range tests {
+		until, quiet := q.Until(test.at)
+		if quiet != test.quiet || !until.Equal(test.until) {
+			t.Errorf("%s: expecting %t until %s but got %t until %s", test.at, test.quiet, test.until, quiet, until)
+		}
+	}
+}
+
+func TestQuietHoursWithinDay(t *testing.T) {
+	q := &preferences.QuietHours{Start: 13 * time.Hour, End: 14 * time.Hour, Location: time.UTC}
+	if _, quiet := q.Until(time.Date(2016, 3, 1, 13, 30, 0, 0, time.UTC)); !quiet {
+		t.Error("Expecting quiet hours at 13:30")
+	}
+	if _, quiet := q.Until(time.Date(2016, 3, 1, 23, 0, 0, 0, time.UTC)); quiet {
+		t.Error("Not expecting quiet hours at 23:00")
+	}
+}
+
+func TestParseQuietHours(t *testing.T) {
+	q, err := preferences.ParseQuietHours("22:30", "07:00", "Europe/Berlin")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if start, end := q.Window(); start != "22:30" || end != "07:00" || q.Location.String() != "Europe/Berlin" {
+		t.Errorf("Wrong quiet hours: %s-%s %s", start, end, q.Location)
+	}
+	for _, w := range [][3]string{
+		{"22", "07:00", ""},
+		{"22:00", "22:00", ""},
+		{"22:00", "07:00", "Nowhere/Special"},
+	} {
+		if _, err := preferences.ParseQuietHours(w[0], w[1], w[2]); err == nil {
+			t.Errorf("Expecting an error for %v", w)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+)
+
+// Collapses reports whether msg replaces the undelivered message old. Queues
+// and stores holding messages should keep only the newest message of a
+// user with the same collapse key.
+func Collapses(old, msg QueuedMessage) bool {
+	return msg.CollapseKey != "" && old.CollapseKey == msg.CollapseKey && old.UserId == msg.UserId
+}
+
+// Collapse replaces the first of the messages that msg collapses in place
+// and reports whether it found one.
+func Collapse(messages []QueuedMessage, msg QueuedMessage) bool {
+	for i := range messages {
+		if Collapses(messages[i], msg) {
+			messages[i] = msg
+			return true
+		}
+	}
+	return false
+}
+
+// maxCoalescedMessages limits the messages held per group when the
+// coalescer has no MaxPayloadSize. The oldest messages are dropped first.
+const maxCoalescedMessages = 100
+
+type coalesceKey struct {
+	userID      string
+	collapseKey string
+}
+
+type coalesceGroup struct {
+	messages []QueuedMessage
+	timer    *time.Timer
+}
+
+// Coalescer holds messages for a window and queues all the messages of a
+// user with the same collapse key that arrived in the window as one digest.
+type Coalescer struct {
+	queue          MessageQueue
+	maxPayloadSize int
+	// pending counts the groups whose digest has not been queued yet.
+	pending sync.WaitGroup
+
+	mu     sync.Mutex
+	groups map[coalesceKey]*coalesceGroup
+	closed bool
+}
+
+type CoalescerProperties struct {
+	// MaxPayloadSize limits the size of the digest data, see TrimDigest.
+	// Zero means the digest is limited to maxCoalescedMessages messages.
+	MaxPayloadSize int
+}
+
+func NewCoalescer(q MessageQueue, conf ...func(*CoalescerProperties)) *Coalescer {
+	var p CoalescerProperties
+	for _, c := range conf {
+		c(&p)
+	}
+	return &Coalescer{
+		queue:          q,
+		maxPayloadSize: p.MaxPayloadSize,
+		groups:         make(map[coalesceKey]*coalesceGroup),
+	}
+}
+
+// Add holds the message until the window started by the first message of
+// its group ends. Messages without a collapse key are queued right away;
+// ctx bounds how long Add waits for the queue to take them.
+func (c *Coalescer) Add(ctx context.Context, msg QueuedMessage, window time.Duration) error {
+	key := coalesceKey{msg.UserId, msg.CollapseKey}
+	c.mu.Lock()
+	if msg.CollapseKey == "" || c.closed {
+		c.mu.Unlock()
+		select {
+		case c.queue.Messages() <- msg:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	g, ok := c.groups[key]
+	if !ok {
+		g = &coalesceGroup{}
+		c.pending.Add(1)
+		g.timer = time.AfterFunc(window, func() {
+			c.flush(key)
+		})
+		c.groups[key] = g
+	}
+	g.messages = append(g.messages, msg)
+	if c.maxPayloadSize > 0 {
+		g.messages = TrimDigest(g.messages, c.maxPayloadSize)
+	} else if len(g.messages) > maxCoalescedMessages {
+		g.messages = g.messages[len(g.messages)-maxCoalescedMessages:]
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// flush queues the digest of the group.
+func (c *Coalescer) flush(key coalesceKey) {
+	c.mu.Lock()
+	g, ok := c.groups[key]
+	delete(c.groups, key)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	defer c.pending.Done()
+	d, err := Digest(g.messages)
+	if err != nil {
+		glog.Errorf("Unable to merge %d messages of user %s into a digest, queueing them one by one: %s", len(g.messages), key.userID, err)
+		for _, msg := range g.messages {
+			c.queue.Messages() <- msg
+		}
+		return
+	}
+	c.queue.Messages() <- d
+}
+
+// Close queues the digests of all the messages still held and waits until
+// they are queued. Messages added later are queued right away.
+func (c *Coalescer) Close() {
+	c.mu.Lock()
+	c.closed = true
+	var keys []coalesceKey
+	for key, g := range c.groups {
+		g.timer.Stop()
+		keys = append(keys, key)
+	}
+	c.mu.Unlock()
+	for _, key := range keys {
+		c.flush(key)
+	}
+	c.pending.Wait()
+}
+
+// Len returns the number of messages held.
+func (c *Coalescer) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for _, g := range c.groups {
+		n += len(g.messages)
+	}
+	return n
+}
+
+type digestEntry struct {
+	Id           string                  `json:"id"`
+	Data         []byte                  `json:"data,omitempty"`
+	Notification *transport.Notification `json:"notification,omitempty"`
+}
+
+// DigestCountKey is the notification data key holding the number of
+// messages merged into a digest.
+const DigestCountKey = "digest_count"
+
+// Digest merges the messages, oldest first, into one. The data of the
+// digest lists the merged messages, see DigestData. The digest takes its
+// notification and delivery options from the newest message and is urgent
+// if any of the messages is. A single message is returned as is.
+func Digest(msgs []QueuedMessage) (QueuedMessage, error) {
+	newest := msgs[len(msgs)-1]
+	if len(msgs) == 1 {
+		return newest, nil
+	}
+	d := newest
+	for _, msg := range msgs {
+		d.Urgent = d.Urgent || msg.Urgent
+	}
+	data, err := DigestData(msgs)
+	if err != nil {
+		return QueuedMessage{}, err
+	}
+	d.Data = data
+	if newest.Notification != nil {
+		n := *newest.Notification
+		n.Data = make(map[string]string, len(newest.Notification.Data)+1)
+		for k, v := range newest.Notification.Data {
+			n.Data[k] = v
+		}
+		n.Data[DigestCountKey] = strconv.Itoa(len(msgs))
+		d.Notification = &n
+	}
+	return d, nil
+}
+
+// DigestData returns the JSON object listing the messages of a digest, e.g.
+//
+//	{"digest": [{"id": "...", "data": "<base64>", "notification": {...}}]}
+func DigestData(msgs []QueuedMessage) ([]byte, error) {
+	var digest struct {
+		Digest []digestEntry `json:"digest"`
+	}
+	for _, msg := range msgs {
+		digest.Digest = append(digest.Digest, newDigestEntry(msg))
+	}
+	return json.Marshal(digest)
+}
+
+func newDigestEntry(msg QueuedMessage) digestEntry {
+	return digestEntry{
+		Id:           msg.Id,
+		Data:         msg.Data,
+		Notification: msg.Notification,
+	}
+}
+
+// digestOverhead is the size of the digest data around its entries, less
+// the separator counted for every entry.
+const digestOverhead = len(`{"digest":[]}`) - 1
+
+// TrimDigest drops the oldest messages until the data of their digest fits
+// in maxSize bytes. The newest message is always kept. Zero means no limit.
+func TrimDigest(msgs []QueuedMessage, maxSize int) []QueuedMessage {
+	if maxSize <= 0 {
+		return msgs
+	}
+	size := digestOverhead
+	for i := len(msgs) - 1; i >= 0; i-- {
+		b, err := json.Marshal(newDigestEntry(msgs[i]))
+		if err != nil {
+			// Digest fails on the same message and the messages are
+			// queued one by one.
+			continue
+		}
+		size += len(b) + 1
+		if size > maxSize && i < len(msgs)-1 {
+			return msgs[i+1:]
+		}
+	}
+	return msgs
+}
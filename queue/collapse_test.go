@@ -0,0 +1,185 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package queue_test
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/queue"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+)
+
+func TestCollapse(t *testing.T) {
+	msgs := []queue.QueuedMessage{
+		{Id: "1", UserId: "u1"},
+		{Id: "2", UserId: "u1", CollapseKey: "score"},
+		{Id: "3", UserId: "u2", CollapseKey: "score"},
+	}
+	if queue.Collapse(msgs, queue.QueuedMessage{Id: "4", UserId: "u1"}) {
+		t.Error("Messages without a collapse key must not collapse")
+	}
+	if !queue.Collapse(msgs, queue.QueuedMessage{Id: "5", UserId: "u2", CollapseKey: "score"}) {
+		t.Fatal("Expecting the message to collapse")
+	}
+	if msgs[1].Id != "2" || msgs[2].Id != "5" {
+		t.Errorf("Wrong message replaced: %+v", msgs)
+	}
+}
+
+func TestSchedulerCollapsesMessages(t *testing.T) {
+	s := queue.NewScheduler(make(chanQueue))
+	at := time.Now().Add(time.Hour)
+	s.Schedule(queue.QueuedMessage{Id: "1", UserId: "u1", CollapseKey: "score"}, at)
+	s.Schedule(queue.QueuedMessage{Id: "2", UserId: "u1", CollapseKey: "score"}, at.Add(time.Hour))
+	if s.Len() != 1 {
+		t.Errorf("Expecting 1 scheduled message but got %d", s.Len())
+	}
+}
+
+func TestCoalescerQueuesDigest(t *testing.T) {
+	q := make(chanQueue, 10)
+	c := queue.NewCoalescer(q)
+	for _, id := range []string{"1", "2", "3"} {
+		c.Add(context.Background(), queue.QueuedMessage{
+			Id:          id,
+			UserId:      "u1",
+			Data:        []byte("data" + id),
+			CollapseKey: "score",
+			Urgent:      id == "1",
+			Notification: &transport.Notification{
+				Title: "Score " + id,
+				Data:  map[string]string{queue.DigestCountKey: "99"},
+			},
+		}, 20*time.Millisecond)
+	}
+	c.Add(context.Background(), queue.QueuedMessage{Id: "4", UserId: "u2", CollapseKey: "score"}, 20*time.Millisecond)
+	if c.Len() != 4 {
+		t.Errorf("Expecting 4 held messages but got %d", c.Len())
+	}
+
+	digests := make(map[string]queue.QueuedMessage)
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-q:
+			digests[msg.UserId] = msg
+		case <-time.After(time.Second):
+			t.Fatal("Digest was not queued")
+		}
+	}
+	if msg := digests["u2"]; msg.Id != "4" {
+		t.Errorf("Single messages must be queued as is: %+v", msg)
+	}
+	d := digests["u1"]
+	if d.Id != "3" || !d.Urgent || d.Notification.Title != "Score 3" || d.Notification.Data[queue.DigestCountKey] != "3" {
+		t.Errorf("Wrong digest: %+v %+v", d, d.Notification)
+	}
+	var data struct {
+		Digest []struct {
+			Id   string
+			Data []byte
+		}
+	}
+	if err := json.Unmarshal(d.Data, &data); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(data.Digest) != 3 || data.Digest[0].Id != "1" || string(data.Digest[2].Data) != "data3" {
+		t.Errorf("Wrong digest data: %s", d.Data)
+	}
+}
+
+func TestCoalescerLimitsHeldMessages(t *testing.T) {
+	q := make(chanQueue, 10)
+	c := queue.NewCoalescer(q)
+	for i := 0; i < 150; i++ {
+		c.Add(context.Background(), queue.QueuedMessage{Id: strconv.Itoa(i), UserId: "u1", CollapseKey: "score"}, time.Hour)
+	}
+	if c.Len() != 100 {
+		t.Errorf("Expecting 100 held messages but got %d", c.Len())
+	}
+	c.Close()
+	d := <-q
+	var data struct {
+		Digest []struct{ Id string }
+	}
+	if err := json.Unmarshal(d.Data, &data); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(data.Digest) != 100 || data.Digest[0].Id != "50" {
+		t.Errorf("Expecting the 100 newest messages but got %d from %s", len(data.Digest), data.Digest[0].Id)
+	}
+}
+
+func TestCoalescerLimitsDigestSize(t *testing.T) {
+	q := make(chanQueue, 10)
+	c := queue.NewCoalescer(q, func(p *queue.CoalescerProperties) {
+		p.MaxPayloadSize = 100
+	})
+	for i := 0; i < 10; i++ {
+		c.Add(context.Background(), queue.QueuedMessage{
+			Id:          strconv.Itoa(i),
+			UserId:      "u1",
+			Data:        []byte("0123456789"),
+			CollapseKey: "score",
+		}, time.Hour)
+	}
+	c.Close()
+	d := <-q
+	if len(d.Data) > 100 {
+		t.Errorf("Digest data of %d bytes exceeds the limit", len(d.Data))
+	}
+	var data struct {
+		Digest []struct{ Id string }
+	}
+	if err := json.Unmarshal(d.Data, &data); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(data.Digest) != 2 || data.Digest[1].Id != "9" {
+		t.Errorf("Expecting the newest messages that fit but got %s", d.Data)
+	}
+}
+
+func TestCoalescerAddHonorsContext(t *testing.T) {
+	c := queue.NewCoalescer(make(chanQueue))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := c.Add(ctx, queue.QueuedMessage{Id: "1", UserId: "u1"}, time.Hour)
+	if err != context.Canceled {
+		t.Errorf("Expecting the context error but got %v", err)
+	}
+}
+
+func TestCoalescerCloseQueuesHeldMessages(t *testing.T) {
+	q := make(chanQueue, 10)
+	c := queue.NewCoalescer(q)
+	c.Add(context.Background(), queue.QueuedMessage{Id: "1", UserId: "u1", CollapseKey: "score"}, time.Hour)
+	c.Close()
+	select {
+	case msg := <-q:
+		if msg.Id != "1" {
+			t.Errorf("Wrong message queued: %+v", msg)
+		}
+	default:
+		t.Fatal("Held message was not queued on close")
+	}
+	c.Add(context.Background(), queue.QueuedMessage{Id: "2", UserId: "u1", CollapseKey: "score"}, time.Hour)
+	if msg := <-q; msg.Id != "2" {
+		t.Errorf("Messages added after close must be queued right away: %+v", msg)
+	}
+}
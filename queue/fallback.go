@@ -0,0 +1,72 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+)
+
+// FallbackStep is a single step of a fallback chain. The step succeeds if
+// the message is delivered to at least one of its devices within the
+// timeout.
+type FallbackStep struct {
+	// Types selects the devices of the step.
+	Types []devicepresence.Device_Type
+	// OnlineOnly skips offline devices.
+	OnlineOnly bool
+	// Timeout limits the step. Zero means no limit.
+	Timeout time.Duration
+}
+
+func (s FallbackStep) selects(d *devicepresence.Device) bool {
+	if s.OnlineOnly && !online(d) {
+		return false
+	}
+	for _, t := range s.Types {
+		if d.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// fallback tries the steps in order until one of them delivers the message.
+// Steps without matching devices are skipped.
+func (h *Handler) fallback(ctx context.Context, steps []FallbackStep, msg transport.Message, devices []*devicepresence.Device, o *outcome) {
+	for i, step := range steps {
+		stepCtx, cancel := ctx, func() {}
+		if step.Timeout > 0 {
+			stepCtx, cancel = context.WithTimeout(ctx, step.Timeout)
+		}
+		delivered := false
+		for _, d := range devices {
+			if step.selects(d) && h.send(stepCtx, msg, h.Transports, d, o) {
+				delivered = true
+			}
+		}
+		cancel()
+		if delivered {
+			glog.V(3).Infof("Message %s delivered by fallback step %d", msg.Id, i+1)
+			o.step = i + 1
+			return
+		}
+	}
+}
@@ -14,11 +14,47 @@
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package queue
 
-import "sync"
+import (
+	"sync"
+
+	"github.com/protogalaxy/service-notify/transport"
+)
 
 type QueuedMessage struct {
+	// Id identifies the message in logs.
+	Id     string
 	UserId string
 	Data   []byte
+	// Notification is the structured form of the message if given.
+	Notification *transport.Notification
+	// Caller is the authenticated sender of the message, if any.
+	Caller string
+	// Routing selects the devices the message is sent to.
+	Routing Routing
+	// Fallback is tried step by step instead of the routing if set.
+	Fallback []FallbackStep
+	// Urgent messages are delivered during the quiet hours of the user.
+	Urgent bool
+	// CollapseKey lets the message replace an undelivered message of the
+	// user with the same key.
+	CollapseKey string
+	// Attempts counts how often the devices of the user could not be
+	// looked up for the message.
+	Attempts int
+	// Deferred messages were held back by the quiet hours of the user and
+	// only go to the channels quiet hours defer, the other devices already
+	// got them.
+	Deferred bool
+}
+
+// Payload returns the message as encoded for devices receiving opaque
+// payloads, so it covers the notification as well as the raw data.
+func (m QueuedMessage) Payload() []byte {
+	b, _, err := transport.NewMessage(m.Id, m.UserId, m.Data, m.Notification).Payload()
+	if err != nil {
+		return m.Data
+	}
+	return b
 }
 
 const (
@@ -35,12 +71,38 @@ type Properties struct {
 	QueueSize  int
 }
 
+// Stats is a snapshot of the queue state.
+type Stats struct {
+	Depth    int
+	Capacity int
+	Workers  int
+	Paused   bool
+}
+
+// ChannelQueue is an in-memory queue that accepts messages over a channel
+// and hands them to a pool of workers. Messages are kept pending until a
+// worker is ready to handle them so the pool can be paused and resized while
+// running.
 type ChannelQueue struct {
 	properties *Properties
 	worker     func(<-chan QueuedMessage)
 	messages   chan QueuedMessage
+	started    chan struct{}
 	done       chan struct{}
+	wake       chan struct{}
 	once       sync.Once
+	workers    sync.WaitGroup
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []QueuedMessage
+	flushed []QueuedMessage
+	work    chan QueuedMessage
+	spawned int
+	running int
+	paused  bool
+	closing bool
+	closed  bool
 }
 
 func NewChannelQueue(worker func(<-chan QueuedMessage), conf ...func(*Properties)) *ChannelQueue {
@@ -51,29 +113,257 @@ func NewChannelQueue(worker func(<-chan QueuedMessage), conf ...func(*Properties
 	for _, f := range conf {
 		f(p)
 	}
-	return &ChannelQueue{
+	q := &ChannelQueue{
 		properties: p,
 		worker:     worker,
-		messages:   make(chan QueuedMessage, p.QueueSize),
+		messages:   make(chan QueuedMessage),
+		started:    make(chan struct{}),
 		done:       make(chan struct{}),
+		wake:       make(chan struct{}, 1),
+		work:       make(chan QueuedMessage),
 	}
+	q.cond = sync.NewCond(&q.mu)
+	go q.intake()
+	return q
 }
 
+// Start runs the workers and blocks until the queue is closed and all the
+// workers have returned.
 func (q *ChannelQueue) Start() {
-	for i := 0; i < q.properties.NumWorkers; i++ {
-		go q.worker(q.messages)
-	}
+	q.mu.Lock()
+	q.spawn()
+	q.workers.Add(1)
+	go q.dispatch()
+	close(q.started)
+	q.mu.Unlock()
 
 	<-q.done
+	q.workers.Wait()
+}
+
+// Started is closed once all the workers have been started.
+func (q *ChannelQueue) Started() <-chan struct{} {
+	return q.started
 }
 
 func (q *ChannelQueue) Messages() chan<- QueuedMessage {
 	return q.messages
 }
 
+// Close stops accepting messages. Pending messages are still handed to the
+// workers, even if the queue is paused, before the workers are stopped.
+// The message channel is left open since producers may still be sending;
+// their sends block until they give up.
 func (q *ChannelQueue) Close() {
 	q.once.Do(func() {
+		q.mu.Lock()
+		q.closing = true
+		q.notify()
+		q.mu.Unlock()
 		close(q.done)
-		close(q.messages)
 	})
 }
+
+func (q *ChannelQueue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return Stats{
+		Depth:    len(q.pending) + len(q.flushed),
+		Capacity: q.properties.QueueSize,
+		Workers:  q.running,
+		Paused:   q.paused,
+	}
+}
+
+// Pause stops handing pending messages to the workers. Incoming messages are
+// still accepted until the queue is full.
+func (q *ChannelQueue) Pause() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = true
+	q.notify()
+}
+
+func (q *ChannelQueue) Resume() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = false
+	q.notify()
+}
+
+// Resize changes the number of workers. Workers that are removed finish the
+// message they are currently handling before they return.
+func (q *ChannelQueue) Resize(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.properties.NumWorkers = n
+	q.notify()
+}
+
+// Flush hands all the pending messages for the user to the workers ahead of
+// any other message, even if the queue is paused. It returns the number of
+// messages flushed.
+func (q *ChannelQueue) Flush(userID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var n int
+	q.pending = filterMessages(q.pending, userID, func(msg QueuedMessage) {
+		q.flushed = append(q.flushed, msg)
+		n++
+	})
+	q.notify()
+	return n
+}
+
+// Drop removes all the pending messages for the user and returns the number
+// of messages dropped.
+func (q *ChannelQueue) Drop(userID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var n int
+	q.pending = filterMessages(q.pending, userID, func(QueuedMessage) {
+		n++
+	})
+	q.flushed = filterMessages(q.flushed, userID, func(QueuedMessage) {
+		n++
+	})
+	q.notify()
+	return n
+}
+
+func filterMessages(messages []QueuedMessage, userID string, removed func(QueuedMessage)) []QueuedMessage {
+	kept := messages[:0]
+	for _, msg := range messages {
+		if msg.UserId == userID {
+			removed(msg)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// notify wakes up the intake and the dispatcher after the queue state has
+// changed. Must be called with the lock held.
+func (q *ChannelQueue) notify() {
+	q.cond.Broadcast()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// intake moves messages from the channel to the pending list as long as the
+// queue is not full. Messages replace the pending messages they collapse.
+func (q *ChannelQueue) intake() {
+	for {
+		q.mu.Lock()
+		for !q.closing && len(q.pending)+len(q.flushed) >= q.properties.QueueSize {
+			q.cond.Wait()
+		}
+		q.mu.Unlock()
+
+		var msg QueuedMessage
+		ok := true
+		select {
+		case msg = <-q.messages:
+		case <-q.done:
+			ok = false
+		}
+
+		q.mu.Lock()
+		if ok {
+			if !Collapse(q.flushed, msg) && !Collapse(q.pending, msg) {
+				q.pending = append(q.pending, msg)
+			}
+		} else {
+			q.closed = true
+		}
+		q.notify()
+		q.mu.Unlock()
+		if !ok {
+			return
+		}
+	}
+}
+
+// dispatch hands pending messages to whichever worker is ready first. A
+// message that could not be handed over before the queue state changed is
+// put back so the new state is taken into account.
+func (q *ChannelQueue) dispatch() {
+	defer q.workers.Done()
+	for {
+		msg, flushed, work, ok := q.next()
+		if !ok {
+			return
+		}
+		select {
+		case work <- msg:
+		case <-q.wake:
+			q.requeue(msg, flushed)
+		}
+	}
+}
+
+// next blocks until a message can be handed to the workers. It returns false
+// once the queue is closed and there is nothing left to dispatch.
+func (q *ChannelQueue) next() (msg QueuedMessage, flushed bool, work chan<- QueuedMessage, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		q.spawn()
+		switch {
+		case q.closing && q.running == 0:
+			close(q.work)
+			return msg, false, nil, false
+		case len(q.flushed) > 0:
+			msg, q.flushed = q.flushed[0], q.flushed[1:]
+			flushed = true
+		case len(q.pending) > 0 && (!q.paused || q.closing):
+			msg, q.pending = q.pending[0], q.pending[1:]
+		case q.closed:
+			close(q.work)
+			return msg, false, nil, false
+		default:
+			q.cond.Wait()
+			continue
+		}
+		q.cond.Broadcast()
+		return msg, flushed, q.work, true
+	}
+}
+
+// requeue puts back a message at the front of the list it was taken from.
+func (q *ChannelQueue) requeue(msg QueuedMessage, flushed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if flushed {
+		q.flushed = append([]QueuedMessage{msg}, q.flushed...)
+	} else {
+		q.pending = append([]QueuedMessage{msg}, q.pending...)
+	}
+}
+
+// spawn starts or stops workers until the configured number is running. The
+// workers are stopped by closing the channel they receive messages from so
+// shrinking the pool replaces all of them. Must be called with the lock held.
+func (q *ChannelQueue) spawn() {
+	if q.spawned > q.properties.NumWorkers {
+		close(q.work)
+		q.work = make(chan QueuedMessage)
+		q.spawned = 0
+	}
+	for q.spawned < q.properties.NumWorkers {
+		q.spawned++
+		q.running++
+		q.workers.Add(1)
+		go func(work <-chan QueuedMessage) {
+			defer q.workers.Done()
+			q.worker(work)
+			q.mu.Lock()
+			q.running--
+			q.notify()
+			q.mu.Unlock()
+		}(q.work)
+	}
+}
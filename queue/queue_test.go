@@ -52,6 +52,20 @@ func TestChannelQueueSendMessage(t *testing.T) {
 	}
 }
 
+func TestChannelQueueSendAfterCloseDoesNotPanic(t *testing.T) {
+	t.Parallel()
+	q := queue.NewChannelQueue(func(c <-chan queue.QueuedMessage) {
+		for range c {
+		}
+	})
+	go q.Start()
+	q.Close()
+	select {
+	case q.Messages() <- queue.QueuedMessage{UserId: "userid"}:
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
 func TestChannelQueueNumWorkersStarted(t *testing.T) {
 	t.Parallel()
 	var lock sync.Mutex
@@ -74,24 +88,205 @@ func TestChannelQueueNumWorkersStarted(t *testing.T) {
 }
 
 func TestChannelQueueSize(t *testing.T) {
+	t.Parallel()
+	q := queue.NewChannelQueue(func(c <-chan queue.QueuedMessage) {}, func(p *queue.Properties) {
+		p.NumWorkers = 1
+		p.QueueSize = 11
+	})
+	defer q.Close()
+
+	if size := q.Stats().Capacity; size != 11 {
+		t.Fatalf("Wrong queue size: expecting 11 but got %d", size)
+	}
+	for i := 0; i < 11; i++ {
+		q.Messages() <- queue.QueuedMessage{UserId: "u"}
+	}
+	select {
+	case q.Messages() <- queue.QueuedMessage{UserId: "u"}:
+		t.Fatal("Queue accepted more messages than its size")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestChannelQueueStarted(t *testing.T) {
+	t.Parallel()
+	q := queue.NewChannelQueue(func(c <-chan queue.QueuedMessage) {
+		for range c {
+		}
+	})
+	go q.Start()
+	defer q.Close()
+	select {
+	case <-q.Started():
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Queue workers were not started")
+	}
+}
+
+func TestChannelQueueStartWaitsForWorkers(t *testing.T) {
 	t.Parallel()
 	var lock sync.Mutex
-	var size int
+	var drained int
 	q := queue.NewChannelQueue(func(c <-chan queue.QueuedMessage) {
-		lock.Lock()
-		defer lock.Unlock()
-		size = cap(c)
+		for range c {
+			lock.Lock()
+			drained += 1
+			lock.Unlock()
+		}
 	}, func(p *queue.Properties) {
-		p.NumWorkers = 1
-		p.QueueSize = 11
+		p.NumWorkers = 2
 	})
-	// We must start and block so we make sure that worker goroutines are created.
+	q.Messages() <- queue.QueuedMessage{UserId: "u1"}
+	q.Messages() <- queue.QueuedMessage{UserId: "u2"}
 	go q.Close()
 	q.Start()
 
 	lock.Lock()
 	defer lock.Unlock()
-	if size != 11 {
-		t.Fatalf("Wrong queue size: expecting 11 but got %d", size)
+	if drained != 2 {
+		t.Fatalf("Queue was not drained: expecting 2 messages but got %d", drained)
+	}
+}
+
+func startQueue(t *testing.T, workers int, handler func(queue.QueuedMessage)) *queue.ChannelQueue {
+	w := &queue.Worker{
+		MessageHandler: handler,
+	}
+	q := queue.NewChannelQueue(w.Do, func(p *queue.Properties) {
+		p.NumWorkers = workers
+	})
+	go q.Start()
+	<-q.Started()
+	return q
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
 	}
 }
+
+func TestChannelQueuePauseResume(t *testing.T) {
+	t.Parallel()
+	handled := make(chan queue.QueuedMessage, 10)
+	q := startQueue(t, 1, func(msg queue.QueuedMessage) {
+		handled <- msg
+	})
+	defer q.Close()
+
+	q.Pause()
+	q.Messages() <- queue.QueuedMessage{UserId: "u1"}
+	waitFor(t, func() bool { return q.Stats().Depth == 1 })
+	select {
+	case <-handled:
+		t.Fatal("Message handled while the queue is paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if !q.Stats().Paused {
+		t.Error("Queue is not reported as paused")
+	}
+
+	q.Resume()
+	assertReceived(t, handled, "u1", "")
+}
+
+func TestChannelQueueDropUserMessages(t *testing.T) {
+	t.Parallel()
+	handled := make(chan queue.QueuedMessage, 10)
+	q := startQueue(t, 1, func(msg queue.QueuedMessage) {
+		handled <- msg
+	})
+	defer q.Close()
+
+	q.Pause()
+	q.Messages() <- queue.QueuedMessage{UserId: "u1", Data: []byte("d1")}
+	q.Messages() <- queue.QueuedMessage{UserId: "u2", Data: []byte("d2")}
+	q.Messages() <- queue.QueuedMessage{UserId: "u1", Data: []byte("d3")}
+	waitFor(t, func() bool { return q.Stats().Depth == 3 })
+
+	if n := q.Drop("u1"); n != 2 {
+		t.Errorf("Wrong number of dropped messages: expecting 2 but got %d", n)
+	}
+	q.Resume()
+	assertReceived(t, handled, "u2", "d2")
+	if depth := q.Stats().Depth; depth != 0 {
+		t.Errorf("Queue not empty: %d", depth)
+	}
+}
+
+func TestChannelQueueFlushUserMessages(t *testing.T) {
+	t.Parallel()
+	handled := make(chan queue.QueuedMessage, 10)
+	q := startQueue(t, 1, func(msg queue.QueuedMessage) {
+		handled <- msg
+	})
+	defer q.Close()
+
+	q.Pause()
+	q.Messages() <- queue.QueuedMessage{UserId: "u1", Data: []byte("d1")}
+	q.Messages() <- queue.QueuedMessage{UserId: "u2", Data: []byte("d2")}
+	waitFor(t, func() bool { return q.Stats().Depth == 2 })
+
+	if n := q.Flush("u2"); n != 1 {
+		t.Errorf("Wrong number of flushed messages: expecting 1 but got %d", n)
+	}
+	assertReceived(t, handled, "u2", "d2")
+	select {
+	case <-handled:
+		t.Fatal("Message of another user handled while the queue is paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestChannelQueueResize(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	w := &queue.Worker{}
+	w.MessageHandler = func(queue.QueuedMessage) {
+		<-release
+	}
+	q := queue.NewChannelQueue(w.Do, func(p *queue.Properties) {
+		p.NumWorkers = 1
+	})
+	go q.Start()
+	defer q.Close()
+	<-q.Started()
+
+	q.Resize(3)
+	for i := 0; i < 3; i++ {
+		q.Messages() <- queue.QueuedMessage{UserId: "u"}
+	}
+	waitFor(t, func() bool { return w.Busy() == 3 })
+	if workers := q.Stats().Workers; workers != 3 {
+		t.Errorf("Wrong number of workers: expecting 3 but got %d", workers)
+	}
+
+	q.Resize(1)
+	close(release)
+	waitFor(t, func() bool { return q.Stats().Workers == 1 })
+}
+
+func TestChannelQueueCollapsesPendingMessages(t *testing.T) {
+	t.Parallel()
+	handled := make(chan queue.QueuedMessage, 10)
+	q := startQueue(t, 1, func(msg queue.QueuedMessage) {
+		handled <- msg
+	})
+	defer q.Close()
+
+	q.Pause()
+	q.Messages() <- queue.QueuedMessage{UserId: "u1", Data: []byte("d1"), CollapseKey: "score"}
+	q.Messages() <- queue.QueuedMessage{UserId: "u2", Data: []byte("d2"), CollapseKey: "score"}
+	q.Messages() <- queue.QueuedMessage{UserId: "u1", Data: []byte("d3"), CollapseKey: "score"}
+	q.Messages() <- queue.QueuedMessage{UserId: "u1", Data: []byte("d4")}
+	waitFor(t, func() bool { return q.Stats().Depth == 3 })
+
+	q.Resume()
+	assertReceived(t, handled, "u1", "d3")
+	assertReceived(t, handled, "u2", "d2")
+	assertReceived(t, handled, "u1", "d4")
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+import (
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/transport"
+)
+
+// Routing selects which of the user's devices receive a message.
+type Routing int
+
+const (
+	// RouteAll sends to every device regardless of its status.
+	RouteAll Routing = iota
+	// RouteSkipOffline sends to online devices only.
+	RouteSkipOffline
+	// RouteOfflineFallback sends to online devices and to offline devices
+	// whose type has a fallback transport.
+	RouteOfflineFallback
+	// RouteMostRecent sends only to the most recently active device,
+	// preferring online devices.
+	RouteMostRecent
+)
+
+func online(d *devicepresence.Device) bool {
+	return d.Status == devicepresence.Device_ONLINE
+}
+
+// route returns the devices a message with the routing is sent to.
+func (h *Handler) route(routing Routing, devices []*devicepresence.Device) []*devicepresence.Device {
+	switch routing {
+	case RouteSkipOffline:
+		var selected []*devicepresence.Device
+		for _, d := range devices {
+			if online(d) {
+				selected = append(selected, d)
+			}
+		}
+		return selected
+	case RouteOfflineFallback:
+		var selected []*devicepresence.Device
+		for _, d := range devices {
+			if _, ok := h.Fallbacks[d.Type]; online(d) || ok {
+				selected = append(selected, d)
+			}
+		}
+		return selected
+	case RouteMostRecent:
+		var recent *devicepresence.Device
+		for _, d := range devices {
+			if recent == nil || moreRecent(d, recent) {
+				recent = d
+			}
+		}
+		if recent == nil {
+			return nil
+		}
+		return []*devicepresence.Device{recent}
+	}
+	return devices
+}
+
+func moreRecent(a, b *devicepresence.Device) bool {
+	if online(a) != online(b) {
+		return online(a)
+	}
+	return a.LastActive > b.LastActive
+}
+
+// transports returns the transports delivering to the device.
+func (h *Handler) transports(routing Routing, device *devicepresence.Device) transport.Registry {
+	if routing == RouteOfflineFallback && !online(device) {
+		return h.Fallbacks
+	}
+	return h.Transports
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Scheduler holds messages until their time has come and then puts them
+// back on the queue.
+type Scheduler struct {
+	queue MessageQueue
+	now   func() time.Time
+	wake  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+	// running tracks Run so Close can wait for the messages it is
+	// queueing.
+	running sync.WaitGroup
+
+	mu      sync.Mutex
+	pending schedule
+	closed  bool
+}
+
+type scheduled struct {
+	msg QueuedMessage
+	at  time.Time
+}
+
+// schedule is a heap of messages ordered by time.
+type schedule []scheduled
+
+func (s schedule) Len() int            { return len(s) }
+func (s schedule) Less(i, j int) bool  { return s[i].at.Before(s[j].at) }
+func (s schedule) Swap(i, j int)       { s[i], s[j] = s[j], s[i] }
+func (s *schedule) Push(x interface{}) { *s = append(*s, x.(scheduled)) }
+func (s *schedule) Pop() interface{} {
+	old := *s
+	x := old[len(old)-1]
+	*s = old[:len(old)-1]
+	return x
+}
+
+func NewScheduler(q MessageQueue) *Scheduler {
+	return &Scheduler{
+		queue: q,
+		now:   time.Now,
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+// Schedule queues the message again at the given time. A scheduled message
+// the message collapses is replaced instead and keeps its time. It reports
+// false if the scheduler is closed.
+func (s *Scheduler) Schedule(msg QueuedMessage, at time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	for i := range s.pending {
+		if Collapses(s.pending[i].msg, msg) {
+			s.pending[i].msg = msg
+			return true
+		}
+	}
+	heap.Push(&s.pending, scheduled{msg: msg, at: at})
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Len returns the number of scheduled messages.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// Run queues the scheduled messages when they are due. It blocks until the
+// scheduler is closed.
+func (s *Scheduler) Run() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.running.Add(1)
+	s.mu.Unlock()
+	defer s.running.Done()
+	for {
+		s.mu.Lock()
+		wait := time.Hour
+		var due []QueuedMessage
+		now := s.now()
+		for len(s.pending) > 0 {
+			if d := s.pending[0].at.Sub(now); d > 0 {
+				wait = d
+				break
+			}
+			due = append(due, heap.Pop(&s.pending).(scheduled).msg)
+		}
+		s.mu.Unlock()
+
+		for _, msg := range due {
+			s.queue.Messages() <- msg
+		}
+		if len(due) > 0 {
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-s.done:
+		}
+		timer.Stop()
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+	}
+}
+
+// Close stops Run and queues the messages that are still scheduled, earliest
+// first, waiting until they are queued. Messages are not scheduled anymore
+// once the scheduler is closed.
+func (s *Scheduler) Close() {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		pending := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+		close(s.done)
+		s.running.Wait()
+		for len(pending) > 0 {
+			s.queue.Messages() <- heap.Pop(&pending).(scheduled).msg
+		}
+	})
+}
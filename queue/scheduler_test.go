@@ -0,0 +1,86 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package queue_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/queue"
+)
+
+type chanQueue chan queue.QueuedMessage
+
+func (q chanQueue) Messages() chan<- queue.QueuedMessage {
+	return q
+}
+
+func TestSchedulerQueuesMessagesWhenDue(t *testing.T) {
+	q := make(chanQueue, 10)
+	s := queue.NewScheduler(q)
+	go s.Run()
+	defer s.Close()
+
+	now := time.Now()
+	s.Schedule(queue.QueuedMessage{Id: "2"}, now.Add(40*time.Millisecond))
+	s.Schedule(queue.QueuedMessage{Id: "1"}, now.Add(20*time.Millisecond))
+	s.Schedule(queue.QueuedMessage{Id: "later"}, now.Add(time.Hour))
+
+	for _, id := range []string{"1", "2"} {
+		select {
+		case msg := <-q:
+			if msg.Id != id {
+				t.Errorf("Expecting message %s but got %s", id, msg.Id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Message %s was not queued", id)
+		}
+	}
+	if time.Since(now) < 40*time.Millisecond {
+		t.Error("Messages queued too early")
+	}
+	if s.Len() != 1 {
+		t.Errorf("Expecting 1 scheduled message but got %d", s.Len())
+	}
+}
+
+func TestSchedulerClose(t *testing.T) {
+	q := make(chanQueue, 10)
+	s := queue.NewScheduler(q)
+	done := make(chan struct{})
+	go func() {
+		s.Run()
+		close(done)
+	}()
+	s.Schedule(queue.QueuedMessage{Id: "1"}, time.Now().Add(time.Hour))
+	s.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+	select {
+	case msg := <-q:
+		if msg.Id != "1" {
+			t.Errorf("Wrong message queued: %s", msg.Id)
+		}
+	default:
+		t.Error("Scheduled messages must be queued on Close")
+	}
+	if s.Schedule(queue.QueuedMessage{Id: "2"}, time.Now()) {
+		t.Error("A closed scheduler must not take messages")
+	}
+}
@@ -17,65 +17,338 @@ package queue
 
 import (
 	"io"
-	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/protogalaxy/service-notify/audit"
 	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/preferences"
 	"github.com/protogalaxy/service-notify/socket"
+	"github.com/protogalaxy/service-notify/transport"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 type Worker struct {
 	MessageHandler func(QueuedMessage)
+	busy           int32
 }
 
 func (w *Worker) Do(messages <-chan QueuedMessage) {
 	for msg := range messages {
+		atomic.AddInt32(&w.busy, 1)
 		w.MessageHandler(msg)
+		atomic.AddInt32(&w.busy, -1)
 	}
 }
 
+// Busy returns the number of messages that are currently being handled.
+func (w *Worker) Busy() int {
+	return int(atomic.LoadInt32(&w.busy))
+}
+
+// Handler fans out queued messages to all the devices of the user.
+type Handler struct {
+	Presence devicepresence.PresenceManagerClient
+	// Transports deliver the message to each device by its type. Devices
+	// without a registered transport count as failed deliveries.
+	Transports transport.Registry
+	// Fallbacks deliver to offline devices of messages routed with
+	// RouteOfflineFallback. Offline devices of other types are skipped.
+	Fallbacks transport.Registry
+	// Inbox keeps messages that were not delivered to any online device if
+	// set.
+	Inbox Inbox
+	// Audit records the outcome of each message if set.
+	Audit audit.Logger
+	// Preferences drop messages of categories the user muted and skip the
+	// muted channels if set.
+	Preferences preferences.Store
+	// Scheduler defers messages that are not urgent to push and email
+	// devices until the quiet hours of the user end. Quiet hours are
+	// ignored if it is not set.
+	Scheduler MessageScheduler
+	// Timeout limits handling a single message, including the device
+	// lookup. Zero means no limit.
+	Timeout time.Duration
+	// MaxAttempts is how often a message is handled before it is dropped
+	// when the devices of the user cannot be looked up. Failed messages are
+	// handed to the Scheduler again after RetryDelay, doubled for every
+	// attempt. Messages are dropped right away if the Scheduler is not set.
+	MaxAttempts int
+	RetryDelay  time.Duration
+	// Now returns the current time, time.Now if not set.
+	Now func() time.Time
+}
+
+// MessageScheduler queues messages again at a later time.
+type MessageScheduler interface {
+	// Schedule reports whether the message was scheduled. It is not once
+	// the scheduler is closed.
+	Schedule(msg QueuedMessage, at time.Time) bool
+}
+
+// Inbox stores messages until the user comes online.
+type Inbox interface {
+	Put(msg QueuedMessage)
+}
+
 func MessageHandler(presenceClient devicepresence.PresenceManagerClient, socketClient socket.SenderClient) func(QueuedMessage) {
-	return func(msg QueuedMessage) {
-		// TODO: add timeout
-		stream, err := presenceClient.GetDevices(context.Background(), &devicepresence.DevicesRequest{
-			UserId: msg.UserId,
-		})
-		if err != nil {
-			glog.Errorf("Unable to retrieve devices for user %s", msg.UserId)
-			return
-		}
+	h := &Handler{
+		Presence: presenceClient,
+		Transports: transport.Registry{
+			devicepresence.Device_WS: &transport.Socket{Client: socketClient},
+		},
+	}
+	return h.Handle
+}
+
+// outcome summarises the delivery of a message.
+type outcome struct {
+	devices   int
+	delivered int
+	// reached counts the deliveries that reached the user, see reaches.
+	reached int
+	stored  bool
+	muted   bool
+	// muteSkipped counts the devices that were skipped only because the
+	// user muted their channel.
+	muteSkipped int
+	// failed is set if the devices of the user could not be looked up.
+	failed bool
+	// deferred is set if the message was scheduled for the devices held
+	// back by the quiet hours of the user.
+	deferred bool
+	// step is the fallback step that delivered the message, counting from
+	// one.
+	step int
+}
 
-		for {
-			device, err := stream.Recv()
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				glog.Error("Unable to receive the next device")
+func (h *Handler) Handle(msg QueuedMessage) {
+	var o outcome
+	defer func() {
+		h.audit(msg, o)
+	}()
+
+	pref := h.preference(msg)
+	if pref.Muted {
+		glog.V(3).Infof("User %s muted the category of message %s, dropping it", msg.UserId, msg.Id)
+		o.muted = true
+		return
+	}
+	until, quiet := h.quietHours(msg)
+
+	ctx := context.Background()
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+	stream, err := h.Presence.GetDevices(ctx, &devicepresence.DevicesRequest{
+		UserId: msg.UserId,
+	})
+	if err != nil {
+		glog.Errorf("Unable to retrieve devices for user %s: %s", msg.UserId, err)
+		o.failed = true
+		h.retry(msg)
+		return
+	}
+
+	var all, held []*devicepresence.Device
+	for {
+		device, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			glog.Error("Unable to receive the next device")
+			break
+		}
+		deferrable := preferences.Deferrable(device.Type)
+		if msg.Deferred && !deferrable {
+			// The device got the message before the quiet hours.
+			continue
+		}
+		if !pref.Allows(device.Type) {
+			glog.V(3).Infof("User %s muted channel %s for message %s", msg.UserId, device.Type, msg.Id)
+			if reaches(device) {
+				o.muteSkipped++
 			}
-			sendMessageToDevice(socketClient, device, msg.Data)
+			continue
+		}
+		if quiet && deferrable {
+			held = append(held, device)
+			continue
+		}
+		all = append(all, device)
+	}
+	if len(held) > 0 {
+		d := msg
+		d.Deferred = true
+		if h.Scheduler.Schedule(d, until) {
+			glog.V(3).Infof("Deferring message %s to %d devices of user %s until %s", msg.Id, len(held), msg.UserId, until)
+			o.deferred = true
+		} else {
+			glog.Warningf("Unable to defer message %s to user %s, sending it right away", msg.Id, msg.UserId)
+			all = append(all, held...)
 		}
 	}
-}
 
-func sendMessageToDevice(socketClient socket.SenderClient, device *devicepresence.Device, data []byte) {
-	switch device.Type {
-	case devicepresence.Device_WS:
-		socketID, err := strconv.ParseInt(device.Id, 10, 64)
-		if err != nil {
-			glog.Errorf("Invalid socket id: %s", err)
-			return
+	m := transport.NewMessage(msg.Id, msg.UserId, msg.Data, msg.Notification)
+	if len(msg.Fallback) > 0 {
+		h.fallback(ctx, msg.Fallback, m, all, &o)
+	} else {
+		for _, device := range h.route(msg.Routing, all) {
+			h.send(ctx, m, h.transports(msg.Routing, device), device, &o)
 		}
-		// TODO: add timeout
-		_, err = socketClient.SendMessage(context.Background(), &socket.SendRequest{
-			SocketId: socketID,
-			Data:     data,
-		})
-		if err != nil {
-			glog.Errorf("Unable to send message to device '%s:%s'", device.Type, device.Id)
-			return
+	}
+
+	// Storing a message the user would have received if they had not
+	// muted the channel only sends it again on every flush.
+	mutedOnly := o.muteSkipped > 0 && o.delivered == o.devices
+	if o.reached == 0 && o.step == 0 && !mutedOnly && !o.deferred {
+		h.store(msg, &o)
+	}
+}
+
+// retry schedules the message to be handled again since the devices of the
+// user could not be looked up. Storing it in the inbox instead would only
+// hold it back from devices that are online.
+func (h *Handler) retry(msg QueuedMessage) {
+	msg.Attempts++
+	if h.Scheduler == nil || msg.Attempts >= h.MaxAttempts {
+		glog.Errorf("Giving up on message %s to user %s after %d attempts", msg.Id, msg.UserId, msg.Attempts)
+		return
+	}
+	delay := h.RetryDelay << uint(msg.Attempts-1)
+	if !h.Scheduler.Schedule(msg, h.now().Add(delay)) {
+		glog.Errorf("Unable to retry message %s to user %s, dropping it", msg.Id, msg.UserId)
+		return
+	}
+	glog.V(3).Infof("Retrying message %s to user %s in %s", msg.Id, msg.UserId, delay)
+}
+
+// store keeps the message in the inbox until the user comes online.
+func (h *Handler) store(msg QueuedMessage, o *outcome) {
+	if h.Inbox == nil {
+		return
+	}
+	glog.V(3).Infof("Message %s did not reach user %s, storing it", msg.Id, msg.UserId)
+	h.Inbox.Put(msg)
+	o.stored = true
+}
+
+// preference returns the preference of the user for the category of the
+// message.
+func (h *Handler) preference(msg QueuedMessage) preferences.Preference {
+	if h.Preferences == nil {
+		return preferences.Preference{}
+	}
+	var category string
+	if msg.Notification != nil {
+		category = msg.Notification.Category
+	}
+	return h.Preferences.Preference(msg.UserId, category)
+}
+
+// quietHours returns when the quiet hours of the user end if the message
+// has to wait for them on deferrable channels.
+func (h *Handler) quietHours(msg QueuedMessage) (time.Time, bool) {
+	if msg.Urgent || h.Scheduler == nil || h.Preferences == nil {
+		return time.Time{}, false
+	}
+	q := h.Preferences.QuietHours(msg.UserId)
+	if q == nil {
+		return time.Time{}, false
+	}
+	return q.Until(h.now())
+}
+
+func (h *Handler) now() time.Time {
+	if h.Now != nil {
+		return h.Now()
+	}
+	return time.Now()
+}
+
+// send delivers the message to the device and reports whether it succeeded.
+func (h *Handler) send(ctx context.Context, msg transport.Message, transports transport.Registry, device *devicepresence.Device, o *outcome) bool {
+	o.devices++
+	err := transports.Send(ctx, device, msg)
+	if err != nil {
+		glog.Errorf("Unable to send message to device '%s:%s': %s", device.Type, device.Id, err)
+		if _, ok := err.(transport.InvalidDeviceError); ok {
+			h.removeDevice(ctx, msg.UserId, device)
+		} else if grpc.Code(err) == codes.NotFound {
+			h.invalidate(msg.UserId)
 		}
-	default:
-		glog.Warning("Unsupported device type: %s", device.Type)
+		return false
+	}
+	o.delivered++
+	if reaches(device) {
+		o.reached++
+	}
+	return true
+}
+
+// reaches reports whether a delivery to the device reaches the user. Push,
+// email and webhook deliveries do not need the device to be online, while
+// sockets of offline devices are gone.
+func reaches(device *devicepresence.Device) bool {
+	switch device.Type {
+	case devicepresence.Device_WS, devicepresence.Device_SSE:
+		return online(device)
+	}
+	return true
+}
+
+// DeviceCache caches device lists in front of the presence service.
+type DeviceCache interface {
+	Invalidate(userID string)
+}
+
+// invalidate drops the cached devices of the user after a device turned
+// out to be gone, e.g. the socket was closed.
+func (h *Handler) invalidate(userID string) {
+	if c, ok := h.Presence.(DeviceCache); ok {
+		c.Invalidate(userID)
+	}
+}
+
+// removeDevice unregisters a device the transport reported as invalid so no
+// further messages are sent to it.
+func (h *Handler) removeDevice(ctx context.Context, userID string, device *devicepresence.Device) {
+	_, err := h.Presence.RemoveDevice(ctx, &devicepresence.RemoveDeviceRequest{
+		UserId:   userID,
+		DeviceId: device.Id,
+		Type:     device.Type,
+	})
+	if err != nil {
+		glog.Errorf("Unable to remove invalid device '%s:%s': %s", device.Type, device.Id, err)
+	}
+}
+
+func (h *Handler) audit(msg QueuedMessage, o outcome) {
+	if h.Audit == nil {
+		return
+	}
+	r := audit.NewRecord(audit.EventDelivery, msg.UserId, msg.Payload())
+	r.MessageId = msg.Id
+	r.Caller = msg.Caller
+	r.Result = audit.DeliveryResult(o.devices, o.delivered)
+	switch {
+	case o.muted:
+		r.Result = audit.ResultMuted
+	case o.deferred && o.delivered == 0:
+		r.Result = audit.ResultDeferred
+	case o.failed:
+		r.Result = audit.ResultFailed
 	}
+	r.Devices = o.devices
+	r.Delivered = o.delivered
+	r.Failed = o.devices - o.delivered
+	r.Stored = o.stored
+	r.FallbackStep = o.step
+	h.Audit.Log(r)
 }
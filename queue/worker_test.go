@@ -17,33 +17,72 @@ package queue_test
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/protogalaxy/service-notify/audit"
 	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/preferences"
 	"github.com/protogalaxy/service-notify/queue"
 	"github.com/protogalaxy/service-notify/socket"
+	"github.com/protogalaxy/service-notify/transport"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 type SenderMock struct {
-	OnSendMessage func(ctx context.Context, in *socket.SendRequest, opts ...grpc.CallOption) (*socket.SendReply, error)
+	OnSendMessage  func(ctx context.Context, in *socket.SendRequest, opts ...grpc.CallOption) (*socket.SendReply, error)
+	OnSendMessages func(ctx context.Context, in *socket.SendBatchRequest, opts ...grpc.CallOption) (*socket.SendBatchReply, error)
 }
 
 func (m SenderMock) SendMessage(ctx context.Context, in *socket.SendRequest, opts ...grpc.CallOption) (*socket.SendReply, error) {
 	return m.OnSendMessage(ctx, in, opts...)
 }
 
+func (m SenderMock) SendMessages(ctx context.Context, in *socket.SendBatchRequest, opts ...grpc.CallOption) (*socket.SendBatchReply, error) {
+	return m.OnSendMessages(ctx, in, opts...)
+}
+
 type PresenceManagerMock struct {
-	OnGetDevices func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error)
+	OnGetDevices      func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error)
+	OnRegisterDevice  func(ctx context.Context, in *devicepresence.Device, opts ...grpc.CallOption) (*devicepresence.RegisterDeviceReply, error)
+	OnRemoveDevice    func(ctx context.Context, in *devicepresence.RemoveDeviceRequest, opts ...grpc.CallOption) (*devicepresence.RemoveDeviceReply, error)
+	OnGetUsersDevices func(ctx context.Context, in *devicepresence.UsersDevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetUsersDevicesClient, error)
+	OnGetDeviceKey    func(ctx context.Context, in *devicepresence.DeviceKeyRequest, opts ...grpc.CallOption) (*devicepresence.DeviceKey, error)
 }
 
 func (m PresenceManagerMock) GetDevices(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
 	return m.OnGetDevices(ctx, in, opts...)
 }
 
+func (m PresenceManagerMock) GetUsersDevices(ctx context.Context, in *devicepresence.UsersDevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetUsersDevicesClient, error) {
+	return m.OnGetUsersDevices(ctx, in, opts...)
+}
+
+func (m PresenceManagerMock) RegisterDevice(ctx context.Context, in *devicepresence.Device, opts ...grpc.CallOption) (*devicepresence.RegisterDeviceReply, error) {
+	return m.OnRegisterDevice(ctx, in, opts...)
+}
+
+func (m PresenceManagerMock) RemoveDevice(ctx context.Context, in *devicepresence.RemoveDeviceRequest, opts ...grpc.CallOption) (*devicepresence.RemoveDeviceReply, error) {
+	return m.OnRemoveDevice(ctx, in, opts...)
+}
+
+func (m PresenceManagerMock) GetDeviceKey(ctx context.Context, in *devicepresence.DeviceKeyRequest, opts ...grpc.CallOption) (*devicepresence.DeviceKey, error) {
+	return m.OnGetDeviceKey(ctx, in, opts...)
+}
+
+type TransportMock struct {
+	OnSend func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error
+}
+
+func (m TransportMock) Send(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+	return m.OnSend(ctx, device, msg)
+}
+
 type DeviceStream struct {
 	devices []*devicepresence.Device
 	grpc.ClientStream
@@ -101,7 +140,7 @@ func TestWorkerHandlerMessagesAreSent(t *testing.T) {
 	}
 
 	h := queue.MessageHandler(pmm, sm)
-	h(queue.QueuedMessage{"user1", []byte("data")})
+	h(queue.QueuedMessage{UserId: "user1", Data: []byte("data")})
 	if messagesSent != 2 {
 		t.Errorf("Message sent to too many devices: %d", messagesSent)
 	}
@@ -117,7 +156,7 @@ func TestWorkerHandlerInvalidDeviceType(t *testing.T) {
 	}
 
 	h := queue.MessageHandler(pmm, nil)
-	h(queue.QueuedMessage{"user1", []byte("data")})
+	h(queue.QueuedMessage{UserId: "user1", Data: []byte("data")})
 }
 
 func TestWorkerGetUserDevicesError(t *testing.T) {
@@ -127,8 +166,38 @@ func TestWorkerGetUserDevicesError(t *testing.T) {
 		},
 	}
 
-	h := queue.MessageHandler(pmm, nil)
-	h(queue.QueuedMessage{"user1", []byte("data")})
+	now := time.Unix(1445000000, 0)
+	inbox := &InboxMock{}
+	a := &AuditMock{}
+	sched := &SchedulerMock{}
+	h := &queue.Handler{
+		Presence:    pmm,
+		Inbox:       inbox,
+		Audit:       a,
+		Scheduler:   sched,
+		MaxAttempts: 3,
+		RetryDelay:  time.Second,
+		Now:         func() time.Time { return now },
+	}
+	h.Handle(queue.QueuedMessage{UserId: "user1", Data: []byte("data"), Attempts: 1})
+
+	if r := a.records[0]; r.Result != audit.ResultFailed {
+		t.Errorf("Expecting a failed delivery but got %s", r.Result)
+	}
+	if len(inbox.stored) != 0 {
+		t.Error("Message must not be stored when the devices could not be looked up")
+	}
+	if len(sched.scheduled) != 1 || sched.scheduled[0].Attempts != 2 {
+		t.Fatalf("Expecting the message to be retried: %+v", sched.scheduled)
+	}
+	if d := sched.at[0].Sub(now); d != 2*time.Second {
+		t.Errorf("Expecting the retry delay to double but got %s", d)
+	}
+
+	h.Handle(sched.scheduled[0])
+	if len(sched.scheduled) != 1 {
+		t.Error("Message must be dropped after the last attempt")
+	}
 }
 
 func TestWorkerSendsMessagesToHandler(t *testing.T) {
@@ -149,7 +218,7 @@ func TestWorkerSendsMessagesToHandler(t *testing.T) {
 
 func sendMessage(t *testing.T, c chan<- queue.QueuedMessage, userId, data string) {
 	select {
-	case c <- queue.QueuedMessage{userId, []byte(data)}:
+	case c <- queue.QueuedMessage{UserId: userId, Data: []byte(data)}:
 	case <-time.After(time.Millisecond):
 		t.Fatalf("Unable to send the message the worker")
 	}
@@ -168,3 +237,643 @@ func assertReceived(t *testing.T, c <-chan queue.QueuedMessage, userId, data str
 		t.Fatalf("Unable to send the message the worker")
 	}
 }
+
+type AuditMock struct {
+	records []audit.Record
+}
+
+func (a *AuditMock) Log(r audit.Record) {
+	a.records = append(a.records, r)
+}
+
+func TestWorkerHandlerAuditsOutcome(t *testing.T) {
+	pmm := PresenceManagerMock{
+		OnGetDevices: func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+			return MockDeviceStream(&devicepresence.Device{
+				Id:   "111",
+				Type: devicepresence.Device_WS,
+			}, &devicepresence.Device{
+				Id:   "invalid",
+				Type: devicepresence.Device_WS,
+			}), nil
+		},
+	}
+	sm := SenderMock{
+		OnSendMessage: func(ctx context.Context, in *socket.SendRequest, opts ...grpc.CallOption) (*socket.SendReply, error) {
+			return &socket.SendReply{}, nil
+		},
+	}
+	a := &AuditMock{}
+	h := &queue.Handler{
+		Presence: pmm,
+		Transports: transport.Registry{
+			devicepresence.Device_WS: &transport.Socket{Client: sm},
+		},
+		Audit: a,
+	}
+	h.Handle(queue.QueuedMessage{Id: "m1", UserId: "user1", Data: []byte("data"), Caller: "game"})
+
+	if len(a.records) != 1 {
+		t.Fatalf("Wrong number of audit records: %d", len(a.records))
+	}
+	r := a.records[0]
+	if r.Event != audit.EventDelivery || r.MessageId != "m1" || r.Caller != "game" {
+		t.Errorf("Wrong audit record: %+v", r)
+	}
+	if r.Result != audit.ResultPartial || r.Devices != 2 || r.Delivered != 1 || r.Failed != 1 {
+		t.Errorf("Wrong delivery outcome: %+v", r)
+	}
+}
+
+func TestWorkerHandlerUnsupportedDeviceTypeFails(t *testing.T) {
+	pmm := PresenceManagerMock{
+		OnGetDevices: func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+			return MockDeviceStream(&devicepresence.Device{
+				Id:   "a@example.com",
+				Type: devicepresence.Device_EMAIL,
+			}), nil
+		},
+	}
+	a := &AuditMock{}
+	h := &queue.Handler{
+		Presence:   pmm,
+		Transports: transport.Registry{},
+		Audit:      a,
+	}
+	h.Handle(queue.QueuedMessage{UserId: "user1", Data: []byte("data")})
+
+	if r := a.records[0]; r.Result != audit.ResultFailed || r.Failed != 1 {
+		t.Errorf("Unsupported device type must count as failed delivery: %+v", r)
+	}
+}
+
+func TestWorkerHandlerRemovesInvalidDevices(t *testing.T) {
+	var removed *devicepresence.RemoveDeviceRequest
+	pmm := PresenceManagerMock{
+		OnGetDevices: func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+			return MockDeviceStream(&devicepresence.Device{
+				Id:   "token",
+				Type: devicepresence.Device_APNS,
+			}), nil
+		},
+		OnRemoveDevice: func(ctx context.Context, in *devicepresence.RemoveDeviceRequest, opts ...grpc.CallOption) (*devicepresence.RemoveDeviceReply, error) {
+			removed = in
+			return &devicepresence.RemoveDeviceReply{}, nil
+		},
+	}
+	h := &queue.Handler{
+		Presence: pmm,
+		Transports: transport.Registry{
+			devicepresence.Device_APNS: TransportMock{
+				OnSend: func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+					return transport.InvalidDeviceError{Reason: "Unregistered"}
+				},
+			},
+		},
+	}
+	h.Handle(queue.QueuedMessage{UserId: "user1", Data: []byte("data")})
+
+	if removed == nil {
+		t.Fatal("Invalid device must be removed")
+	}
+	if removed.UserId != "user1" || removed.DeviceId != "token" || removed.Type != devicepresence.Device_APNS {
+		t.Errorf("Wrong device removed: %+v", removed)
+	}
+}
+
+type InboxMock struct {
+	stored []queue.QueuedMessage
+}
+
+func (m *InboxMock) Put(msg queue.QueuedMessage) {
+	m.stored = append(m.stored, msg)
+}
+
+func TestWorkerHandlerStoresMessagesWithoutOnlineDevices(t *testing.T) {
+	tests := []struct {
+		name    string
+		devices []*devicepresence.Device
+		stored  bool
+	}{
+		{"no devices", nil, true},
+		{"offline devices", []*devicepresence.Device{
+			{Id: "1", Type: devicepresence.Device_WS, Status: devicepresence.Device_OFFLINE},
+		}, true},
+		{"failed online device", []*devicepresence.Device{
+			{Id: "fail", Type: devicepresence.Device_WS},
+		}, true},
+		{"online device", []*devicepresence.Device{
+			{Id: "1", Type: devicepresence.Device_WS, Status: devicepresence.Device_OFFLINE},
+			{Id: "2", Type: devicepresence.Device_WS},
+		}, false},
+		{"offline push device", []*devicepresence.Device{
+			{Id: "1", Type: devicepresence.Device_APNS, Status: devicepresence.Device_OFFLINE},
+		}, false},
+		{"failed offline push device", []*devicepresence.Device{
+			{Id: "fail", Type: devicepresence.Device_APNS, Status: devicepresence.Device_OFFLINE},
+		}, true},
+	}
+	for _, test := range tests {
+		devices := test.devices
+		pmm := PresenceManagerMock{
+			OnGetDevices: func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+				return MockDeviceStream(devices...), nil
+			},
+		}
+		tm := TransportMock{
+			OnSend: func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+				if device.Id == "fail" {
+					return errors.New("error")
+				}
+				return nil
+			},
+		}
+		inbox := &InboxMock{}
+		a := &AuditMock{}
+		h := &queue.Handler{
+			Presence: pmm,
+			Transports: transport.Registry{
+				devicepresence.Device_WS:   tm,
+				devicepresence.Device_APNS: tm,
+			},
+			Inbox: inbox,
+			Audit: a,
+		}
+		h.Handle(queue.QueuedMessage{Id: "msg1", UserId: "user1", Data: []byte("data")})
+
+		if stored := len(inbox.stored) == 1; stored != test.stored {
+			t.Errorf("%s: expecting stored %t but got %t", test.name, test.stored, stored)
+		}
+		if a.records[0].Stored != test.stored {
+			t.Errorf("%s: audit record stored mismatch", test.name)
+		}
+	}
+}
+
+func TestWorkerHandlerRouting(t *testing.T) {
+	devices := []*devicepresence.Device{
+		{Id: "ws-online", Type: devicepresence.Device_WS, LastActive: 100},
+		{Id: "ws-offline", Type: devicepresence.Device_WS, Status: devicepresence.Device_OFFLINE, LastActive: 300},
+		{Id: "push-offline", Type: devicepresence.Device_APNS, Status: devicepresence.Device_OFFLINE, LastActive: 200},
+		{Id: "ws-recent", Type: devicepresence.Device_WS, LastActive: 200},
+	}
+	tests := []struct {
+		routing  queue.Routing
+		expected []string
+	}{
+		{queue.RouteAll, []string{"ws-online", "ws-offline", "push-offline", "ws-recent"}},
+		{queue.RouteSkipOffline, []string{"ws-online", "ws-recent"}},
+		{queue.RouteOfflineFallback, []string{"ws-online", "fallback:push-offline", "ws-recent"}},
+		{queue.RouteMostRecent, []string{"ws-recent"}},
+	}
+	for _, test := range tests {
+		pmm := PresenceManagerMock{
+			OnGetDevices: func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+				return MockDeviceStream(devices...), nil
+			},
+		}
+		var sent []string
+		send := func(prefix string) transport.Transport {
+			return TransportMock{
+				OnSend: func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+					sent = append(sent, prefix+device.Id)
+					return nil
+				},
+			}
+		}
+		h := &queue.Handler{
+			Presence: pmm,
+			Transports: transport.Registry{
+				devicepresence.Device_WS:   send(""),
+				devicepresence.Device_APNS: send(""),
+			},
+			Fallbacks: transport.Registry{
+				devicepresence.Device_APNS: send("fallback:"),
+			},
+		}
+		h.Handle(queue.QueuedMessage{UserId: "user1", Data: []byte("data"), Routing: test.routing})
+
+		if fmt.Sprint(sent) != fmt.Sprint(test.expected) {
+			t.Errorf("Routing %d: expecting %v but sent to %v", test.routing, test.expected, sent)
+		}
+	}
+}
+
+func TestWorkerHandlerMostRecentPrefersOnlineDevices(t *testing.T) {
+	pmm := PresenceManagerMock{
+		OnGetDevices: func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+			return MockDeviceStream(
+				&devicepresence.Device{Id: "offline", Status: devicepresence.Device_OFFLINE, LastActive: 200},
+				&devicepresence.Device{Id: "online", LastActive: 100},
+			), nil
+		},
+	}
+	var sent []string
+	h := &queue.Handler{
+		Presence: pmm,
+		Transports: transport.Registry{
+			devicepresence.Device_WS: TransportMock{
+				OnSend: func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+					sent = append(sent, device.Id)
+					return nil
+				},
+			},
+		},
+	}
+	h.Handle(queue.QueuedMessage{UserId: "user1", Data: []byte("data"), Routing: queue.RouteMostRecent})
+
+	if len(sent) != 1 || sent[0] != "online" {
+		t.Errorf("Expecting the online device but sent to %v", sent)
+	}
+}
+
+func TestWorkerHandlerFallbackChain(t *testing.T) {
+	pmm := PresenceManagerMock{
+		OnGetDevices: func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+			return MockDeviceStream(
+				&devicepresence.Device{Id: "ws", Type: devicepresence.Device_WS, Status: devicepresence.Device_OFFLINE},
+				&devicepresence.Device{Id: "push", Type: devicepresence.Device_APNS},
+				&devicepresence.Device{Id: "email", Type: devicepresence.Device_EMAIL},
+			), nil
+		},
+	}
+	var sent []string
+	send := func(err error) transport.Transport {
+		return TransportMock{
+			OnSend: func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+				sent = append(sent, device.Id)
+				return err
+			},
+		}
+	}
+	a := &AuditMock{}
+	h := &queue.Handler{
+		Presence: pmm,
+		Transports: transport.Registry{
+			devicepresence.Device_WS:    send(nil),
+			devicepresence.Device_APNS:  send(errors.New("error")),
+			devicepresence.Device_EMAIL: send(nil),
+		},
+		Audit: a,
+	}
+	h.Handle(queue.QueuedMessage{
+		UserId: "user1",
+		Data:   []byte("data"),
+		Fallback: []queue.FallbackStep{
+			{Types: []devicepresence.Device_Type{devicepresence.Device_WS}, OnlineOnly: true},
+			{Types: []devicepresence.Device_Type{devicepresence.Device_APNS}},
+			{Types: []devicepresence.Device_Type{devicepresence.Device_EMAIL}},
+			{Types: []devicepresence.Device_Type{devicepresence.Device_WS}},
+		},
+	})
+
+	if fmt.Sprint(sent) != "[push email]" {
+		t.Errorf("Unexpected deliveries: %v", sent)
+	}
+	if r := a.records[0]; r.FallbackStep != 3 || r.Result != audit.ResultPartial {
+		t.Errorf("Expecting delivery by step 3: %+v", r)
+	}
+}
+
+func TestWorkerHandlerFallbackDeliveryIsNotStored(t *testing.T) {
+	pmm := PresenceManagerMock{
+		OnGetDevices: func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+			return MockDeviceStream(
+				&devicepresence.Device{Id: "ws", Type: devicepresence.Device_WS, Status: devicepresence.Device_OFFLINE},
+			), nil
+		},
+	}
+	inbox := &InboxMock{}
+	a := &AuditMock{}
+	h := &queue.Handler{
+		Presence: pmm,
+		Transports: transport.Registry{
+			devicepresence.Device_WS: TransportMock{
+				OnSend: func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+					return nil
+				},
+			},
+		},
+		Inbox: inbox,
+		Audit: a,
+	}
+	h.Handle(queue.QueuedMessage{
+		UserId: "user1",
+		Data:   []byte("data"),
+		Fallback: []queue.FallbackStep{
+			{Types: []devicepresence.Device_Type{devicepresence.Device_WS}},
+		},
+	})
+
+	if len(inbox.stored) != 0 || a.records[0].Stored {
+		t.Error("Message delivered by a fallback step must not be stored")
+	}
+	if r := a.records[0]; r.FallbackStep != 1 {
+		t.Errorf("Expecting delivery by step 1: %+v", r)
+	}
+}
+
+func TestWorkerHandlerFallbackStepTimeout(t *testing.T) {
+	pmm := PresenceManagerMock{
+		OnGetDevices: func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+			return MockDeviceStream(
+				&devicepresence.Device{Id: "ws", Type: devicepresence.Device_WS},
+				&devicepresence.Device{Id: "push", Type: devicepresence.Device_FCM},
+			), nil
+		},
+	}
+	a := &AuditMock{}
+	h := &queue.Handler{
+		Presence: pmm,
+		Transports: transport.Registry{
+			devicepresence.Device_WS: TransportMock{
+				OnSend: func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+					<-ctx.Done()
+					return ctx.Err()
+				},
+			},
+			devicepresence.Device_FCM: TransportMock{
+				OnSend: func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+					return nil
+				},
+			},
+		},
+		Audit: a,
+	}
+	h.Handle(queue.QueuedMessage{
+		UserId: "user1",
+		Data:   []byte("data"),
+		Fallback: []queue.FallbackStep{
+			{Types: []devicepresence.Device_Type{devicepresence.Device_WS}, Timeout: 10 * time.Millisecond},
+			{Types: []devicepresence.Device_Type{devicepresence.Device_FCM}},
+		},
+	})
+
+	if r := a.records[0]; r.FallbackStep != 2 {
+		t.Errorf("Expecting delivery by step 2 after the timeout: %+v", r)
+	}
+}
+
+func TestWorkerHandlerHonoursPreferences(t *testing.T) {
+	prefs := preferences.NewMemoryStore(preferences.Defaults{
+		"promotions": {Muted: true},
+	})
+	prefs.Set("user1", map[string]preferences.Preference{
+		"friends": {MutedChannels: []devicepresence.Device_Type{devicepresence.Device_APNS}},
+	})
+	tests := []struct {
+		category string
+		expected []string
+		result   string
+	}{
+		{"", []string{"ws", "push"}, audit.ResultDelivered},
+		{"friends", []string{"ws"}, audit.ResultDelivered},
+		{"promotions", nil, audit.ResultMuted},
+	}
+	for _, test := range tests {
+		pmm := PresenceManagerMock{
+			OnGetDevices: func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+				return MockDeviceStream(
+					&devicepresence.Device{Id: "ws", Type: devicepresence.Device_WS},
+					&devicepresence.Device{Id: "push", Type: devicepresence.Device_APNS},
+				), nil
+			},
+		}
+		var sent []string
+		tm := TransportMock{
+			OnSend: func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+				sent = append(sent, device.Id)
+				return nil
+			},
+		}
+		inbox := &InboxMock{}
+		a := &AuditMock{}
+		h := &queue.Handler{
+			Presence: pmm,
+			Transports: transport.Registry{
+				devicepresence.Device_WS:   tm,
+				devicepresence.Device_APNS: tm,
+			},
+			Inbox:       inbox,
+			Audit:       a,
+			Preferences: prefs,
+		}
+		h.Handle(queue.QueuedMessage{
+			UserId:       "user1",
+			Notification: &transport.Notification{Body: "body", Category: test.category},
+		})
+
+		if fmt.Sprint(sent) != fmt.Sprint(test.expected) {
+			t.Errorf("Category %q: expecting %v but sent to %v", test.category, test.expected, sent)
+		}
+		if a.records[0].Result != test.result {
+			t.Errorf("Category %q: expecting result %s but got %s", test.category, test.result, a.records[0].Result)
+		}
+		if len(inbox.stored) != 0 {
+			t.Errorf("Category %q: message should not be stored", test.category)
+		}
+	}
+}
+
+func TestWorkerHandlerDoesNotStoreMessagesForMutedChannels(t *testing.T) {
+	prefs := preferences.NewMemoryStore(nil)
+	prefs.Set("user1", map[string]preferences.Preference{
+		"friends": {MutedChannels: []devicepresence.Device_Type{devicepresence.Device_WS}},
+	})
+	tests := []struct {
+		name    string
+		devices []*devicepresence.Device
+		stored  bool
+	}{
+		{"muted online device", []*devicepresence.Device{
+			{Id: "ws", Type: devicepresence.Device_WS},
+		}, false},
+		{"muted offline device", []*devicepresence.Device{
+			{Id: "ws", Type: devicepresence.Device_WS, Status: devicepresence.Device_OFFLINE},
+		}, true},
+		{"muted online device and failed device", []*devicepresence.Device{
+			{Id: "ws", Type: devicepresence.Device_WS},
+			{Id: "fail", Type: devicepresence.Device_APNS},
+		}, true},
+	}
+	for _, test := range tests {
+		devices := test.devices
+		pmm := PresenceManagerMock{
+			OnGetDevices: func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+				return MockDeviceStream(devices...), nil
+			},
+		}
+		tm := TransportMock{
+			OnSend: func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+				return errors.New("error")
+			},
+		}
+		inbox := &InboxMock{}
+		h := &queue.Handler{
+			Presence: pmm,
+			Transports: transport.Registry{
+				devicepresence.Device_WS:   tm,
+				devicepresence.Device_APNS: tm,
+			},
+			Inbox:       inbox,
+			Preferences: prefs,
+		}
+		h.Handle(queue.QueuedMessage{
+			UserId:       "user1",
+			Notification: &transport.Notification{Body: "body", Category: "friends"},
+		})
+
+		if stored := len(inbox.stored) == 1; stored != test.stored {
+			t.Errorf("%s: expecting stored %t but got %t", test.name, test.stored, stored)
+		}
+	}
+}
+
+type SchedulerMock struct {
+	scheduled []queue.QueuedMessage
+	at        []time.Time
+	closed    bool
+}
+
+func (m *SchedulerMock) Schedule(msg queue.QueuedMessage, at time.Time) bool {
+	if m.closed {
+		return false
+	}
+	m.scheduled = append(m.scheduled, msg)
+	m.at = append(m.at, at)
+	return true
+}
+
+func TestWorkerHandlerDefersDuringQuietHours(t *testing.T) {
+	prefs := preferences.NewMemoryStore(nil)
+	prefs.SetQuietHours("user1", &preferences.QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour, Location: time.UTC})
+	tests := []struct {
+		urgent   bool
+		closed   bool
+		deferred bool
+		sent     []devicepresence.Device_Type
+	}{
+		{false, false, true, []devicepresence.Device_Type{devicepresence.Device_WS}},
+		{true, false, false, []devicepresence.Device_Type{devicepresence.Device_WS, devicepresence.Device_APNS}},
+		{false, true, false, []devicepresence.Device_Type{devicepresence.Device_WS, devicepresence.Device_APNS}},
+	}
+	for _, test := range tests {
+		pmm := PresenceManagerMock{
+			OnGetDevices: func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+				return MockDeviceStream(
+					&devicepresence.Device{Id: "ws", Type: devicepresence.Device_WS},
+					&devicepresence.Device{Id: "apns", Type: devicepresence.Device_APNS},
+				), nil
+			},
+		}
+		var sent []devicepresence.Device_Type
+		tm := TransportMock{
+			OnSend: func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+				sent = append(sent, device.Type)
+				return nil
+			},
+		}
+		s := &SchedulerMock{closed: test.closed}
+		a := &AuditMock{}
+		h := &queue.Handler{
+			Presence: pmm,
+			Transports: transport.Registry{
+				devicepresence.Device_WS:   tm,
+				devicepresence.Device_APNS: tm,
+			},
+			Audit:       a,
+			Preferences: prefs,
+			Scheduler:   s,
+			Now: func() time.Time {
+				return time.Date(2016, 3, 1, 3, 0, 0, 0, time.UTC)
+			},
+		}
+		h.Handle(queue.QueuedMessage{Id: "msg1", UserId: "user1", Data: []byte("data"), Urgent: test.urgent})
+
+		if deferred := len(s.scheduled) == 1; deferred != test.deferred {
+			t.Fatalf("Urgent %t, closed %t: expecting deferred %t but got %t", test.urgent, test.closed, test.deferred, deferred)
+		}
+		if !reflect.DeepEqual(sent, test.sent) {
+			t.Errorf("Urgent %t, closed %t: expecting %v to be sent but got %v", test.urgent, test.closed, test.sent, sent)
+		}
+		if test.deferred {
+			if !s.at[0].Equal(time.Date(2016, 3, 1, 7, 0, 0, 0, time.UTC)) {
+				t.Errorf("Message deferred until %s", s.at[0])
+			}
+			if !s.scheduled[0].Deferred {
+				t.Error("Deferred message must be marked as deferred")
+			}
+
+			sent = nil
+			h.Now = func() time.Time { return time.Date(2016, 3, 1, 7, 0, 0, 0, time.UTC) }
+			h.Handle(s.scheduled[0])
+			if len(sent) != 1 || sent[0] != devicepresence.Device_APNS {
+				t.Errorf("Deferred message must only go to the held back devices, sent to %v", sent)
+			}
+		}
+	}
+}
+
+func TestWorkerHandlerDefersWithoutOnlineDevices(t *testing.T) {
+	prefs := preferences.NewMemoryStore(nil)
+	prefs.SetQuietHours("user1", &preferences.QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour, Location: time.UTC})
+	pmm := PresenceManagerMock{
+		OnGetDevices: func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+			return MockDeviceStream(&devicepresence.Device{Id: "apns", Type: devicepresence.Device_APNS}), nil
+		},
+	}
+	inbox := &InboxMock{}
+	a := &AuditMock{}
+	h := &queue.Handler{
+		Presence:    pmm,
+		Inbox:       inbox,
+		Audit:       a,
+		Preferences: prefs,
+		Scheduler:   &SchedulerMock{},
+		Now: func() time.Time {
+			return time.Date(2016, 3, 1, 3, 0, 0, 0, time.UTC)
+		},
+	}
+	h.Handle(queue.QueuedMessage{Id: "msg1", UserId: "user1", Data: []byte("data")})
+	if a.records[0].Result != audit.ResultDeferred {
+		t.Errorf("Wrong audit result: %s", a.records[0].Result)
+	}
+	if len(inbox.stored) != 0 {
+		t.Error("Deferred message must not be stored")
+	}
+}
+
+type CachedPresenceMock struct {
+	PresenceManagerMock
+	invalidated []string
+}
+
+func (m *CachedPresenceMock) Invalidate(userID string) {
+	m.invalidated = append(m.invalidated, userID)
+}
+
+func TestWorkerHandlerInvalidatesCachedDevicesOnNotFound(t *testing.T) {
+	pmm := &CachedPresenceMock{
+		PresenceManagerMock: PresenceManagerMock{
+			OnGetDevices: func(ctx context.Context, in *devicepresence.DevicesRequest, opts ...grpc.CallOption) (devicepresence.PresenceManager_GetDevicesClient, error) {
+				return MockDeviceStream(&devicepresence.Device{Id: "1", Type: devicepresence.Device_WS}), nil
+			},
+		},
+	}
+	sm := SenderMock{
+		OnSendMessage: func(ctx context.Context, in *socket.SendRequest, opts ...grpc.CallOption) (*socket.SendReply, error) {
+			return nil, grpc.Errorf(codes.NotFound, "socket closed")
+		},
+	}
+	h := &queue.Handler{
+		Presence: pmm,
+		Transports: transport.Registry{
+			devicepresence.Device_WS: &transport.Socket{Client: sm},
+		},
+	}
+	h.Handle(queue.QueuedMessage{UserId: "user1", Data: []byte("data")})
+
+	if len(pmm.invalidated) != 1 || pmm.invalidated[0] != "user1" {
+		t.Errorf("Expecting the devices of user1 to be invalidated: %v", pmm.invalidated)
+	}
+}
@@ -11,6 +11,9 @@ It is generated from these files:
 It has these top-level messages:
 	SendRequest
 	SendReply
+	SendBatchRequest
+	SendResult
+	SendBatchReply
 */
 package socket
 
@@ -31,6 +34,11 @@ var _ = proto.Marshal
 type SendRequest struct {
 	SocketId int64  `protobuf:"varint,1,opt,name=socket_id" json:"socket_id,omitempty"`
 	Data     []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	// ContentEncoding names the compression of the data, e.g. "gzip". The
+	// data is uncompressed if empty.
+	ContentEncoding string `protobuf:"bytes,3,opt,name=content_encoding" json:"content_encoding,omitempty"`
+	// KeyId names the device key the data is encrypted with, if encrypted.
+	KeyId string `protobuf:"bytes,4,opt,name=key_id" json:"key_id,omitempty"`
 }
 
 func (m *SendRequest) Reset()         { *m = SendRequest{} }
@@ -44,6 +52,48 @@ func (m *SendReply) Reset()         { *m = SendReply{} }
 func (m *SendReply) String() string { return proto.CompactTextString(m) }
 func (*SendReply) ProtoMessage()    {}
 
+type SendBatchRequest struct {
+	Messages []*SendRequest `protobuf:"bytes,1,rep,name=messages" json:"messages,omitempty"`
+}
+
+func (m *SendBatchRequest) Reset()         { *m = SendBatchRequest{} }
+func (m *SendBatchRequest) String() string { return proto.CompactTextString(m) }
+func (*SendBatchRequest) ProtoMessage()    {}
+
+func (m *SendBatchRequest) GetMessages() []*SendRequest {
+	if m != nil {
+		return m.Messages
+	}
+	return nil
+}
+
+// SendResult is the outcome of sending a single message of a batch.
+type SendResult struct {
+	SocketId int64 `protobuf:"varint,1,opt,name=socket_id" json:"socket_id,omitempty"`
+	// Code is the gRPC status code of the send, zero if it succeeded.
+	Code  uint32 `protobuf:"varint,2,opt,name=code" json:"code,omitempty"`
+	Error string `protobuf:"bytes,3,opt,name=error" json:"error,omitempty"`
+}
+
+func (m *SendResult) Reset()         { *m = SendResult{} }
+func (m *SendResult) String() string { return proto.CompactTextString(m) }
+func (*SendResult) ProtoMessage()    {}
+
+type SendBatchReply struct {
+	Results []*SendResult `protobuf:"bytes,1,rep,name=results" json:"results,omitempty"`
+}
+
+func (m *SendBatchReply) Reset()         { *m = SendBatchReply{} }
+func (m *SendBatchReply) String() string { return proto.CompactTextString(m) }
+func (*SendBatchReply) ProtoMessage()    {}
+
+func (m *SendBatchReply) GetResults() []*SendResult {
+	if m != nil {
+		return m.Results
+	}
+	return nil
+}
+
 func init() {
 }
 
@@ -51,6 +101,9 @@ func init() {
 
 type SenderClient interface {
 	SendMessage(ctx context.Context, in *SendRequest, opts ...grpc.CallOption) (*SendReply, error)
+	// SendMessages sends several messages at once. The reply holds a result
+	// for each message in the order of the request.
+	SendMessages(ctx context.Context, in *SendBatchRequest, opts ...grpc.CallOption) (*SendBatchReply, error)
 }
 
 type senderClient struct {
@@ -70,10 +123,22 @@ func (c *senderClient) SendMessage(ctx context.Context, in *SendRequest, opts ..
 	return out, nil
 }
 
+func (c *senderClient) SendMessages(ctx context.Context, in *SendBatchRequest, opts ...grpc.CallOption) (*SendBatchReply, error) {
+	out := new(SendBatchReply)
+	err := grpc.Invoke(ctx, "/socket.Sender/SendMessages", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for Sender service
 
 type SenderServer interface {
 	SendMessage(context.Context, *SendRequest) (*SendReply, error)
+	// SendMessages sends several messages at once. The reply holds a result
+	// for each message in the order of the request.
+	SendMessages(context.Context, *SendBatchRequest) (*SendBatchReply, error)
 }
 
 func RegisterSenderServer(s *grpc.Server, srv SenderServer) {
@@ -92,6 +157,18 @@ func _Sender_SendMessage_Handler(srv interface{}, ctx context.Context, buf []byt
 	return out, nil
 }
 
+func _Sender_SendMessages_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(SendBatchRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(SenderServer).SendMessages(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 var _Sender_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "socket.Sender",
 	HandlerType: (*SenderServer)(nil),
@@ -100,6 +177,10 @@ var _Sender_serviceDesc = grpc.ServiceDesc{
 			MethodName: "SendMessage",
 			Handler:    _Sender_SendMessage_Handler,
 		},
+		{
+			MethodName: "SendMessages",
+			Handler:    _Sender_SendMessages_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{},
 }
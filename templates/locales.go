@@ -0,0 +1,48 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package templates
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Locales resolves the preferred locale of a user.
+type Locales interface {
+	// Locale returns the locale of the user or an empty string if unknown.
+	Locale(userID string) string
+}
+
+// UserLocales maps user ids to locales.
+type UserLocales map[string]string
+
+func (l UserLocales) Locale(userID string) string {
+	return l[userID]
+}
+
+// LoadUserLocales reads a JSON object mapping user ids to locales.
+func LoadUserLocales(name string) (UserLocales, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var l UserLocales
+	if err := json.NewDecoder(f).Decode(&l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,205 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package templates renders notification payloads from versioned, localized
+// text templates.
+package templates
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// DefaultLocale is used when a template has no version for the requested
+// locale or its language.
+const DefaultLocale = "en"
+
+var (
+	ErrNotFound        = errors.New("template not found")
+	ErrVersionNotFound = errors.New("template version not found")
+	ErrInvalidVersion  = errors.New("invalid template version")
+	ErrMissingId       = errors.New("missing template id")
+	ErrMissingLocale   = errors.New("missing locale")
+)
+
+// Template is a single version of a template for a locale.
+type Template struct {
+	Id      string
+	Locale  string
+	Version int
+	Source  string
+	parsed  *template.Template
+}
+
+// Registry keeps all versions of the templates keyed by template id and
+// locale.
+type Registry struct {
+	mu        sync.RWMutex
+	templates map[key][]*Template
+}
+
+type key struct {
+	id     string
+	locale string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		templates: make(map[key][]*Template),
+	}
+}
+
+// Parse validates the template source.
+func Parse(id, source string) (*template.Template, error) {
+	return template.New(id).Option("missingkey=error").Parse(source)
+}
+
+// Put stores the source as the next version of the template for the locale
+// and returns the version.
+func (r *Registry) Put(id, locale, source string) (int, error) {
+	if id == "" {
+		return 0, ErrMissingId
+	}
+	if locale == "" {
+		return 0, ErrMissingLocale
+	}
+	parsed, err := Parse(id, source)
+	if err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := key{id, normalize(locale)}
+	t := &Template{
+		Id:      id,
+		Locale:  k.locale,
+		Version: len(r.templates[k]) + 1,
+		Source:  source,
+		parsed:  parsed,
+	}
+	r.templates[k] = append(r.templates[k], t)
+	return t.Version, nil
+}
+
+// Get returns the version of the template for the locale, the latest if
+// version is zero. Locales fall back to their language and then to
+// DefaultLocale, e.g. "pt-BR" to "pt" and "en".
+func (r *Registry) Get(id, locale string, version int) (*Template, error) {
+	if version < 0 {
+		return nil, ErrInvalidVersion
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, l := range candidates(locale) {
+		versions := r.templates[key{id, l}]
+		if len(versions) == 0 {
+			continue
+		}
+		if version == 0 {
+			return versions[len(versions)-1], nil
+		}
+		if version > len(versions) {
+			return nil, ErrVersionNotFound
+		}
+		return versions[version-1], nil
+	}
+	return nil, ErrNotFound
+}
+
+// List returns the latest version of every template for every locale, or
+// of the given template only.
+func (r *Registry) List(id string) []*Template {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var list []*Template
+	for k, versions := range r.templates {
+		if id == "" || k.id == id {
+			list = append(list, versions[len(versions)-1])
+		}
+	}
+	sort.Sort(byIdAndLocale(list))
+	return list
+}
+
+// Render executes the template with the parameters. All parameters used by
+// the template must be given.
+func (r *Registry) Render(id, locale string, version int, params map[string]string) ([]byte, *Template, error) {
+	t, err := r.Get(id, locale, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	var b bytes.Buffer
+	if err := t.parsed.Execute(&b, params); err != nil {
+		return nil, nil, err
+	}
+	return b.Bytes(), t, nil
+}
+
+// LoadDir puts every file named "<template id>.<locale>.tmpl" in the
+// directory into the registry.
+func (r *Registry) LoadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		parts := strings.Split(strings.TrimSuffix(filepath.Base(f), ".tmpl"), ".")
+		if len(parts) != 2 {
+			return fmt.Errorf("%s: expecting <template id>.<locale>.tmpl", f)
+		}
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if _, err := r.Put(parts[0], parts[1], string(b)); err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+	}
+	return nil
+}
+
+func normalize(locale string) string {
+	return strings.ToLower(strings.Replace(locale, "_", "-", -1))
+}
+
+func candidates(locale string) []string {
+	locale = normalize(locale)
+	var c []string
+	if locale != "" {
+		c = append(c, locale)
+		if i := strings.Index(locale, "-"); i > 0 {
+			c = append(c, locale[:i])
+		}
+	}
+	return append(c, DefaultLocale)
+}
+
+type byIdAndLocale []*Template
+
+func (s byIdAndLocale) Len() int      { return len(s) }
+func (s byIdAndLocale) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byIdAndLocale) Less(i, j int) bool {
+	if s[i].Id != s[j].Id {
+		return s[i].Id < s[j].Id
+	}
+	return s[i].Locale < s[j].Locale
+}
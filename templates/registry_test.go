@@ -0,0 +1,118 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package templates_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/protogalaxy/service-notify/templates"
+)
+
+func TestRegistryVersions(t *testing.T) {
+	r := templates.NewRegistry()
+	for i, source := range []string{"v1 {{.name}}", "v2 {{.name}}"} {
+		v, err := r.Put("turn", "en", source)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if v != i+1 {
+			t.Errorf("Expecting version %d but got %d", i+1, v)
+		}
+	}
+	params := map[string]string{"name": "Alice"}
+	if b, _, _ := r.Render("turn", "en", 0, params); string(b) != "v2 Alice" {
+		t.Errorf("Latest version not rendered: %s", b)
+	}
+	if b, _, _ := r.Render("turn", "en", 1, params); string(b) != "v1 Alice" {
+		t.Errorf("Pinned version not rendered: %s", b)
+	}
+	if _, _, err := r.Render("turn", "en", 3, params); err != templates.ErrVersionNotFound {
+		t.Errorf("Expecting version not found but got: %v", err)
+	}
+}
+
+func TestRegistryNegativeVersion(t *testing.T) {
+	r := templates.NewRegistry()
+	r.Put("turn", "en", "v1")
+	_, _, err := r.Render("turn", "en", -1, nil)
+	if err != templates.ErrInvalidVersion {
+		t.Errorf("Expecting invalid version but got: %v", err)
+	}
+}
+
+func TestRegistryLocaleFallback(t *testing.T) {
+	r := templates.NewRegistry()
+	r.Put("turn", "en", "Your turn")
+	r.Put("turn", "pt", "Sua vez")
+	r.Put("turn", "pt_BR", "Sua vez!")
+
+	tests := []struct {
+		locale   string
+		expected string
+	}{
+		{"pt-BR", "Sua vez!"},
+		{"pt-PT", "Sua vez"},
+		{"de", "Your turn"},
+		{"", "Your turn"},
+	}
+	for _, test := range tests {
+		b, _, err := r.Render("turn", test.locale, 0, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if string(b) != test.expected {
+			t.Errorf("Locale %s: expecting %q but got %q", test.locale, test.expected, b)
+		}
+	}
+	if _, _, err := r.Render("unknown", "en", 0, nil); err != templates.ErrNotFound {
+		t.Errorf("Expecting not found but got: %v", err)
+	}
+}
+
+func TestRegistryValidation(t *testing.T) {
+	r := templates.NewRegistry()
+	if _, err := r.Put("turn", "en", "{{.name"); err == nil {
+		t.Error("Expecting a parse error")
+	}
+	if _, err := r.Put("", "en", "text"); err == nil {
+		t.Error("Expecting an error for a missing id")
+	}
+	r.Put("turn", "en", "{{.name}}")
+	if _, _, err := r.Render("turn", "en", 0, map[string]string{}); err == nil {
+		t.Error("Expecting an error for a missing parameter")
+	}
+}
+
+func TestRegistryLoadDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "turn.en.tmpl"), []byte("Your turn"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "turn.de.tmpl"), []byte("Du bist dran"), 0644)
+
+	r := templates.NewRegistry()
+	if err := r.LoadDir(dir); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if list := r.List(""); len(list) != 2 || list[0].Locale != "de" || list[1].Locale != "en" {
+		t.Errorf("Unexpected templates: %+v", list)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package templates
+
+import (
+	"github.com/golang/glog"
+	"github.com/protogalaxy/service-notify/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Service lets the content team manage and preview templates.
+type Service struct {
+	Registry *Registry
+	// Authenticator identifies the operator. All calls are accepted
+	// anonymously if it is not set.
+	Authenticator auth.Authenticator
+}
+
+func (s *Service) authenticate(ctx context.Context) (string, error) {
+	if s.Authenticator == nil {
+		return "", nil
+	}
+	operator, err := s.Authenticator.Authenticate(ctx)
+	if err != nil {
+		return "", grpc.Errorf(codes.Unauthenticated, "%s", err)
+	}
+	return operator, nil
+}
+
+func (s *Service) PutTemplate(ctx context.Context, req *PutTemplateRequest) (*PutTemplateReply, error) {
+	operator, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	version, err := s.Registry.Put(req.TemplateId, req.Locale, req.Source)
+	if err != nil {
+		return nil, grpc.Errorf(Code(err), "%s", err)
+	}
+	glog.Infof("Stored version %d of template %s for locale %s by '%s'", version, req.TemplateId, req.Locale, operator)
+	return &PutTemplateReply{Version: int32(version)}, nil
+}
+
+func (s *Service) ListTemplates(ctx context.Context, req *ListTemplatesRequest) (*ListTemplatesReply, error) {
+	if _, err := s.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	var res ListTemplatesReply
+	for _, t := range s.Registry.List(req.TemplateId) {
+		res.Templates = append(res.Templates, &TemplateVersion{
+			TemplateId: t.Id,
+			Locale:     t.Locale,
+			Version:    int32(t.Version),
+		})
+	}
+	return &res, nil
+}
+
+func (s *Service) PreviewTemplate(ctx context.Context, req *PreviewTemplateRequest) (*PreviewTemplateReply, error) {
+	if _, err := s.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	if req.TemplateId == "" {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", ErrMissingId)
+	}
+	data, t, err := s.Registry.Render(req.TemplateId, req.Locale, int(req.Version), req.Params)
+	if err != nil {
+		return nil, grpc.Errorf(Code(err), "%s", err)
+	}
+	return &PreviewTemplateReply{
+		Data:    data,
+		Locale:  t.Locale,
+		Version: int32(t.Version),
+	}, nil
+}
+
+// Code returns the gRPC status code for an error of the registry. Unknown
+// templates and versions are not found, all other errors are caused by the
+// template source or the parameters.
+func Code(err error) codes.Code {
+	switch err {
+	case ErrNotFound, ErrVersionNotFound:
+		return codes.NotFound
+	}
+	return codes.InvalidArgument
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package templates_test
+
+import (
+	"testing"
+
+	"github.com/protogalaxy/service-notify/templates"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestServicePutAndPreview(t *testing.T) {
+	s := &templates.Service{Registry: templates.NewRegistry()}
+	res, err := s.PutTemplate(context.Background(), &templates.PutTemplateRequest{
+		TemplateId: "turn",
+		Locale:     "de",
+		Source:     "{{.player}} ist dran",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if res.Version != 1 {
+		t.Errorf("Expecting version 1 but got %d", res.Version)
+	}
+
+	preview, err := s.PreviewTemplate(context.Background(), &templates.PreviewTemplateRequest{
+		TemplateId: "turn",
+		Locale:     "de-AT",
+		Params:     map[string]string{"player": "Bob"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(preview.Data) != "Bob ist dran" || preview.Locale != "de" || preview.Version != 1 {
+		t.Errorf("Unexpected preview: %+v", preview)
+	}
+
+	list, _ := s.ListTemplates(context.Background(), &templates.ListTemplatesRequest{})
+	if len(list.Templates) != 1 || list.Templates[0].TemplateId != "turn" {
+		t.Errorf("Unexpected templates: %+v", list.Templates)
+	}
+}
+
+func TestServicePutInvalidTemplate(t *testing.T) {
+	s := &templates.Service{Registry: templates.NewRegistry()}
+	_, err := s.PutTemplate(context.Background(), &templates.PutTemplateRequest{
+		TemplateId: "turn",
+		Locale:     "en",
+		Source:     "{{if}}",
+	})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expecting invalid argument error but got: %v", err)
+	}
+}
+
+func TestServicePreviewUnknownTemplate(t *testing.T) {
+	s := &templates.Service{Registry: templates.NewRegistry()}
+	_, err := s.PreviewTemplate(context.Background(), &templates.PreviewTemplateRequest{TemplateId: "turn"})
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expecting not found error but got: %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+// Code generated by protoc-gen-go.
+// source: templates.proto
+// DO NOT EDIT!
+
+/*
+Package templates is a generated protocol buffer package.
+
+It is generated from these files:
+	templates.proto
+
+It has these top-level messages:
+	PutTemplateRequest
+	PutTemplateReply
+	ListTemplatesRequest
+	TemplateVersion
+	ListTemplatesReply
+	PreviewTemplateRequest
+	PreviewTemplateReply
+*/
+package templates
+
+import proto "github.com/golang/protobuf/proto"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+
+type PutTemplateRequest struct {
+	TemplateId string `protobuf:"bytes,1,opt,name=template_id" json:"template_id,omitempty"`
+	Locale     string `protobuf:"bytes,2,opt,name=locale" json:"locale,omitempty"`
+	Source     string `protobuf:"bytes,3,opt,name=source" json:"source,omitempty"`
+}
+
+func (m *PutTemplateRequest) Reset()         { *m = PutTemplateRequest{} }
+func (m *PutTemplateRequest) String() string { return proto.CompactTextString(m) }
+func (*PutTemplateRequest) ProtoMessage()    {}
+
+type PutTemplateReply struct {
+	Version int32 `protobuf:"varint,1,opt,name=version" json:"version,omitempty"`
+}
+
+func (m *PutTemplateReply) Reset()         { *m = PutTemplateReply{} }
+func (m *PutTemplateReply) String() string { return proto.CompactTextString(m) }
+func (*PutTemplateReply) ProtoMessage()    {}
+
+type ListTemplatesRequest struct {
+	TemplateId string `protobuf:"bytes,1,opt,name=template_id" json:"template_id,omitempty"`
+}
+
+func (m *ListTemplatesRequest) Reset()         { *m = ListTemplatesRequest{} }
+func (m *ListTemplatesRequest) String() string { return proto.CompactTextString(m) }
+func (*ListTemplatesRequest) ProtoMessage()    {}
+
+type TemplateVersion struct {
+	TemplateId string `protobuf:"bytes,1,opt,name=template_id" json:"template_id,omitempty"`
+	Locale     string `protobuf:"bytes,2,opt,name=locale" json:"locale,omitempty"`
+	Version    int32  `protobuf:"varint,3,opt,name=version" json:"version,omitempty"`
+}
+
+func (m *TemplateVersion) Reset()         { *m = TemplateVersion{} }
+func (m *TemplateVersion) String() string { return proto.CompactTextString(m) }
+func (*TemplateVersion) ProtoMessage()    {}
+
+type ListTemplatesReply struct {
+	Templates []*TemplateVersion `protobuf:"bytes,1,rep,name=templates" json:"templates,omitempty"`
+}
+
+func (m *ListTemplatesReply) Reset()         { *m = ListTemplatesReply{} }
+func (m *ListTemplatesReply) String() string { return proto.CompactTextString(m) }
+func (*ListTemplatesReply) ProtoMessage()    {}
+
+func (m *ListTemplatesReply) GetTemplates() []*TemplateVersion {
+	if m != nil {
+		return m.Templates
+	}
+	return nil
+}
+
+type PreviewTemplateRequest struct {
+	TemplateId string `protobuf:"bytes,1,opt,name=template_id" json:"template_id,omitempty"`
+	Locale     string `protobuf:"bytes,2,opt,name=locale" json:"locale,omitempty"`
+	// Version selects the version to render, the latest if zero.
+	Version int32             `protobuf:"varint,3,opt,name=version" json:"version,omitempty"`
+	Params  map[string]string `protobuf:"bytes,4,rep,name=params" json:"params,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *PreviewTemplateRequest) Reset()         { *m = PreviewTemplateRequest{} }
+func (m *PreviewTemplateRequest) String() string { return proto.CompactTextString(m) }
+func (*PreviewTemplateRequest) ProtoMessage()    {}
+
+type PreviewTemplateReply struct {
+	Data []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	// Locale and version of the rendered template.
+	Locale  string `protobuf:"bytes,2,opt,name=locale" json:"locale,omitempty"`
+	Version int32  `protobuf:"varint,3,opt,name=version" json:"version,omitempty"`
+}
+
+func (m *PreviewTemplateReply) Reset()         { *m = PreviewTemplateReply{} }
+func (m *PreviewTemplateReply) String() string { return proto.CompactTextString(m) }
+func (*PreviewTemplateReply) ProtoMessage()    {}
+
+func init() {
+}
+
+// Client API for Templates service
+
+type TemplatesClient interface {
+	// PutTemplate validates the source and stores it as a new version of the
+	// template for the locale.
+	PutTemplate(ctx context.Context, in *PutTemplateRequest, opts ...grpc.CallOption) (*PutTemplateReply, error)
+	ListTemplates(ctx context.Context, in *ListTemplatesRequest, opts ...grpc.CallOption) (*ListTemplatesReply, error)
+	// PreviewTemplate renders a template without sending it.
+	PreviewTemplate(ctx context.Context, in *PreviewTemplateRequest, opts ...grpc.CallOption) (*PreviewTemplateReply, error)
+}
+
+type templatesClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewTemplatesClient(cc *grpc.ClientConn) TemplatesClient {
+	return &templatesClient{cc}
+}
+
+func (c *templatesClient) PutTemplate(ctx context.Context, in *PutTemplateRequest, opts ...grpc.CallOption) (*PutTemplateReply, error) {
+	out := new(PutTemplateReply)
+	err := grpc.Invoke(ctx, "/templates.Templates/PutTemplate", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *templatesClient) ListTemplates(ctx context.Context, in *ListTemplatesRequest, opts ...grpc.CallOption) (*ListTemplatesReply, error) {
+	out := new(ListTemplatesReply)
+	err := grpc.Invoke(ctx, "/templates.Templates/ListTemplates", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *templatesClient) PreviewTemplate(ctx context.Context, in *PreviewTemplateRequest, opts ...grpc.CallOption) (*PreviewTemplateReply, error) {
+	out := new(PreviewTemplateReply)
+	err := grpc.Invoke(ctx, "/templates.Templates/PreviewTemplate", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Templates service
+
+type TemplatesServer interface {
+	// PutTemplate validates the source and stores it as a new version of the
+	// template for the locale.
+	PutTemplate(context.Context, *PutTemplateRequest) (*PutTemplateReply, error)
+	ListTemplates(context.Context, *ListTemplatesRequest) (*ListTemplatesReply, error)
+	// PreviewTemplate renders a template without sending it.
+	PreviewTemplate(context.Context, *PreviewTemplateRequest) (*PreviewTemplateReply, error)
+}
+
+func RegisterTemplatesServer(s *grpc.Server, srv TemplatesServer) {
+	s.RegisterService(&_Templates_serviceDesc, srv)
+}
+
+func _Templates_PutTemplate_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(PutTemplateRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(TemplatesServer).PutTemplate(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Templates_ListTemplates_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(ListTemplatesRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(TemplatesServer).ListTemplates(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Templates_PreviewTemplate_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(PreviewTemplateRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(TemplatesServer).PreviewTemplate(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+var _Templates_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "templates.Templates",
+	HandlerType: (*TemplatesServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PutTemplate",
+			Handler:    _Templates_PutTemplate_Handler,
+		},
+		{
+			MethodName: "ListTemplates",
+			Handler:    _Templates_ListTemplates_Handler,
+		},
+		{
+			MethodName: "PreviewTemplate",
+			Handler:    _Templates_PreviewTemplate_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tlsutil
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+)
+
+// alpnProtoStr are the HTTP/2 protocol ids negotiated by gRPC.
+var alpnProtoStr = []string{"h2-14", "h2-15", "h2-16"}
+
+// dialTimeout limits establishing a connection including the TLS handshake
+// so an unresponsive server does not stall the reconnect loop.
+const dialTimeout = 20 * time.Second
+
+// NewServerCredentials returns transport credentials for a server listener
+// that always use the latest certificates of the reloader. If verifyClients
+// is set clients must present a certificate signed by the reloader's CA.
+func NewServerCredentials(r *Reloader, verifyClients bool) credentials.TransportAuthenticator {
+	return &reloadingCreds{
+		reloader:      r,
+		verifyClients: verifyClients,
+	}
+}
+
+// NewClientCredentials returns transport credentials for dialing a server
+// with the latest certificates of the reloader. The client certificate is
+// only presented if the reloader has one. If serverName is empty the host of
+// the dialed address is verified.
+func NewClientCredentials(r *Reloader, serverName string) credentials.TransportAuthenticator {
+	return &reloadingCreds{
+		reloader:   r,
+		serverName: serverName,
+	}
+}
+
+type reloadingCreds struct {
+	reloader      *Reloader
+	serverName    string
+	verifyClients bool
+}
+
+// GetRequestMetadata returns nil, nil since TLS credentials do not have
+// metadata.
+func (c *reloadingCreds) GetRequestMetadata(ctx context.Context) (map[string]string, error) {
+	return nil, nil
+}
+
+func (c *reloadingCreds) Dial(addr string) (net.Conn, error) {
+	name := c.serverName
+	if name == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("tlsutil: failed to parse server address %v", err)
+		}
+		name = host
+	}
+	config := &tls.Config{
+		RootCAs:    c.reloader.CertPool(),
+		NextProtos: alpnProtoStr,
+		ServerName: name,
+	}
+	if cert := c.reloader.Certificate(); cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", addr, config)
+}
+
+func (c *reloadingCreds) NewListener(lis net.Listener) net.Listener {
+	return tls.NewListener(lis, &tls.Config{
+		NextProtos: alpnProtoStr,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.serverConfig(), nil
+		},
+	})
+}
+
+func (c *reloadingCreds) serverConfig() *tls.Config {
+	config := &tls.Config{
+		NextProtos: alpnProtoStr,
+	}
+	if cert := c.reloader.Certificate(); cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	if c.verifyClients {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = c.reloader.CertPool()
+	}
+	return config
+}
@@ -0,0 +1,146 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tlsutil_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/protogalaxy/service-notify/tlsutil"
+)
+
+// serve accepts a single connection and echoes a byte back to the client.
+func serve(t *testing.T, r *tlsutil.Reloader, verifyClients bool) (string, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis = tlsutil.NewServerCredentials(r, verifyClients).NewListener(lis)
+	go func() {
+		c, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.CopyN(c, c, 1)
+	}()
+	return lis.Addr().String(), func() { lis.Close() }
+}
+
+func roundTrip(r *tlsutil.Reloader, addr string) error {
+	c, err := tlsutil.NewClientCredentials(r, "").Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte{1}); err != nil {
+		return err
+	}
+	_, err = c.Read(make([]byte, 1))
+	return err
+}
+
+func TestCredentialsTLS(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newCertAuthority(t)
+	certFile, keyFile := ca.issue(t, dir, "server")
+
+	server, err := tlsutil.NewReloader(tlsutil.Files{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := tlsutil.NewReloader(tlsutil.Files{CAFile: ca.write(t, dir)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, stop := serve(t, server, false)
+	defer stop()
+
+	if err := roundTrip(client, addr); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestCredentialsMutualTLS(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newCertAuthority(t)
+	caFile := ca.write(t, dir)
+	serverCert, serverKey := ca.issue(t, dir, "server")
+	clientCert, clientKey := ca.issue(t, dir, "client")
+
+	server, err := tlsutil.NewReloader(tlsutil.Files{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := tlsutil.NewReloader(tlsutil.Files{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, stop := serve(t, server, true)
+	defer stop()
+
+	if err := roundTrip(client, addr); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestCredentialsMutualTLSRejectsAnonymousClient(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newCertAuthority(t)
+	caFile := ca.write(t, dir)
+	serverCert, serverKey := ca.issue(t, dir, "server")
+
+	server, err := tlsutil.NewReloader(tlsutil.Files{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := tlsutil.NewReloader(tlsutil.Files{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, stop := serve(t, server, true)
+	defer stop()
+
+	if err := roundTrip(client, addr); err == nil {
+		t.Error("Expecting the server to reject a client without a certificate")
+	}
+}
+
+func TestCredentialsUntrustedServer(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := newCertAuthority(t).issue(t, dir, "server")
+
+	server, err := tlsutil.NewReloader(tlsutil.Files{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := tlsutil.NewReloader(tlsutil.Files{CAFile: newCertAuthority(t).write(t, dir)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, stop := serve(t, server, false)
+	defer stop()
+
+	if err := roundTrip(client, addr); err == nil {
+		t.Error("Expecting the client to reject a server signed by another CA")
+	}
+}
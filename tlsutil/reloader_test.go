@@ -0,0 +1,194 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tlsutil_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/tlsutil"
+)
+
+// certAuthority issues self-signed certificates for the tests.
+type certAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+var serial int64
+
+func newCertAuthority(t *testing.T) *certAuthority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := template("test ca")
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &certAuthority{cert: cert, key: key, der: der}
+}
+
+func template(name string) *x509.Certificate {
+	serial++
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+}
+
+// issue writes a certificate and key signed by the CA to dir and returns the
+// file names.
+func (ca *certAuthority) issue(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template(name), ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func (ca *certAuthority) write(t *testing.T, dir string) string {
+	name := filepath.Join(dir, "ca.crt")
+	writePEM(t, name, "CERTIFICATE", ca.der)
+	return name
+}
+
+func writePEM(t *testing.T, name, typ string, der []byte) {
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(name, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestReloaderRequiresCertAndKey(t *testing.T) {
+	_, err := tlsutil.NewReloader(tlsutil.Files{CertFile: "server.crt"})
+	if err == nil {
+		t.Error("Expecting an error when the key file is missing")
+	}
+}
+
+func TestReloaderLoadsFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newCertAuthority(t)
+	certFile, keyFile := ca.issue(t, dir, "server")
+
+	r, err := tlsutil.NewReloader(tlsutil.Files{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   ca.write(t, dir),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if r.Certificate() == nil {
+		t.Error("Certificate was not loaded")
+	}
+	if r.CertPool() == nil {
+		t.Error("CA certificates were not loaded")
+	}
+}
+
+func TestReloaderReloadsChangedFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newCertAuthority(t)
+	certFile, keyFile := ca.issue(t, dir, "server")
+
+	r, err := tlsutil.NewReloader(tlsutil.Files{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	before := r.Certificate()
+
+	ca.issue(t, dir, "server")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if r.Certificate() == before {
+		t.Error("Certificate was not reloaded")
+	}
+}
+
+func TestReloaderKeepsCertificateOnError(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newCertAuthority(t)
+	certFile, keyFile := ca.issue(t, dir, "server")
+
+	r, err := tlsutil.NewReloader(tlsutil.Files{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	before := r.Certificate()
+
+	ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if err := r.Reload(); err == nil {
+		t.Error("Expecting an error for an invalid certificate")
+	}
+	if r.Certificate() != before {
+		t.Error("Certificate should not be replaced by an invalid one")
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"golang.org/x/net/context"
+)
+
+// APNSEndpoint is the production APNs endpoint.
+const APNSEndpoint = "https://api.push.apple.com"
+
+// apnsTokenLifetime is how long a provider token is reused. APNs rejects
+// tokens older than an hour.
+const apnsTokenLifetime = 50 * time.Minute
+
+// APNSProperties configure an APNS transport.
+type APNSProperties struct {
+	// Endpoint is the base URL of the APNs service.
+	Endpoint string
+	// Topic is the bundle id of the app.
+	Topic string
+	// Title is shown above the notification body.
+	Title string
+	// Timeout limits a single request.
+	Timeout time.Duration
+	// Client sends the requests. It must support HTTP/2.
+	Client *http.Client
+	// Now returns the current time used for issuing provider tokens.
+	Now func() time.Time
+}
+
+// APNS delivers messages to APNS devices, using the device id as the device
+// token, through the APNs HTTP/2 API authenticated with provider tokens.
+type APNS struct {
+	keyID      string
+	teamID     string
+	key        *ecdsa.PrivateKey
+	properties *APNSProperties
+
+	mu     sync.Mutex
+	token  string
+	issued time.Time
+}
+
+func NewAPNS(keyID, teamID string, key *ecdsa.PrivateKey, conf ...func(*APNSProperties)) *APNS {
+	p := &APNSProperties{
+		Endpoint: APNSEndpoint,
+		Timeout:  10 * time.Second,
+		Client:   &http.Client{},
+		Now:      time.Now,
+	}
+	for _, f := range conf {
+		f(p)
+	}
+	return &APNS{
+		keyID:      keyID,
+		teamID:     teamID,
+		key:        key,
+		properties: p,
+	}
+}
+
+// LoadAPNSKey reads the PEM encoded PKCS #8 signing key downloaded from the
+// Apple developer account.
+func LoadAPNSKey(path string) (*ecdsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an ECDSA key")
+	}
+	return key, nil
+}
+
+type aps struct {
+	Alert    alert  `json:"alert"`
+	Badge    int    `json:"badge,omitempty"`
+	Category string `json:"category,omitempty"`
+}
+
+// apnsPayload maps the message to the aps dictionary. Custom data of the
+// notification is added as top level keys.
+func (a *APNS) apnsPayload(msg Message) map[string]interface{} {
+	n := msg.notification()
+	payload := make(map[string]interface{}, len(n.Data)+2)
+	for k, v := range n.Data {
+		payload[k] = v
+	}
+	payload["aps"] = aps{
+		Alert:    newAlert(a.properties.Title, msg),
+		Badge:    n.Badge,
+		Category: n.Category,
+	}
+	if msg.Id != "" {
+		payload["message_id"] = msg.Id
+	}
+	return payload
+}
+
+func (a *APNS) Send(ctx context.Context, device *devicepresence.Device, msg Message) error {
+	// The token becomes part of the request path, so anything but the hex
+	// encoded token APNs issues is rejected.
+	if _, err := hex.DecodeString(device.Id); err != nil || device.Id == "" {
+		return InvalidDeviceError{"device token is not hex encoded"}
+	}
+	body, err := json.Marshal(a.apnsPayload(msg))
+	if err != nil {
+		return err
+	}
+	token, err := a.providerToken()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.properties.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", a.properties.Endpoint+"/3/device/"+device.Id, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("Apns-Push-Type", "alert")
+	if a.properties.Topic != "" {
+		req.Header.Set("Apns-Topic", a.properties.Topic)
+	}
+	if k := msg.notification().CollapseKey; k != "" {
+		req.Header.Set("Apns-Collapse-Id", k)
+	}
+	res, err := a.properties.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil
+	}
+
+	var e struct {
+		Reason string `json:"reason"`
+	}
+	readError(res, &e)
+	switch {
+	case res.StatusCode == http.StatusGone,
+		e.Reason == "BadDeviceToken",
+		e.Reason == "DeviceTokenNotForTopic":
+		return InvalidDeviceError{e.Reason}
+	case e.Reason == "ExpiredProviderToken":
+		a.mu.Lock()
+		a.token = ""
+		a.mu.Unlock()
+	}
+	return PushError{res.StatusCode, e.Reason}
+}
+
+// providerToken returns the ES256 signed JWT identifying the team, issuing a
+// new one when the current one is about to expire.
+func (a *APNS) providerToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.properties.Now()
+	if a.token != "" && now.Sub(a.issued) < apnsTokenLifetime {
+		return a.token, nil
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": a.keyID})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": a.teamID, "iat": now.Unix()})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("unable to sign provider token: %s", err)
+	}
+	// JWS uses the fixed size concatenation of r and s.
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	a.token = unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+	a.issued = now
+	return a.token, nil
+}
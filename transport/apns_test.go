@@ -0,0 +1,219 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+)
+
+// fakeAPNS starts an HTTP/2 server answering like APNs. Tokens listed in
+// dead are reported as unregistered.
+func fakeAPNS(t *testing.T, key *ecdsa.PrivateKey, dead ...string) (*httptest.Server, chan map[string]interface{}) {
+	payloads := make(chan map[string]interface{}, 10)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("Expecting HTTP/2 but got %s", r.Proto)
+		}
+		if !verifyES256(&key.PublicKey, strings.TrimPrefix(r.Header.Get("Authorization"), "bearer ")) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"reason":"InvalidProviderToken"}`))
+			return
+		}
+		token := strings.TrimPrefix(r.URL.Path, "/3/device/")
+		for _, d := range dead {
+			if d == token {
+				w.WriteHeader(http.StatusGone)
+				w.Write([]byte(`{"reason":"Unregistered","timestamp":1445000000}`))
+				return
+			}
+		}
+		var p map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&p)
+		payloads <- p
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	return srv, payloads
+}
+
+func verifyES256(key *ecdsa.PublicKey, token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return false
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	return ecdsa.Verify(key, digest[:], r, s)
+}
+
+func newAPNS(srv *httptest.Server, key *ecdsa.PrivateKey) *transport.APNS {
+	return transport.NewAPNS("KEYID", "TEAMID", key, func(p *transport.APNSProperties) {
+		p.Endpoint = srv.URL
+		p.Topic = "com.example.game"
+		p.Title = "Protogalaxy"
+		p.Client = srv.Client()
+	})
+}
+
+func TestAPNSSendsAlert(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	srv, payloads := fakeAPNS(t, key)
+	defer srv.Close()
+
+	a := newAPNS(srv, key)
+	device := &devicepresence.Device{Id: "0a1b2c3d", Type: devicepresence.Device_APNS}
+	if err := a.Send(context.Background(), device, transport.Message{Id: "msg1", Data: []byte("Your turn")}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	p := <-payloads
+	alert := p["aps"].(map[string]interface{})["alert"].(map[string]interface{})
+	if alert["title"] != "Protogalaxy" || alert["body"] != "Your turn" {
+		t.Errorf("Unexpected alert: %v", alert)
+	}
+	if p["message_id"] != "msg1" {
+		t.Errorf("Unexpected message id: %v", p["message_id"])
+	}
+}
+
+func TestAPNSUnregisteredToken(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	srv, _ := fakeAPNS(t, key, "dead")
+	defer srv.Close()
+
+	a := newAPNS(srv, key)
+	err := a.Send(context.Background(), &devicepresence.Device{Id: "dead"}, transport.Message{})
+	if e, ok := err.(transport.InvalidDeviceError); !ok || e.Reason != "Unregistered" {
+		t.Errorf("Expecting invalid device error but got: %v", err)
+	}
+}
+
+func TestAPNSRejectsMalformedToken(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	srv, payloads := fakeAPNS(t, key)
+	defer srv.Close()
+
+	a := newAPNS(srv, key)
+	err := a.Send(context.Background(), &devicepresence.Device{Id: "../../3/device/0a1b"}, transport.Message{})
+	if _, ok := err.(transport.InvalidDeviceError); !ok {
+		t.Errorf("Expecting invalid device error but got: %v", err)
+	}
+	select {
+	case <-payloads:
+		t.Error("No request should be made for a malformed token")
+	default:
+	}
+}
+
+func TestAPNSRejectedProviderToken(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	srv, _ := fakeAPNS(t, key)
+	defer srv.Close()
+
+	a := newAPNS(srv, other)
+	err := a.Send(context.Background(), &devicepresence.Device{Id: "0a1b2c3d"}, transport.Message{})
+	if e, ok := err.(transport.PushError); !ok || e.StatusCode != http.StatusForbidden {
+		t.Errorf("Expecting push error but got: %v", err)
+	}
+}
+
+func TestLoadAPNSKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b, _ := x509.MarshalPKCS8PrivateKey(key)
+	dir, err := ioutil.TempDir("", "apns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "AuthKey.p8")
+	ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), 0600)
+
+	loaded, err := transport.LoadAPNSKey(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if loaded.D.Cmp(key.D) != 0 {
+		t.Error("Loaded key does not match")
+	}
+}
+
+func TestAPNSMapsNotification(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	headers := make(chan http.Header, 1)
+	payloads := make(chan map[string]interface{}, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&p)
+		headers <- r.Header
+		payloads <- p
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	err := newAPNS(srv, key).Send(context.Background(), &devicepresence.Device{Id: "0a1b2c3d"}, transport.Message{
+		Notification: &transport.Notification{
+			Title:       "Game over",
+			Body:        "You won",
+			Category:    "RESULT",
+			Data:        map[string]string{"game": "42"},
+			CollapseKey: "game-42",
+			Badge:       3,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if h := <-headers; h.Get("Apns-Collapse-Id") != "game-42" {
+		t.Errorf("Collapse key not set: %v", h)
+	}
+	p := <-payloads
+	aps := p["aps"].(map[string]interface{})
+	alert := aps["alert"].(map[string]interface{})
+	if alert["title"] != "Game over" || alert["body"] != "You won" {
+		t.Errorf("Unexpected alert: %v", alert)
+	}
+	if aps["badge"] != 3.0 || aps["category"] != "RESULT" {
+		t.Errorf("Unexpected aps: %v", aps)
+	}
+	if p["game"] != "42" {
+		t.Errorf("Custom data missing: %v", p)
+	}
+}
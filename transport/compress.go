@@ -0,0 +1,98 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sync"
+)
+
+// EncodingGzip compresses payloads with gzip.
+const EncodingGzip = "gzip"
+
+var compressors = map[string]func([]byte) ([]byte, error){
+	EncodingGzip: compressGzip,
+}
+
+// CheckEncoding returns an error if payloads cannot be compressed with the
+// encoding. The empty encoding disables compression.
+func CheckEncoding(encoding string) error {
+	if _, ok := compressors[encoding]; encoding != "" && !ok {
+		return fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+	return nil
+}
+
+// payloads caches the compressed payloads of a message so it is compressed
+// once no matter to how many devices it is sent.
+type payloads struct {
+	mu         sync.Mutex
+	compressed map[string][]byte
+}
+
+// NewMessage returns a message whose copies share compressed payloads.
+func NewMessage(id, userID string, data []byte, n *Notification) Message {
+	return Message{
+		Id:           id,
+		UserId:       userID,
+		Data:         data,
+		Notification: n,
+		payloads:     &payloads{compressed: make(map[string][]byte)},
+	}
+}
+
+// CompressedPayload returns the payload compressed with the encoding if it
+// is at least minSize bytes long, along with its content type and the
+// encoding actually applied.
+func (m Message) CompressedPayload(encoding string, minSize int) ([]byte, string, string, error) {
+	data, contentType, err := m.Payload()
+	if err != nil {
+		return nil, "", "", err
+	}
+	compress, ok := compressors[encoding]
+	if !ok || len(data) < minSize {
+		return data, contentType, "", nil
+	}
+	if m.payloads == nil {
+		b, err := compress(data)
+		return b, contentType, encoding, err
+	}
+	m.payloads.mu.Lock()
+	defer m.payloads.mu.Unlock()
+	b, ok := m.payloads.compressed[encoding]
+	if !ok {
+		var err error
+		if b, err = compress(data); err != nil {
+			return nil, "", "", err
+		}
+		m.payloads.compressed[encoding] = b
+	}
+	return b, contentType, encoding, nil
+}
+
+func compressGzip(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,74 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/protogalaxy/service-notify/transport"
+)
+
+func gunzip(t *testing.T, b []byte) []byte {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Invalid gzip data: %s", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Invalid gzip data: %s", err)
+	}
+	return data
+}
+
+func TestCompressedPayload(t *testing.T) {
+	data := bytes.Repeat([]byte("data"), 100)
+	msg := transport.NewMessage("id", "user1", data, nil)
+
+	b, _, encoding, err := msg.CompressedPayload(transport.EncodingGzip, 100)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if encoding != transport.EncodingGzip || !bytes.Equal(gunzip(t, b), data) {
+		t.Errorf("Payload not compressed: %s", encoding)
+	}
+	again, _, _, _ := msg.CompressedPayload(transport.EncodingGzip, 100)
+	if &again[0] != &b[0] {
+		t.Error("Payload must be compressed once per message")
+	}
+
+	b, _, encoding, _ = msg.CompressedPayload(transport.EncodingGzip, 1000)
+	if encoding != "" || !bytes.Equal(b, data) {
+		t.Error("Payloads below the minimum size must not be compressed")
+	}
+	b, _, encoding, _ = msg.CompressedPayload("", 0)
+	if encoding != "" || !bytes.Equal(b, data) {
+		t.Error("Payloads must not be compressed without encoding")
+	}
+}
+
+func TestCheckEncoding(t *testing.T) {
+	for _, e := range []string{"", transport.EncodingGzip} {
+		if err := transport.CheckEncoding(e); err != nil {
+			t.Errorf("Unexpected error for %q: %s", e, err)
+		}
+	}
+	if err := transport.CheckEncoding("br"); err == nil {
+		t.Error("Expecting an error for an unsupported encoding")
+	}
+}
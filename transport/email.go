@@ -0,0 +1,349 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"golang.org/x/net/context"
+)
+
+var errEmailClosed = errors.New("email transport closed")
+
+// DefaultEmailSubject uses the notification title as subject.
+const DefaultEmailSubject = `{{if .Title}}{{.Title}}{{else}}Notification{{end}}`
+
+// EmailProperties configure an Email transport.
+type EmailProperties struct {
+	// From is the sender address.
+	From string
+	// Subject and Body are text/template sources rendered with EmailData.
+	Subject string
+	Body    string
+	// Auth authenticates the session if the server supports AUTH.
+	Auth smtp.Auth
+	// TLSConfig is used for STARTTLS. The server name defaults to the host
+	// of the server address.
+	TLSConfig *tls.Config
+	// RequireTLS fails delivery if the server does not offer STARTTLS.
+	RequireTLS bool
+	// Timeout limits establishing a connection.
+	Timeout time.Duration
+	// IdleTimeout is how long an unused connection is kept open.
+	IdleTimeout time.Duration
+	// BatchSize is the maximum number of queued messages sent in a row over
+	// the connection before waiting for new ones.
+	BatchSize int
+}
+
+// EmailData is passed to the subject and body templates.
+type EmailData struct {
+	Id     string
+	UserId string
+	To     string
+	// Title, Category and Data come from the notification if given.
+	Title    string
+	Category string
+	Data     map[string]string
+	// Body is the notification body or else the raw payload.
+	Body string
+}
+
+// Email delivers messages to EMAIL devices, using the device id as the
+// recipient address, through an SMTP server. Messages are sent by a single
+// goroutine which reuses the connection for messages queued concurrently.
+type Email struct {
+	addr       string
+	properties *EmailProperties
+	from       *mail.Address
+	subject    *template.Template
+	body       *template.Template
+
+	requests  chan *emailRequest
+	start     sync.Once
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type emailRequest struct {
+	to     string
+	msg    []byte
+	result chan error
+}
+
+func NewEmail(addr string, conf ...func(*EmailProperties)) (*Email, error) {
+	p := &EmailProperties{
+		Subject:     DefaultEmailSubject,
+		Body:        "{{.Body}}",
+		Timeout:     10 * time.Second,
+		IdleTimeout: 30 * time.Second,
+		BatchSize:   100,
+	}
+	for _, f := range conf {
+		f(p)
+	}
+	subject, err := template.New("subject").Parse(p.Subject)
+	if err != nil {
+		return nil, err
+	}
+	body, err := template.New("body").Parse(p.Body)
+	if err != nil {
+		return nil, err
+	}
+	from := &mail.Address{}
+	if p.From != "" {
+		if from, err = mail.ParseAddress(p.From); err != nil {
+			return nil, fmt.Errorf("invalid sender address: %s", err)
+		}
+	}
+	return &Email{
+		addr:       addr,
+		properties: p,
+		from:       from,
+		subject:    subject,
+		body:       body,
+		requests:   make(chan *emailRequest),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+func (e *Email) Send(ctx context.Context, device *devicepresence.Device, msg Message) error {
+	// The address ends up in the headers, parsing it rejects line breaks.
+	to, err := mail.ParseAddress(device.Id)
+	if err != nil {
+		return InvalidDeviceError{fmt.Sprintf("invalid email address: %s", err)}
+	}
+	b, err := e.render(to, msg)
+	if err != nil {
+		return err
+	}
+	e.start.Do(func() {
+		go e.loop()
+	})
+	r := &emailRequest{
+		to:     to.Address,
+		msg:    b,
+		result: make(chan error, 1),
+	}
+	select {
+	case e.requests <- r:
+	case <-e.done:
+		return errEmailClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-r.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close quits the open connection and fails further sends.
+func (e *Email) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.done)
+	})
+	return nil
+}
+
+func (e *Email) render(to *mail.Address, msg Message) ([]byte, error) {
+	n := msg.notification()
+	data := EmailData{
+		Id:       msg.Id,
+		UserId:   msg.UserId,
+		To:       to.Address,
+		Title:    n.Title,
+		Category: n.Category,
+		Data:     n.Data,
+		Body:     msg.body(),
+	}
+	var subject, body bytes.Buffer
+	if err := e.subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := e.body.Execute(&body, data); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if e.from.Address != "" {
+		fmt.Fprintf(&b, "From: %s\r\n", e.from)
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject.String()))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if msg.Id != "" {
+		fmt.Fprintf(&b, "X-Notify-Message-Id: %s\r\n", msg.Id)
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: %s; charset=utf-8\r\n", emailContentType(n.ContentType))
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.Write(body.Bytes())
+	return b.Bytes(), nil
+}
+
+// emailContentType returns the content type of the body. Only text types
+// are sent as is.
+func emailContentType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(t, "text/") {
+		return "text/plain"
+	}
+	return t
+}
+
+func (e *Email) loop() {
+	var c *smtp.Client
+	idle := time.NewTimer(e.properties.IdleTimeout)
+	defer func() {
+		idle.Stop()
+		if c != nil {
+			c.Quit()
+		}
+	}()
+	for {
+		select {
+		case r := <-e.requests:
+			batch := []*emailRequest{r}
+		collect:
+			for len(batch) < e.properties.BatchSize {
+				select {
+				case r := <-e.requests:
+					batch = append(batch, r)
+				default:
+					break collect
+				}
+			}
+			c = e.sendBatch(c, batch)
+			idle.Reset(e.properties.IdleTimeout)
+		case <-idle.C:
+			if c != nil {
+				c.Quit()
+				c = nil
+			}
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// sendBatch delivers the messages over the connection, dialing a new one if
+// there is none or the reused one turns out to be broken. It returns the
+// connection to be reused for the next batch.
+func (e *Email) sendBatch(c *smtp.Client, batch []*emailRequest) *smtp.Client {
+	for _, r := range batch {
+		var err error
+		for attempt := 0; attempt < 2; attempt++ {
+			reused := c != nil
+			if c == nil {
+				if c, err = e.dial(); err != nil {
+					break
+				}
+			}
+			err = e.deliver(c, r)
+			if _, ok := err.(*textproto.Error); ok {
+				// The server rejected the message, the session is fine.
+				c.Reset()
+				break
+			}
+			if err == nil {
+				break
+			}
+			c.Close()
+			c = nil
+			if !reused {
+				break
+			}
+		}
+		r.result <- err
+	}
+	return c
+}
+
+func (e *Email) dial() (*smtp.Client, error) {
+	host, _, err := net.SplitHostPort(e.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", e.addr, e.properties.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := &tls.Config{ServerName: host}
+		if e.properties.TLSConfig != nil {
+			config = e.properties.TLSConfig.Clone()
+			if config.ServerName == "" {
+				config.ServerName = host
+			}
+		}
+		if err := c.StartTLS(config); err != nil {
+			c.Close()
+			return nil, err
+		}
+	} else if e.properties.RequireTLS {
+		c.Close()
+		return nil, fmt.Errorf("%s does not support STARTTLS", e.addr)
+	}
+	if e.properties.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(e.properties.Auth); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+	}
+	glog.V(1).Infof("Connected to SMTP server %s", e.addr)
+	return c, nil
+}
+
+func (e *Email) deliver(c *smtp.Client, r *emailRequest) error {
+	if err := c.Mail(e.from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(r.to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(r.msg); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
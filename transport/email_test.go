@@ -0,0 +1,339 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+)
+
+type mail struct {
+	from, to string
+	data     string
+	tls      bool
+	user     string
+}
+
+// smtpServer is an in-process SMTP server supporting STARTTLS and AUTH
+// PLAIN. Recipients starting with "reject" are refused.
+type smtpServer struct {
+	l      net.Listener
+	config *tls.Config
+	mails  chan mail
+
+	mu    sync.Mutex
+	conns int
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{
+		l:      l,
+		config: &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}},
+		mails:  make(chan mail, 10),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *smtpServer) Close()       { s.l.Close() }
+func (s *smtpServer) Addr() string { return s.l.Addr().String() }
+
+func (s *smtpServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+func (s *smtpServer) serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+func (s *smtpServer) handle(c net.Conn) {
+	defer c.Close()
+	tc := textproto.NewConn(c)
+	tc.PrintfLine("220 localhost ESMTP")
+	var m mail
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			if m.tls {
+				tc.PrintfLine("250-localhost\r\n250 AUTH PLAIN")
+			} else {
+				tc.PrintfLine("250-localhost\r\n250 STARTTLS")
+			}
+		case "STARTTLS":
+			tc.PrintfLine("220 ready")
+			c = tls.Server(c, s.config)
+			tc = textproto.NewConn(c)
+			m = mail{tls: true}
+		case "AUTH":
+			b, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "AUTH PLAIN "))
+			parts := strings.Split(string(b), "\x00")
+			if len(parts) != 3 || parts[2] != "secret" {
+				tc.PrintfLine("535 authentication failed")
+				continue
+			}
+			m.user = parts[1]
+			tc.PrintfLine("235 authenticated")
+		case "MAIL":
+			m.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<> ")
+			tc.PrintfLine("250 ok")
+		case "RCPT":
+			m.to = strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<> ")
+			if strings.HasPrefix(m.to, "reject") {
+				tc.PrintfLine("550 no such user")
+				continue
+			}
+			tc.PrintfLine("250 ok")
+		case "DATA":
+			tc.PrintfLine("354 go ahead")
+			b, err := tc.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			m.data = string(b)
+			s.mails <- m
+			m = mail{tls: m.tls, user: m.user}
+			tc.PrintfLine("250 queued")
+		case "RSET", "NOOP":
+			tc.PrintfLine("250 ok")
+		case "QUIT":
+			tc.PrintfLine("221 bye")
+			return
+		default:
+			tc.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func selfSigned(t *testing.T) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newEmail(t *testing.T, s *smtpServer) *transport.Email {
+	e, err := transport.NewEmail(s.Addr(), func(p *transport.EmailProperties) {
+		p.From = "noreply@example.com"
+		p.Subject = "Message for {{.UserId}}"
+		p.Body = "Hello {{.To}},\n\n{{.Body}}\n"
+		p.Auth = smtp.PlainAuth("", "notify", "secret", "127.0.0.1")
+		p.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+		p.RequireTLS = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func emailDevice(address string) *devicepresence.Device {
+	return &devicepresence.Device{Id: address, Type: devicepresence.Device_EMAIL}
+}
+
+func TestEmailSendsRenderedMessage(t *testing.T) {
+	s := newSMTPServer(t)
+	defer s.Close()
+	e := newEmail(t, s)
+	defer e.Close()
+
+	err := e.Send(context.Background(), emailDevice("player@example.com"), transport.Message{UserId: "user1", Data: []byte("Your turn")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	m := <-s.mails
+	if !m.tls || m.user != "notify" {
+		t.Errorf("Expecting an authenticated TLS session: %+v", m)
+	}
+	if m.from != "noreply@example.com" || m.to != "player@example.com" {
+		t.Errorf("Unexpected envelope: %+v", m)
+	}
+	if !strings.Contains(m.data, "Subject: Message for user1\n") {
+		t.Errorf("Subject not rendered: %s", m.data)
+	}
+	if !strings.Contains(m.data, "\n\nHello player@example.com,\n\nYour turn\n") {
+		t.Errorf("Body not rendered: %s", m.data)
+	}
+}
+
+func TestEmailReusesConnection(t *testing.T) {
+	s := newSMTPServer(t)
+	defer s.Close()
+	e := newEmail(t, s)
+	defer e.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := e.Send(context.Background(), emailDevice("player@example.com"), transport.Message{}); err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := e.Send(context.Background(), emailDevice("player@example.com"), transport.Message{}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if n := s.Connections(); n != 1 {
+		t.Errorf("Expecting a single connection but got %d", n)
+	}
+}
+
+func TestEmailRejectedRecipientKeepsSession(t *testing.T) {
+	s := newSMTPServer(t)
+	defer s.Close()
+	e := newEmail(t, s)
+	defer e.Close()
+
+	if err := e.Send(context.Background(), emailDevice("reject@example.com"), transport.Message{}); err == nil {
+		t.Error("Expecting the recipient to be rejected")
+	}
+	if err := e.Send(context.Background(), emailDevice("player@example.com"), transport.Message{}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if n := s.Connections(); n != 1 {
+		t.Errorf("Expecting a single connection but got %d", n)
+	}
+}
+
+func TestEmailReconnectsAfterIdleTimeout(t *testing.T) {
+	s := newSMTPServer(t)
+	defer s.Close()
+	e, _ := transport.NewEmail(s.Addr(), func(p *transport.EmailProperties) {
+		p.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+		p.IdleTimeout = 10 * time.Millisecond
+	})
+	defer e.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := e.Send(context.Background(), emailDevice("player@example.com"), transport.Message{}); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := s.Connections(); n != 2 {
+		t.Errorf("Expecting a new connection after the idle timeout but got %d", n)
+	}
+}
+
+func TestEmailRejectsInvalidAddresses(t *testing.T) {
+	s := newSMTPServer(t)
+	defer s.Close()
+	e := newEmail(t, s)
+	defer e.Close()
+
+	err := e.Send(context.Background(), emailDevice("player@example.com\r\nBcc: victim@example.com"), transport.Message{})
+	if _, ok := err.(transport.InvalidDeviceError); !ok {
+		t.Errorf("Expecting an invalid device error but got: %v", err)
+	}
+	if n := s.Connections(); n != 0 {
+		t.Errorf("Expecting no connection for an invalid address but got %d", n)
+	}
+
+	_, err = transport.NewEmail(s.Addr(), func(p *transport.EmailProperties) {
+		p.From = "noreply@example.com\r\nBcc: victim@example.com"
+	})
+	if err == nil {
+		t.Error("Expecting an invalid sender address error")
+	}
+}
+
+func TestEmailInvalidTemplate(t *testing.T) {
+	_, err := transport.NewEmail("localhost:25", func(p *transport.EmailProperties) {
+		p.Body = "{{.Body"
+	})
+	if err == nil {
+		t.Error("Expecting a template parse error")
+	}
+}
+
+func TestEmailMapsNotification(t *testing.T) {
+	s := newSMTPServer(t)
+	defer s.Close()
+	e, _ := transport.NewEmail(s.Addr(), func(p *transport.EmailProperties) {
+		p.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	})
+	defer e.Close()
+
+	err := e.Send(context.Background(), emailDevice("player@example.com"), transport.Message{
+		Data: []byte("raw"),
+		Notification: &transport.Notification{
+			Title:       "Password changed",
+			Body:        "<p>Your password was changed.</p>",
+			ContentType: "text/html",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	m := <-s.mails
+	if !strings.Contains(m.data, "Subject: Password changed\n") {
+		t.Errorf("Title not used as subject: %s", m.data)
+	}
+	if !strings.Contains(m.data, "Content-Type: text/html; charset=utf-8\n") {
+		t.Errorf("Content type not set: %s", m.data)
+	}
+	if !strings.HasSuffix(m.data, "\n\n<p>Your password was changed.</p>\n") {
+		t.Errorf("Notification body not used: %s", m.data)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// Encrypted payloads are sealed in an envelope made of a version byte, the
+// sender's ephemeral X25519 public key, the AES-GCM nonce and the sealed
+// data. The AES-256 key is derived with HKDF-SHA256 from the X25519 shared
+// secret, salted with both public keys.
+const (
+	envelopeVersion = 1
+	envelopeInfo    = "protogalaxy notify envelope v1"
+	keySize         = 32
+	nonceSize       = 12
+)
+
+var errInvalidEnvelope = errors.New("invalid envelope")
+
+// Seal encrypts the data to the X25519 public key of a device.
+func Seal(publicKey, data []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPub := ephemeral.PublicKey().Bytes()
+	aead, err := envelopeCipher(ephemeral, pub, ephemeralPub, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 1+keySize+nonceSize, 1+keySize+nonceSize+len(data)+aead.Overhead())
+	out[0] = envelopeVersion
+	copy(out[1:], ephemeralPub)
+	nonce := out[1+keySize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, data, out[:1]), nil
+}
+
+// Open decrypts an envelope sealed with the public key of the private key.
+func Open(privateKey, envelope []byte) ([]byte, error) {
+	if len(envelope) < 1+keySize+nonceSize || envelope[0] != envelopeVersion {
+		return nil, errInvalidEnvelope
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPub := envelope[1 : 1+keySize]
+	pub, err := ecdh.X25519().NewPublicKey(ephemeralPub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := envelopeCipher(priv, pub, ephemeralPub, priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	nonce := envelope[1+keySize : 1+keySize+nonceSize]
+	return aead.Open(nil, nonce, envelope[1+keySize+nonceSize:], envelope[:1])
+}
+
+func envelopeCipher(priv *ecdh.PrivateKey, pub *ecdh.PublicKey, ephemeralPub, devicePub []byte) (cipher.AEAD, error) {
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte{}, ephemeralPub...), devicePub...)
+	key, err := hkdf.Key(sha256.New, secret, salt, envelopeInfo, keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
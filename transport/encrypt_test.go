@@ -0,0 +1,82 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport_test
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+
+	"github.com/protogalaxy/service-notify/transport"
+)
+
+func newDeviceKey(t *testing.T) *ecdh.PrivateKey {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return key
+}
+
+func TestSealOpen(t *testing.T) {
+	key := newDeviceKey(t)
+	envelope, err := transport.Seal(key.PublicKey().Bytes(), []byte("secret"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bytes.Contains(envelope, []byte("secret")) {
+		t.Error("Data not encrypted")
+	}
+	data, err := transport.Open(key.Bytes(), envelope)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(data) != "secret" {
+		t.Errorf("Expecting secret but got %q", data)
+	}
+}
+
+func TestOpenWrongKey(t *testing.T) {
+	envelope, err := transport.Seal(newDeviceKey(t).PublicKey().Bytes(), []byte("secret"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := transport.Open(newDeviceKey(t).Bytes(), envelope); err == nil {
+		t.Error("Expecting an error for the wrong key")
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	key := newDeviceKey(t)
+	envelope, err := transport.Seal(key.PublicKey().Bytes(), []byte("secret"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	envelope[len(envelope)-1] ^= 1
+	if _, err := transport.Open(key.Bytes(), envelope); err == nil {
+		t.Error("Expecting an error for a tampered envelope")
+	}
+	if _, err := transport.Open(key.Bytes(), envelope[:10]); err == nil {
+		t.Error("Expecting an error for a truncated envelope")
+	}
+}
+
+func TestSealInvalidKey(t *testing.T) {
+	if _, err := transport.Seal([]byte("short"), []byte("secret")); err == nil {
+		t.Error("Expecting an error for an invalid public key")
+	}
+}
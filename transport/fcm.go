@@ -0,0 +1,183 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// FCMEndpoint is the base URL of the FCM HTTP v1 API.
+const FCMEndpoint = "https://fcm.googleapis.com"
+
+// FCMScope is the OAuth 2.0 scope required for sending messages.
+const FCMScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// FCMProperties configure an FCM transport.
+type FCMProperties struct {
+	// Endpoint is the base URL of the FCM service.
+	Endpoint string
+	// Title is shown above the notification body.
+	Title string
+	// Timeout limits a single request.
+	Timeout time.Duration
+	// Client sends the requests.
+	Client *http.Client
+}
+
+// FCM delivers messages to FCM devices, using the device id as the
+// registration token, through the FCM HTTP v1 API.
+type FCM struct {
+	project    string
+	tokens     oauth2.TokenSource
+	properties *FCMProperties
+}
+
+// NewFCM creates a transport sending messages on behalf of the Firebase
+// project. The access tokens must carry FCMScope.
+func NewFCM(project string, tokens oauth2.TokenSource, conf ...func(*FCMProperties)) *FCM {
+	p := &FCMProperties{
+		Endpoint: FCMEndpoint,
+		Timeout:  10 * time.Second,
+		Client:   &http.Client{},
+	}
+	for _, f := range conf {
+		f(p)
+	}
+	return &FCM{
+		project:    project,
+		tokens:     tokens,
+		properties: p,
+	}
+}
+
+type fcmRequest struct {
+	Message struct {
+		Token        string            `json:"token"`
+		Notification alert             `json:"notification"`
+		Data         map[string]string `json:"data,omitempty"`
+		Android      *fcmAndroid       `json:"android,omitempty"`
+		APNS         *fcmAPNS          `json:"apns,omitempty"`
+	} `json:"message"`
+}
+
+type fcmAndroid struct {
+	CollapseKey string `json:"collapse_key,omitempty"`
+}
+
+type fcmAPNS struct {
+	Headers map[string]string `json:"headers,omitempty"`
+	Payload struct {
+		Aps struct {
+			Badge    int    `json:"badge,omitempty"`
+			Category string `json:"category,omitempty"`
+		} `json:"aps"`
+	} `json:"payload"`
+}
+
+// fcmMessage maps the message to the FCM message. Custom data and the
+// category are passed as data, the collapse key and badge through the
+// platform specific options.
+func (f *FCM) fcmMessage(token string, msg Message) fcmRequest {
+	n := msg.notification()
+	var r fcmRequest
+	r.Message.Token = token
+	r.Message.Notification = newAlert(f.properties.Title, msg)
+	r.Message.Data = make(map[string]string, len(n.Data)+2)
+	for k, v := range n.Data {
+		r.Message.Data[k] = v
+	}
+	if msg.Id != "" {
+		r.Message.Data["message_id"] = msg.Id
+	}
+	if n.Category != "" {
+		r.Message.Data["category"] = n.Category
+	}
+	if n.CollapseKey != "" {
+		r.Message.Android = &fcmAndroid{CollapseKey: n.CollapseKey}
+	}
+	if n.CollapseKey != "" || n.Badge != 0 || n.Category != "" {
+		a := &fcmAPNS{}
+		if n.CollapseKey != "" {
+			a.Headers = map[string]string{"apns-collapse-id": n.CollapseKey}
+		}
+		a.Payload.Aps.Badge = n.Badge
+		a.Payload.Aps.Category = n.Category
+		r.Message.APNS = a
+	}
+	return r
+}
+
+type fcmError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+func (f *FCM) Send(ctx context.Context, device *devicepresence.Device, msg Message) error {
+	body, err := json.Marshal(f.fcmMessage(device.Id, msg))
+	if err != nil {
+		return err
+	}
+	token, err := f.tokens.Token()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.properties.Timeout)
+	defer cancel()
+	url := f.properties.Endpoint + "/v1/projects/" + f.project + "/messages:send"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	token.SetAuthHeader(req)
+	res, err := f.properties.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil
+	}
+
+	var e fcmError
+	readError(res, &e)
+	if res.StatusCode == http.StatusNotFound {
+		return InvalidDeviceError{e.Error.Status}
+	}
+	for _, d := range e.Error.Details {
+		if d.ErrorCode == "UNREGISTERED" {
+			return InvalidDeviceError{d.ErrorCode}
+		}
+	}
+	return PushError{res.StatusCode, e.Error.Message}
+}
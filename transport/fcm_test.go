@@ -0,0 +1,160 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+type staticTokens string
+
+func (s staticTokens) Token() (*oauth2.Token, error) {
+	return &oauth2.Token{AccessToken: string(s), TokenType: "Bearer"}, nil
+}
+
+type fcmMessage struct {
+	Message struct {
+		Token        string            `json:"token"`
+		Notification map[string]string `json:"notification"`
+		Data         map[string]string `json:"data"`
+	} `json:"message"`
+}
+
+// fakeFCM starts a server answering like the FCM HTTP v1 API. Tokens listed
+// in dead are reported as unregistered.
+func fakeFCM(t *testing.T, dead ...string) (*httptest.Server, chan fcmMessage) {
+	messages := make(chan fcmMessage, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/game/messages:send" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"code":401,"message":"invalid credentials","status":"UNAUTHENTICATED"}}`))
+			return
+		}
+		var m fcmMessage
+		json.NewDecoder(r.Body).Decode(&m)
+		for _, d := range dead {
+			if d == m.Message.Token {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":{"code":404,"message":"Requested entity was not found.","status":"NOT_FOUND",` +
+					`"details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`))
+				return
+			}
+		}
+		messages <- m
+		w.Write([]byte(`{"name":"projects/game/messages/1"}`))
+	}))
+	return srv, messages
+}
+
+func newFCM(srv *httptest.Server, token string) *transport.FCM {
+	return transport.NewFCM("game", staticTokens(token), func(p *transport.FCMProperties) {
+		p.Endpoint = srv.URL
+		p.Title = "Protogalaxy"
+	})
+}
+
+func TestFCMSendsNotification(t *testing.T) {
+	srv, messages := fakeFCM(t)
+	defer srv.Close()
+
+	device := &devicepresence.Device{Id: "token1", Type: devicepresence.Device_FCM}
+	err := newFCM(srv, "secret").Send(context.Background(), device, transport.Message{Id: "msg1", Data: []byte("Your turn")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	m := <-messages
+	if m.Message.Token != "token1" {
+		t.Errorf("Unexpected token: %s", m.Message.Token)
+	}
+	if n := m.Message.Notification; n["title"] != "Protogalaxy" || n["body"] != "Your turn" {
+		t.Errorf("Unexpected notification: %v", n)
+	}
+	if m.Message.Data["message_id"] != "msg1" {
+		t.Errorf("Unexpected data: %v", m.Message.Data)
+	}
+}
+
+func TestFCMUnregisteredToken(t *testing.T) {
+	srv, _ := fakeFCM(t, "dead")
+	defer srv.Close()
+
+	err := newFCM(srv, "secret").Send(context.Background(), &devicepresence.Device{Id: "dead"}, transport.Message{})
+	if _, ok := err.(transport.InvalidDeviceError); !ok {
+		t.Errorf("Expecting invalid device error but got: %v", err)
+	}
+}
+
+func TestFCMUnauthorized(t *testing.T) {
+	srv, _ := fakeFCM(t)
+	defer srv.Close()
+
+	err := newFCM(srv, "wrong").Send(context.Background(), &devicepresence.Device{Id: "token1"}, transport.Message{})
+	if e, ok := err.(transport.PushError); !ok || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expecting push error but got: %v", err)
+	}
+}
+
+func TestFCMMapsNotification(t *testing.T) {
+	bodies := make(chan map[string]interface{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&b)
+		bodies <- b
+	}))
+	defer srv.Close()
+
+	err := newFCM(srv, "secret").Send(context.Background(), &devicepresence.Device{Id: "token1"}, transport.Message{
+		Notification: &transport.Notification{
+			Title:       "Game over",
+			Body:        "You won",
+			Category:    "RESULT",
+			Data:        map[string]string{"game": "42"},
+			CollapseKey: "game-42",
+			Badge:       3,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	m := (<-bodies)["message"].(map[string]interface{})
+	n := m["notification"].(map[string]interface{})
+	if n["title"] != "Game over" || n["body"] != "You won" {
+		t.Errorf("Unexpected notification: %v", n)
+	}
+	data := m["data"].(map[string]interface{})
+	if data["game"] != "42" || data["category"] != "RESULT" {
+		t.Errorf("Unexpected data: %v", data)
+	}
+	if m["android"].(map[string]interface{})["collapse_key"] != "game-42" {
+		t.Errorf("Collapse key not set: %v", m["android"])
+	}
+	aps := m["apns"].(map[string]interface{})["payload"].(map[string]interface{})["aps"].(map[string]interface{})
+	if aps["badge"] != 3.0 {
+		t.Errorf("Badge not set: %v", aps)
+	}
+}
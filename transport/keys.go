@@ -0,0 +1,152 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// DeviceKeysProperties configures the device key cache.
+type DeviceKeysProperties struct {
+	// TTL is how long a key is used before it is looked up again.
+	TTL time.Duration
+	// MismatchTTL is how long a key is used whose id differs from the one
+	// the device advertised, e.g. while a rotation propagates.
+	MismatchTTL time.Duration
+	// MaxEntries limits the number of cached keys.
+	MaxEntries int
+	Now        func() time.Time
+}
+
+type deviceRef struct {
+	userID   string
+	deviceID string
+	typ      devicepresence.Device_Type
+}
+
+type cachedKey struct {
+	key *devicepresence.DeviceKey
+	// advertised is the key id in the device list the key was fetched for.
+	advertised string
+	expires    time.Time
+}
+
+// DeviceKeys looks up device encryption keys in presence and caches them.
+// Devices name their current key id in the device list, so a rotated key
+// misses the cache and is fetched again.
+//
+// DeviceKeys is a presence client itself and forgets the key of a device
+// that is registered or removed through it, since a device registered again
+// may come with a new key under the same id.
+type DeviceKeys struct {
+	devicepresence.PresenceManagerClient
+	props DeviceKeysProperties
+
+	mu   sync.Mutex
+	keys map[deviceRef]cachedKey
+}
+
+func NewDeviceKeys(presence devicepresence.PresenceManagerClient, conf ...func(*DeviceKeysProperties)) *DeviceKeys {
+	props := DeviceKeysProperties{
+		TTL:         time.Hour,
+		MismatchTTL: 10 * time.Second,
+		MaxEntries:  100000,
+		Now:         time.Now,
+	}
+	for _, c := range conf {
+		c(&props)
+	}
+	return &DeviceKeys{
+		PresenceManagerClient: presence,
+		props:                 props,
+		keys:                  make(map[deviceRef]cachedKey),
+	}
+}
+
+// Key returns the current key of the device. Devices without a key id have
+// no key and nil is returned.
+func (k *DeviceKeys) Key(ctx context.Context, device *devicepresence.Device) (*devicepresence.DeviceKey, error) {
+	if device.KeyId == "" {
+		return nil, nil
+	}
+	ref := deviceRef{device.UserId, device.Id, device.Type}
+	now := k.props.Now()
+	k.mu.Lock()
+	cached, ok := k.keys[ref]
+	k.mu.Unlock()
+	if ok && now.Before(cached.expires) && (cached.key.KeyId == device.KeyId || cached.advertised == device.KeyId) {
+		return cached.key, nil
+	}
+	key, err := k.GetDeviceKey(ctx, &devicepresence.DeviceKeyRequest{
+		UserId:   device.UserId,
+		DeviceId: device.Id,
+		Type:     device.Type,
+	})
+	if err != nil || key == nil {
+		return key, err
+	}
+	ttl := k.props.TTL
+	if key.KeyId != device.KeyId {
+		// Presence and the device list disagree while a rotation
+		// propagates. The key is only used briefly so the device list
+		// catches up, without looking it up on every send meanwhile.
+		ttl = k.props.MismatchTTL
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[ref]; !ok && len(k.keys) >= k.props.MaxEntries {
+		k.evict(now)
+	}
+	k.keys[ref] = cachedKey{key: key, advertised: device.KeyId, expires: now.Add(ttl)}
+	return key, nil
+}
+
+// Forget drops the cached key of the device.
+func (k *DeviceKeys) Forget(userID, deviceID string, typ devicepresence.Device_Type) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, deviceRef{userID, deviceID, typ})
+}
+
+func (k *DeviceKeys) RegisterDevice(ctx context.Context, in *devicepresence.Device, opts ...grpc.CallOption) (*devicepresence.RegisterDeviceReply, error) {
+	defer k.Forget(in.UserId, in.Id, in.Type)
+	return k.PresenceManagerClient.RegisterDevice(ctx, in, opts...)
+}
+
+func (k *DeviceKeys) RemoveDevice(ctx context.Context, in *devicepresence.RemoveDeviceRequest, opts ...grpc.CallOption) (*devicepresence.RemoveDeviceReply, error) {
+	defer k.Forget(in.UserId, in.DeviceId, in.Type)
+	return k.PresenceManagerClient.RemoveDevice(ctx, in, opts...)
+}
+
+// evict drops expired keys, or an arbitrary key if none expired.
+func (k *DeviceKeys) evict(now time.Time) {
+	for ref, cached := range k.keys {
+		if !now.Before(cached.expires) {
+			delete(k.keys, ref)
+		}
+	}
+	for ref := range k.keys {
+		if len(k.keys) < k.props.MaxEntries {
+			break
+		}
+		delete(k.keys, ref)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// KeyPresenceMock serves device keys and counts lookups.
+type KeyPresenceMock struct {
+	devicepresence.PresenceManagerClient
+
+	keys    map[string]*devicepresence.DeviceKey
+	lookups int
+}
+
+func (m *KeyPresenceMock) GetDeviceKey(ctx context.Context, in *devicepresence.DeviceKeyRequest, opts ...grpc.CallOption) (*devicepresence.DeviceKey, error) {
+	m.lookups++
+	return m.keys[in.DeviceId], nil
+}
+
+func TestDeviceKeysCachesKeys(t *testing.T) {
+	p := &KeyPresenceMock{keys: map[string]*devicepresence.DeviceKey{
+		"1": {KeyId: "k1", PublicKey: []byte("pub1")},
+	}}
+	keys := transport.NewDeviceKeys(p)
+	device := &devicepresence.Device{Id: "1", UserId: "user", KeyId: "k1"}
+	for i := 0; i < 3; i++ {
+		key, err := keys.Key(context.Background(), device)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if key.KeyId != "k1" {
+			t.Errorf("Wrong key: %+v", key)
+		}
+	}
+	if p.lookups != 1 {
+		t.Errorf("Expecting 1 lookup but got %d", p.lookups)
+	}
+}
+
+func TestDeviceKeysWithoutKey(t *testing.T) {
+	p := &KeyPresenceMock{}
+	key, err := transport.NewDeviceKeys(p).Key(context.Background(), &devicepresence.Device{Id: "1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if key != nil || p.lookups != 0 {
+		t.Errorf("Devices without a key id should not be looked up: %+v", key)
+	}
+}
+
+func TestDeviceKeysRotation(t *testing.T) {
+	p := &KeyPresenceMock{keys: map[string]*devicepresence.DeviceKey{
+		"1": {KeyId: "k1", PublicKey: []byte("pub1")},
+	}}
+	keys := transport.NewDeviceKeys(p)
+	device := &devicepresence.Device{Id: "1", UserId: "user", KeyId: "k1"}
+	keys.Key(context.Background(), device)
+	p.keys["1"] = &devicepresence.DeviceKey{KeyId: "k2", PublicKey: []byte("pub2")}
+	device.KeyId = "k2"
+	key, err := keys.Key(context.Background(), device)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if key.KeyId != "k2" || p.lookups != 2 {
+		t.Errorf("Rotated key not looked up: %+v after %d lookups", key, p.lookups)
+	}
+}
+
+func TestDeviceKeysExpire(t *testing.T) {
+	p := &KeyPresenceMock{keys: map[string]*devicepresence.DeviceKey{
+		"1": {KeyId: "k1", PublicKey: []byte("pub1")},
+	}}
+	now := time.Unix(0, 0)
+	keys := transport.NewDeviceKeys(p, func(props *transport.DeviceKeysProperties) {
+		props.TTL = time.Minute
+		props.Now = func() time.Time { return now }
+	})
+	device := &devicepresence.Device{Id: "1", UserId: "user", KeyId: "k1"}
+	keys.Key(context.Background(), device)
+	now = now.Add(2 * time.Minute)
+	keys.Key(context.Background(), device)
+	keys.Key(context.Background(), device)
+	if p.lookups != 2 {
+		t.Errorf("Expecting 2 lookups but got %d", p.lookups)
+	}
+}
+
+func TestDeviceKeysMismatchedKeyIdExpiresEarly(t *testing.T) {
+	p := &KeyPresenceMock{keys: map[string]*devicepresence.DeviceKey{
+		"1": {KeyId: "k2", PublicKey: []byte("pub2")},
+	}}
+	now := time.Unix(0, 0)
+	keys := transport.NewDeviceKeys(p, func(props *transport.DeviceKeysProperties) {
+		props.TTL = time.Hour
+		props.MismatchTTL = time.Second
+		props.Now = func() time.Time { return now }
+	})
+	device := &devicepresence.Device{Id: "1", UserId: "user", KeyId: "k1"}
+	for i := 0; i < 3; i++ {
+		key, err := keys.Key(context.Background(), device)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if key.KeyId != "k2" {
+			t.Errorf("Expecting the key presence returned but got %+v", key)
+		}
+	}
+	if p.lookups != 1 {
+		t.Errorf("Expecting 1 lookup but got %d", p.lookups)
+	}
+	now = now.Add(2 * time.Second)
+	keys.Key(context.Background(), device)
+	if p.lookups != 2 {
+		t.Errorf("Mismatched key must expire after MismatchTTL, got %d lookups", p.lookups)
+	}
+}
+
+func TestDeviceKeysCachedUnderReturnedKeyId(t *testing.T) {
+	p := &KeyPresenceMock{keys: map[string]*devicepresence.DeviceKey{
+		"1": {KeyId: "k2", PublicKey: []byte("pub2")},
+	}}
+	keys := transport.NewDeviceKeys(p)
+	device := &devicepresence.Device{Id: "1", UserId: "user", KeyId: "k1"}
+	keys.Key(context.Background(), device)
+	device.KeyId = "k2"
+	keys.Key(context.Background(), device)
+	if p.lookups != 1 {
+		t.Errorf("Expecting 1 lookup once the device list caught up but got %d", p.lookups)
+	}
+}
+
+func (m *KeyPresenceMock) RegisterDevice(ctx context.Context, in *devicepresence.Device, opts ...grpc.CallOption) (*devicepresence.RegisterDeviceReply, error) {
+	return &devicepresence.RegisterDeviceReply{}, nil
+}
+
+func TestDeviceKeysForgetsReregisteredDevice(t *testing.T) {
+	p := &KeyPresenceMock{keys: map[string]*devicepresence.DeviceKey{
+		"1": {KeyId: "k1", PublicKey: []byte("pub1")},
+	}}
+	keys := transport.NewDeviceKeys(p)
+	device := &devicepresence.Device{Id: "1", UserId: "user", KeyId: "k1"}
+	keys.Key(context.Background(), device)
+	p.keys["1"] = &devicepresence.DeviceKey{KeyId: "k1", PublicKey: []byte("new")}
+	if _, err := keys.RegisterDevice(context.Background(), device); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	key, _ := keys.Key(context.Background(), device)
+	if string(key.PublicKey) != "new" || p.lookups != 2 {
+		t.Errorf("Key of a registered device must be looked up again: %+v after %d lookups", key, p.lookups)
+	}
+}
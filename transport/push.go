@@ -0,0 +1,70 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// InvalidDeviceError is returned when a push service reports the device
+// token as no longer valid. Such devices should be removed from presence.
+type InvalidDeviceError struct {
+	Reason string
+}
+
+func (e InvalidDeviceError) Error() string {
+	return fmt.Sprintf("invalid device: %s", e.Reason)
+}
+
+// PushError is returned when a push service rejects a message for a reason
+// other than an invalid device token.
+type PushError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e PushError) Error() string {
+	return fmt.Sprintf("push service responded with status %d: %s", e.StatusCode, e.Reason)
+}
+
+// alert is the user visible part of a push notification.
+type alert struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+// newAlert maps the message to the alert shown on the device. The
+// configured title is used if the notification has none.
+func newAlert(title string, msg Message) alert {
+	return alert{
+		Title: msg.title(title),
+		Body:  msg.body(),
+	}
+}
+
+// readError decodes the JSON error body of a push service response into v
+// and discards anything left.
+func readError(res *http.Response, v interface{}) {
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err == nil {
+		json.Unmarshal(b, v)
+	}
+	io.Copy(ioutil.Discard, res.Body)
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/socket"
+	"golang.org/x/net/context"
+)
+
+// Socket delivers messages to WebSocket devices through the socket service.
+type Socket struct {
+	Client socket.SenderClient
+	// Encoding compresses payloads of at least MinCompressSize bytes if
+	// set. The socket service passes the encoding on to the client.
+	Encoding        string
+	MinCompressSize int
+	// Keys encrypts payloads to devices that registered an encryption key
+	// if set. Payloads are compressed before they are encrypted.
+	Keys *DeviceKeys
+	// Nodes routes messages to the socket service of the gateway node
+	// holding the socket if set. Devices without a node use Client.
+	Nodes *SocketPool
+	// Timeout limits a single send including the connection to the
+	// gateway node if set.
+	Timeout time.Duration
+}
+
+func (s *Socket) Send(ctx context.Context, device *devicepresence.Device, msg Message) error {
+	socketID, err := strconv.ParseInt(device.Id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid socket id: %s", err)
+	}
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	data, _, encoding, err := msg.CompressedPayload(s.Encoding, s.MinCompressSize)
+	if err != nil {
+		return err
+	}
+	var keyID string
+	if s.Keys != nil {
+		key, err := s.Keys.Key(ctx, device)
+		if err != nil {
+			return fmt.Errorf("device key lookup: %s", err)
+		}
+		if key != nil {
+			if data, err = Seal(key.PublicKey, data); err != nil {
+				return err
+			}
+			keyID = key.KeyId
+		}
+	}
+	client := s.Client
+	if device.Node != "" && s.Nodes != nil {
+		c, release, err := s.Nodes.Client(ctx, device.Node)
+		if err != nil {
+			return err
+		}
+		defer release()
+		client = c
+	}
+	_, err = client.SendMessage(ctx, &socket.SendRequest{
+		SocketId:        socketID,
+		Data:            data,
+		ContentEncoding: encoding,
+		KeyId:           keyID,
+	})
+	return err
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport_test
+
+import (
+	"testing"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/socket"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+type SenderMock struct {
+	OnSendMessage  func(ctx context.Context, in *socket.SendRequest, opts ...grpc.CallOption) (*socket.SendReply, error)
+	OnSendMessages func(ctx context.Context, in *socket.SendBatchRequest, opts ...grpc.CallOption) (*socket.SendBatchReply, error)
+}
+
+func (m SenderMock) SendMessage(ctx context.Context, in *socket.SendRequest, opts ...grpc.CallOption) (*socket.SendReply, error) {
+	return m.OnSendMessage(ctx, in, opts...)
+}
+
+func (m SenderMock) SendMessages(ctx context.Context, in *socket.SendBatchRequest, opts ...grpc.CallOption) (*socket.SendBatchReply, error) {
+	return m.OnSendMessages(ctx, in, opts...)
+}
+
+func TestSocketSendsToSocketService(t *testing.T) {
+	var sent *socket.SendRequest
+	s := &transport.Socket{
+		Client: SenderMock{
+			OnSendMessage: func(ctx context.Context, in *socket.SendRequest, opts ...grpc.CallOption) (*socket.SendReply, error) {
+				sent = in
+				return &socket.SendReply{}, nil
+			},
+		},
+	}
+	err := s.Send(context.Background(), &devicepresence.Device{Id: "123"}, transport.Message{Data: []byte("data")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sent.SocketId != 123 || string(sent.Data) != "data" {
+		t.Errorf("Wrong request sent: %+v", sent)
+	}
+}
+
+func TestSocketInvalidSocketId(t *testing.T) {
+	s := &transport.Socket{}
+	if err := s.Send(context.Background(), &devicepresence.Device{Id: "abc"}, transport.Message{}); err == nil {
+		t.Error("Expecting an error for an invalid socket id")
+	}
+}
+
+func TestSocketCompressesPayload(t *testing.T) {
+	var sent *socket.SendRequest
+	s := &transport.Socket{
+		Client: SenderMock{
+			OnSendMessage: func(ctx context.Context, in *socket.SendRequest, opts ...grpc.CallOption) (*socket.SendReply, error) {
+				sent = in
+				return &socket.SendReply{}, nil
+			},
+		},
+		Encoding: transport.EncodingGzip,
+	}
+	err := s.Send(context.Background(), &devicepresence.Device{Id: "123"}, transport.Message{Data: []byte("data")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sent.ContentEncoding != transport.EncodingGzip || string(gunzip(t, sent.Data)) != "data" {
+		t.Errorf("Payload not compressed: %+v", sent)
+	}
+}
+
+func TestSocketEncryptsPayload(t *testing.T) {
+	key := newDeviceKey(t)
+	var sent *socket.SendRequest
+	s := &transport.Socket{
+		Client: SenderMock{
+			OnSendMessage: func(ctx context.Context, in *socket.SendRequest, opts ...grpc.CallOption) (*socket.SendReply, error) {
+				sent = in
+				return &socket.SendReply{}, nil
+			},
+		},
+		Keys: transport.NewDeviceKeys(&KeyPresenceMock{keys: map[string]*devicepresence.DeviceKey{
+			"123": {KeyId: "k1", PublicKey: key.PublicKey().Bytes()},
+		}}),
+	}
+	err := s.Send(context.Background(), &devicepresence.Device{Id: "123", KeyId: "k1"}, transport.Message{Data: []byte("data")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sent.KeyId != "k1" {
+		t.Errorf("Expecting key id k1 but got %q", sent.KeyId)
+	}
+	data, err := transport.Open(key.Bytes(), sent.Data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(data) != "data" {
+		t.Errorf("Expecting data but got %q", data)
+	}
+}
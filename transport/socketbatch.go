@@ -0,0 +1,164 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/protogalaxy/service-notify/socket"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+type SocketBatchProperties struct {
+	// Window is how long a message waits for others to join its batch.
+	Window time.Duration
+	// MaxMessages is the largest number of messages sent in one batch.
+	MaxMessages int
+	// Timeout limits a batch send.
+	Timeout time.Duration
+}
+
+// SocketBatcher is a SenderClient that collects the messages sent within a
+// short window and sends them with a single SendMessages call. Each
+// SendMessage call returns the result of its own message. If the socket
+// service does not implement SendMessages the messages are sent one by one
+// from then on.
+type SocketBatcher struct {
+	socket.SenderClient
+	properties *SocketBatchProperties
+	// unsupported is set once the socket service reported that it does not
+	// implement SendMessages.
+	unsupported int32
+
+	mu      sync.Mutex
+	pending []pendingSend
+	timer   *time.Timer
+}
+
+type pendingSend struct {
+	req *socket.SendRequest
+	res chan error
+}
+
+var errBatchReply = errors.New("socket service returned a malformed batch reply")
+
+func NewSocketBatcher(client socket.SenderClient, conf ...func(*SocketBatchProperties)) *SocketBatcher {
+	p := &SocketBatchProperties{
+		Window:      2 * time.Millisecond,
+		MaxMessages: 100,
+		Timeout:     5 * time.Second,
+	}
+	for _, f := range conf {
+		f(p)
+	}
+	return &SocketBatcher{
+		SenderClient: client,
+		properties:   p,
+	}
+}
+
+func (b *SocketBatcher) SendMessage(ctx context.Context, in *socket.SendRequest, opts ...grpc.CallOption) (*socket.SendReply, error) {
+	if atomic.LoadInt32(&b.unsupported) != 0 {
+		return b.SenderClient.SendMessage(ctx, in, opts...)
+	}
+	res := make(chan error, 1)
+	b.mu.Lock()
+	b.pending = append(b.pending, pendingSend{req: in, res: res})
+	if len(b.pending) >= b.properties.MaxMessages {
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+		go b.send(b.take())
+	} else if len(b.pending) == 1 {
+		b.timer = time.AfterFunc(b.properties.Window, b.flush)
+	}
+	b.mu.Unlock()
+
+	select {
+	case err := <-res:
+		if err != nil {
+			return nil, err
+		}
+		return &socket.SendReply{}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// take returns the pending messages and starts a new batch. Must be called
+// with the lock held.
+func (b *SocketBatcher) take() []pendingSend {
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+func (b *SocketBatcher) flush() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+	if len(batch) > 0 {
+		b.send(batch)
+	}
+}
+
+// send sends the batch and hands each message its result.
+func (b *SocketBatcher) send(batch []pendingSend) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.properties.Timeout)
+	defer cancel()
+	req := &socket.SendBatchRequest{}
+	for _, p := range batch {
+		req.Messages = append(req.Messages, p.req)
+	}
+	reply, err := b.SenderClient.SendMessages(ctx, req)
+	switch {
+	case grpc.Code(err) == codes.Unimplemented:
+		glog.Warning("Socket service does not implement SendMessages, sending messages one by one")
+		atomic.StoreInt32(&b.unsupported, 1)
+		var wg sync.WaitGroup
+		for _, p := range batch {
+			wg.Add(1)
+			go func(p pendingSend) {
+				defer wg.Done()
+				_, err := b.SenderClient.SendMessage(ctx, p.req)
+				p.res <- err
+			}(p)
+		}
+		wg.Wait()
+	case err != nil:
+		for _, p := range batch {
+			p.res <- err
+		}
+	case len(reply.Results) != len(batch):
+		for _, p := range batch {
+			p.res <- errBatchReply
+		}
+	default:
+		for i, p := range batch {
+			var err error
+			if r := reply.Results[i]; r.Code != uint32(codes.OK) {
+				err = grpc.Errorf(codes.Code(r.Code), "%s", r.Error)
+			}
+			p.res <- err
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/socket"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// sendConcurrently sends a message to each socket and returns the errors
+// by socket id.
+func sendConcurrently(client socket.SenderClient, socketIDs ...int64) map[int64]error {
+	var mu sync.Mutex
+	errs := make(map[int64]error)
+	var wg sync.WaitGroup
+	for _, id := range socketIDs {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			_, err := client.SendMessage(context.Background(), &socket.SendRequest{SocketId: id, Data: []byte("data")})
+			mu.Lock()
+			errs[id] = err
+			mu.Unlock()
+		}(id)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestSocketBatcherSendsBatches(t *testing.T) {
+	var batches int32
+	sm := SenderMock{
+		OnSendMessages: func(ctx context.Context, in *socket.SendBatchRequest, opts ...grpc.CallOption) (*socket.SendBatchReply, error) {
+			atomic.AddInt32(&batches, 1)
+			var reply socket.SendBatchReply
+			for _, msg := range in.Messages {
+				r := &socket.SendResult{SocketId: msg.SocketId}
+				if msg.SocketId == 2 {
+					r.Code = uint32(codes.NotFound)
+					r.Error = "socket closed"
+				}
+				reply.Results = append(reply.Results, r)
+			}
+			return &reply, nil
+		},
+	}
+	b := transport.NewSocketBatcher(sm, func(p *transport.SocketBatchProperties) {
+		p.Window = 20 * time.Millisecond
+	})
+	errs := sendConcurrently(b, 1, 2, 3)
+
+	if batches != 1 {
+		t.Errorf("Expecting a single batch but got %d", batches)
+	}
+	if errs[1] != nil || errs[3] != nil {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+	if grpc.Code(errs[2]) != codes.NotFound {
+		t.Errorf("Expecting not found error but got: %v", errs[2])
+	}
+}
+
+func TestSocketBatcherLimitsBatchSize(t *testing.T) {
+	var mu sync.Mutex
+	var sizes []int
+	sm := SenderMock{
+		OnSendMessages: func(ctx context.Context, in *socket.SendBatchRequest, opts ...grpc.CallOption) (*socket.SendBatchReply, error) {
+			mu.Lock()
+			sizes = append(sizes, len(in.Messages))
+			mu.Unlock()
+			var reply socket.SendBatchReply
+			for _, msg := range in.Messages {
+				reply.Results = append(reply.Results, &socket.SendResult{SocketId: msg.SocketId})
+			}
+			return &reply, nil
+		},
+	}
+	b := transport.NewSocketBatcher(sm, func(p *transport.SocketBatchProperties) {
+		p.Window = time.Hour
+		p.MaxMessages = 2
+	})
+	sendConcurrently(b, 1, 2, 3, 4)
+
+	if len(sizes) != 2 || sizes[0] != 2 || sizes[1] != 2 {
+		t.Errorf("Expecting 2 batches of 2 messages but got %v", sizes)
+	}
+}
+
+func TestSocketBatcherMalformedReply(t *testing.T) {
+	sm := SenderMock{
+		OnSendMessages: func(ctx context.Context, in *socket.SendBatchRequest, opts ...grpc.CallOption) (*socket.SendBatchReply, error) {
+			return &socket.SendBatchReply{}, nil
+		},
+	}
+	b := transport.NewSocketBatcher(sm)
+	if errs := sendConcurrently(b, 1); errs[1] == nil {
+		t.Error("Expecting an error for a reply without results")
+	}
+}
+
+func TestSocketBatcherFallsBackToSingleSends(t *testing.T) {
+	var batches, sends int32
+	sm := SenderMock{
+		OnSendMessage: func(ctx context.Context, in *socket.SendRequest, opts ...grpc.CallOption) (*socket.SendReply, error) {
+			atomic.AddInt32(&sends, 1)
+			return &socket.SendReply{}, nil
+		},
+		OnSendMessages: func(ctx context.Context, in *socket.SendBatchRequest, opts ...grpc.CallOption) (*socket.SendBatchReply, error) {
+			atomic.AddInt32(&batches, 1)
+			return nil, grpc.Errorf(codes.Unimplemented, "unknown method")
+		},
+	}
+	b := transport.NewSocketBatcher(sm, func(p *transport.SocketBatchProperties) {
+		p.Window = 20 * time.Millisecond
+	})
+	errs := sendConcurrently(b, 1, 2)
+	if errs[1] != nil || errs[2] != nil {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+	sendConcurrently(b, 3)
+	if batches != 1 || sends != 3 {
+		t.Errorf("Expecting 1 batch and 3 single sends but got %d and %d", batches, sends)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/protogalaxy/service-notify/socket"
+	"golang.org/x/net/context"
+)
+
+var (
+	errPoolClosed    = errors.New("socket pool closed")
+	errDialAbandoned = errors.New("connection to the socket service abandoned")
+)
+
+// DialSocket connects to the socket service on a gateway node and returns
+// the client along with a function closing the connection.
+type DialSocket func(node string) (client socket.SenderClient, close func(), err error)
+
+type SocketPoolProperties struct {
+	// IdleTimeout is how long a connection is kept without sends.
+	IdleTimeout time.Duration
+	// DialTimeout is how long a dial may be in progress before Expire
+	// gives up on it.
+	DialTimeout time.Duration
+	Now         func() time.Time
+}
+
+// SocketPool keeps a connection to the socket service of each gateway node
+// messages are sent to. Connections are dialed on first use and closed by
+// Expire once idle.
+type SocketPool struct {
+	dial       DialSocket
+	properties *SocketPoolProperties
+
+	mu     sync.Mutex
+	nodes  map[string]*nodeConn
+	closed bool
+}
+
+type nodeConn struct {
+	// ready is closed once the connection is dialed.
+	ready  chan struct{}
+	client socket.SenderClient
+	close  func()
+	err    error
+	// refs counts the sends in progress.
+	refs     int
+	lastUsed time.Time
+	// dialed is when the dial started and abandoned is set once the pool
+	// no longer holds the connection while it is being dialed.
+	dialed    time.Time
+	abandoned bool
+}
+
+func NewSocketPool(dial DialSocket, conf ...func(*SocketPoolProperties)) *SocketPool {
+	p := &SocketPoolProperties{
+		IdleTimeout: 5 * time.Minute,
+		DialTimeout: 10 * time.Second,
+		Now:         time.Now,
+	}
+	for _, f := range conf {
+		f(p)
+	}
+	return &SocketPool{
+		dial:       dial,
+		properties: p,
+		nodes:      make(map[string]*nodeConn),
+	}
+}
+
+// Client returns the client of the node, dialing it if needed. Waiting for
+// the dial stops when ctx is done. The release function must be called once
+// the client is no longer used.
+func (p *SocketPool) Client(ctx context.Context, node string) (socket.SenderClient, func(), error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, nil, errPoolClosed
+	}
+	c, ok := p.nodes[node]
+	if !ok {
+		c = &nodeConn{
+			ready:  make(chan struct{}),
+			dialed: p.properties.Now(),
+		}
+		p.nodes[node] = c
+		go p.connect(node, c)
+	}
+	c.refs++
+	p.mu.Unlock()
+
+	release := func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		c.refs--
+		c.lastUsed = p.properties.Now()
+	}
+	select {
+	case <-c.ready:
+	case <-ctx.Done():
+		release()
+		return nil, nil, ctx.Err()
+	}
+	if c.err != nil {
+		release()
+		return nil, nil, c.err
+	}
+	return c.client, release, nil
+}
+
+// connect dials the node. Failed connections are forgotten so the next send
+// dials again and connections abandoned while being dialed are closed.
+func (p *SocketPool) connect(node string, c *nodeConn) {
+	client, closeConn, err := p.dial(node)
+	p.mu.Lock()
+	c.client, c.close, c.err = client, closeConn, err
+	abandoned := c.abandoned
+	if abandoned && err == nil {
+		c.err = errDialAbandoned
+	}
+	if err != nil && p.nodes[node] == c {
+		delete(p.nodes, node)
+	}
+	close(c.ready)
+	p.mu.Unlock()
+	switch {
+	case err != nil:
+		glog.Errorf("Unable to connect to the socket service at %s: %s", node, err)
+	case abandoned:
+		glog.V(2).Infof("Closing abandoned connection to the socket service at %s", node)
+		closeConn()
+	default:
+		glog.V(2).Infof("Connected to the socket service at %s", node)
+	}
+}
+
+// Expire closes the connections that have not been used for the idle
+// timeout and returns their number.
+func (p *SocketPool) Expire() int {
+	now := p.properties.Now()
+	var idle []*nodeConn
+	p.mu.Lock()
+	for node, c := range p.nodes {
+		select {
+		case <-c.ready:
+		default:
+			if now.Sub(c.dialed) >= p.properties.DialTimeout {
+				delete(p.nodes, node)
+				c.abandoned = true
+				glog.Errorf("Timed out connecting to the socket service at %s", node)
+			}
+			continue
+		}
+		if c.refs == 0 && now.Sub(c.lastUsed) >= p.properties.IdleTimeout {
+			delete(p.nodes, node)
+			idle = append(idle, c)
+			glog.V(2).Infof("Closing idle connection to the socket service at %s", node)
+		}
+	}
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.close()
+	}
+	return len(idle)
+}
+
+// Len returns the number of connected nodes.
+func (p *SocketPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.nodes)
+}
+
+// Close closes all the connections. Connections still being dialed are
+// closed once the dial returns.
+func (p *SocketPool) Close() {
+	var dialed []*nodeConn
+	p.mu.Lock()
+	p.closed = true
+	for _, c := range p.nodes {
+		select {
+		case <-c.ready:
+			if c.err == nil {
+				dialed = append(dialed, c)
+			}
+		default:
+			c.abandoned = true
+		}
+	}
+	p.nodes = make(map[string]*nodeConn)
+	p.mu.Unlock()
+	for _, c := range dialed {
+		c.close()
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/socket"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// nodeDialer dials sender mocks recording the node of each sent message.
+type nodeDialer struct {
+	mu     sync.Mutex
+	dialed []string
+	closed []string
+	sent   []string
+	fail   bool
+}
+
+func (d *nodeDialer) Dial(node string) (socket.SenderClient, func(), error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dialed = append(d.dialed, node)
+	if d.fail {
+		return nil, nil, errors.New("connection refused")
+	}
+	client := SenderMock{
+		OnSendMessage: func(ctx context.Context, in *socket.SendRequest, opts ...grpc.CallOption) (*socket.SendReply, error) {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.sent = append(d.sent, node)
+			return &socket.SendReply{}, nil
+		},
+	}
+	return client, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.closed = append(d.closed, node)
+	}, nil
+}
+
+func TestSocketRoutesToGatewayNode(t *testing.T) {
+	d := &nodeDialer{}
+	var sentDefault int
+	s := &transport.Socket{
+		Client: SenderMock{
+			OnSendMessage: func(ctx context.Context, in *socket.SendRequest, opts ...grpc.CallOption) (*socket.SendReply, error) {
+				sentDefault++
+				return &socket.SendReply{}, nil
+			},
+		},
+		Nodes: transport.NewSocketPool(d.Dial),
+	}
+	for _, device := range []*devicepresence.Device{
+		{Id: "1", Node: "gw1:9092"},
+		{Id: "2", Node: "gw2:9092"},
+		{Id: "3", Node: "gw1:9092"},
+		{Id: "4"},
+	} {
+		if err := s.Send(context.Background(), device, transport.Message{Data: []byte("data")}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if len(d.dialed) != 2 || s.Nodes.Len() != 2 {
+		t.Errorf("Expecting each node to be dialed once: %v", d.dialed)
+	}
+	if len(d.sent) != 3 || d.sent[0] != "gw1:9092" || d.sent[1] != "gw2:9092" || sentDefault != 1 {
+		t.Errorf("Messages sent to the wrong nodes: %v and %d to the default", d.sent, sentDefault)
+	}
+}
+
+func TestSocketPoolDialsConcurrentUsersOnce(t *testing.T) {
+	d := &nodeDialer{}
+	p := transport.NewSocketPool(d.Dial)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, release, err := p.Client(context.Background(), "gw1:9092")
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err)
+				return
+			}
+			release()
+		}()
+	}
+	wg.Wait()
+	if len(d.dialed) != 1 {
+		t.Errorf("Expecting a single dial but got %v", d.dialed)
+	}
+}
+
+func TestSocketPoolDialFailureIsNotCached(t *testing.T) {
+	d := &nodeDialer{fail: true}
+	p := transport.NewSocketPool(d.Dial)
+	if _, _, err := p.Client(context.Background(), "gw1:9092"); err == nil {
+		t.Fatal("Expecting a dial error")
+	}
+	d.fail = false
+	if _, release, err := p.Client(context.Background(), "gw1:9092"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	} else {
+		release()
+	}
+	if len(d.dialed) != 2 {
+		t.Errorf("Expecting the node to be dialed again: %v", d.dialed)
+	}
+}
+
+func TestSocketPoolExpiresIdleConnections(t *testing.T) {
+	d := &nodeDialer{}
+	now := time.Unix(0, 0)
+	p := transport.NewSocketPool(d.Dial, func(props *transport.SocketPoolProperties) {
+		props.IdleTimeout = time.Minute
+		props.Now = func() time.Time { return now }
+	})
+	_, release1, _ := p.Client(context.Background(), "gw1:9092")
+	release1()
+	_, release2, _ := p.Client(context.Background(), "gw2:9092")
+
+	now = now.Add(time.Minute)
+	if n := p.Expire(); n != 1 {
+		t.Errorf("Expecting 1 expired connection but got %d", n)
+	}
+	if len(d.closed) != 1 || d.closed[0] != "gw1:9092" {
+		t.Errorf("Wrong connections closed: %v", d.closed)
+	}
+
+	release2()
+	if n := p.Expire(); n != 0 {
+		t.Errorf("Recently used connection expired")
+	}
+	now = now.Add(time.Minute)
+	p.Expire()
+	if p.Len() != 0 || len(d.closed) != 2 {
+		t.Errorf("Expecting all connections closed: %v", d.closed)
+	}
+}
+
+func TestSocketPoolDoesNotWaitForHangingDials(t *testing.T) {
+	unblock := make(chan struct{})
+	closed := make(chan string, 2)
+	dial := func(node string) (socket.SenderClient, func(), error) {
+		<-unblock
+		return SenderMock{}, func() { closed <- node }, nil
+	}
+	now := time.Unix(0, 0)
+	p := transport.NewSocketPool(dial, func(props *transport.SocketPoolProperties) {
+		props.DialTimeout = time.Second
+		props.Now = func() time.Time { return now }
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := p.Client(ctx, "gw1:9092"); err != context.DeadlineExceeded {
+		t.Errorf("Expecting the wait to time out but got: %v", err)
+	}
+
+	now = now.Add(time.Second)
+	p.Expire()
+	if p.Len() != 0 {
+		t.Error("Expecting the hanging dial to be dropped")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	p.Client(ctx, "gw2:9092")
+	done := make(chan struct{})
+	go func() {
+		p.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close waits for the hanging dial")
+	}
+	if _, _, err := p.Client(context.Background(), "gw1:9092"); err == nil {
+		t.Error("Expecting an error from a closed pool")
+	}
+
+	close(unblock)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("Expecting the abandoned connections to be closed")
+		}
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/protogalaxy/service-notify/auth"
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// ErrNotSubscribed is returned when sending to an SSE device that is
+// neither connected nor within its resume window. The device is gone for
+// good, so it is an InvalidDeviceError and the device gets removed.
+var ErrNotSubscribed = InvalidDeviceError{"sse device not subscribed"}
+
+// SSEProperties configure an SSE transport.
+type SSEProperties struct {
+	// ReplaySize is the number of recent messages kept per user for clients
+	// resuming with Last-Event-ID.
+	ReplaySize int
+	// Linger is how long a disconnected client stays registered and keeps
+	// having messages buffered, allowing it to resume without losing any.
+	Linger time.Duration
+	// Heartbeat is the interval of comments keeping idle streams open.
+	Heartbeat time.Duration
+	// Timeout limits the presence registration calls.
+	Timeout time.Duration
+}
+
+// SSE serves Server-Sent Events streams and delivers messages to the SSE
+// devices they register.
+//
+// Clients authenticate with a token in the Authorization header or the
+// access_token query parameter and receive the messages of the user the
+// token identifies. Each stream registers itself with presence as an SSE
+// device. Event ids are per user sequence numbers; a client reconnecting
+// with Last-Event-ID receives the buffered messages it missed.
+//
+// Streams and their buffers only exist in the memory of the instance serving
+// them, and a device unknown to the instance is removed from presence. The
+// service must therefore run as a single instance while SSE is enabled.
+type SSE struct {
+	authenticator auth.Authenticator
+	presence      devicepresence.PresenceManagerClient
+	properties    *SSEProperties
+
+	mu     sync.Mutex
+	users  map[string]*sseUser
+	done   chan struct{}
+	server *http.Server
+}
+
+type sseUser struct {
+	seq     uint64
+	events  []sseEvent
+	streams map[string]*sseStream
+}
+
+type sseEvent struct {
+	id        uint64
+	messageId string
+	data      []byte
+}
+
+type sseStream struct {
+	// wake is signalled when new events are buffered.
+	wake chan struct{}
+}
+
+func NewSSE(authenticator auth.Authenticator, presence devicepresence.PresenceManagerClient, conf ...func(*SSEProperties)) *SSE {
+	p := &SSEProperties{
+		ReplaySize: 32,
+		Linger:     30 * time.Second,
+		Heartbeat:  15 * time.Second,
+		Timeout:    5 * time.Second,
+	}
+	for _, f := range conf {
+		f(p)
+	}
+	return &SSE{
+		authenticator: authenticator,
+		presence:      presence,
+		properties:    p,
+		users:         make(map[string]*sseUser),
+		done:          make(chan struct{}),
+	}
+}
+
+// Serve accepts event stream subscriptions at /events on the listener until
+// Close is called.
+func (s *SSE) Serve(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/events", s)
+	srv := &http.Server{Handler: mux}
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	default:
+	}
+	s.server = srv
+	s.mu.Unlock()
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Close ends all open streams and stops serving subscriptions.
+func (s *SSE) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+		if s.server != nil {
+			s.server.Close()
+		}
+	}
+}
+
+func (s *SSE) Send(ctx context.Context, device *devicepresence.Device, msg Message) error {
+	userID := device.UserId
+	if userID == "" {
+		userID = msg.UserId
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.users[userID]
+	if u == nil || u.streams[device.Id] == nil {
+		return ErrNotSubscribed
+	}
+	// All streams of the user share the buffer so a message sent to several
+	// of its devices is buffered once.
+	if !u.buffered(msg.Id) {
+		data, _, err := msg.Payload()
+		if err != nil {
+			return err
+		}
+		u.seq++
+		u.events = append(u.events, sseEvent{
+			id:        u.seq,
+			messageId: msg.Id,
+			data:      data,
+		})
+		if len(u.events) > s.properties.ReplaySize {
+			u.events = u.events[len(u.events)-s.properties.ReplaySize:]
+		}
+	}
+	for _, st := range u.streams {
+		select {
+		case st.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (u *sseUser) buffered(messageID string) bool {
+	if messageID == "" {
+		return false
+	}
+	for _, e := range u.events {
+		if e.messageId == messageID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SSE) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		token = r.URL.Query().Get("access_token")
+	}
+	ctx := metadata.NewContext(context.Background(), metadata.MD{auth.MetadataKey: token})
+	userID, err := s.authenticator.Authenticate(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+
+	deviceID := newStreamId()
+	ctx, cancel := context.WithTimeout(context.Background(), s.properties.Timeout)
+	_, err = s.presence.RegisterDevice(ctx, &devicepresence.Device{
+		Id:     deviceID,
+		Type:   devicepresence.Device_SSE,
+		UserId: userID,
+		Status: devicepresence.Device_ONLINE,
+	})
+	cancel()
+	if err != nil {
+		glog.Errorf("Unable to register SSE device for user %s: %s", userID, err)
+		http.Error(w, "unable to subscribe", http.StatusServiceUnavailable)
+		return
+	}
+	st, last := s.subscribe(userID, deviceID, lastID)
+	defer s.unsubscribe(userID, deviceID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(s.properties.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		for _, e := range s.pending(userID, last) {
+			if _, err := w.Write(formatEvent(e)); err != nil {
+				return
+			}
+			last = e.id
+		}
+		flusher.Flush()
+		select {
+		case <-st.wake:
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// subscribe adds the stream and returns the id of the last event the client
+// has seen. Clients without a known Last-Event-ID start with new messages.
+func (s *SSE) subscribe(userID, deviceID, lastID string) (*sseStream, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.users[userID]
+	if u == nil {
+		u = &sseUser{streams: make(map[string]*sseStream)}
+		s.users[userID] = u
+	}
+	st := &sseStream{wake: make(chan struct{}, 1)}
+	u.streams[deviceID] = st
+	last := u.seq
+	if id, err := strconv.ParseUint(lastID, 10, 64); err == nil && id <= u.seq {
+		last = id
+	}
+	return st, last
+}
+
+// unsubscribe keeps the stream buffering until it expires so the client can
+// resume from where it was cut off.
+func (s *SSE) unsubscribe(userID, deviceID string) {
+	time.AfterFunc(s.properties.Linger, func() {
+		s.expire(userID, deviceID)
+	})
+}
+
+func (s *SSE) expire(userID, deviceID string) {
+	s.mu.Lock()
+	u := s.users[userID]
+	delete(u.streams, deviceID)
+	if len(u.streams) == 0 {
+		delete(s.users, userID)
+	}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.properties.Timeout)
+	defer cancel()
+	_, err := s.presence.RemoveDevice(ctx, &devicepresence.RemoveDeviceRequest{
+		UserId:   userID,
+		DeviceId: deviceID,
+		Type:     devicepresence.Device_SSE,
+	})
+	if err != nil {
+		glog.Errorf("Unable to remove SSE device '%s' of user %s: %s", deviceID, userID, err)
+	}
+}
+
+func (s *SSE) pending(userID string, last uint64) []sseEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var events []sseEvent
+	for _, e := range s.users[userID].events {
+		if e.id > last {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// formatEvent writes the event with a data field per line of its payload.
+// Clients end lines at CRLF, CR or LF so all of them start a new field.
+func formatEvent(e sseEvent) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "id: %d\n", e.id)
+	data := bytes.Replace(e.data, []byte("\r\n"), []byte("\n"), -1)
+	data = bytes.Replace(data, []byte("\r"), []byte("\n"), -1)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		b.WriteString("data: ")
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+func newStreamId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		glog.Errorf("Unable to generate stream id: %s", err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,274 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport_test
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/auth"
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// PresenceMock records registered SSE devices.
+type PresenceMock struct {
+	devicepresence.PresenceManagerClient
+
+	registered chan *devicepresence.Device
+	removed    chan *devicepresence.RemoveDeviceRequest
+}
+
+func NewPresenceMock() *PresenceMock {
+	return &PresenceMock{
+		registered: make(chan *devicepresence.Device, 10),
+		removed:    make(chan *devicepresence.RemoveDeviceRequest, 10),
+	}
+}
+
+func (m *PresenceMock) RegisterDevice(ctx context.Context, in *devicepresence.Device, opts ...grpc.CallOption) (*devicepresence.RegisterDeviceReply, error) {
+	m.registered <- in
+	return &devicepresence.RegisterDeviceReply{}, nil
+}
+
+func (m *PresenceMock) RemoveDevice(ctx context.Context, in *devicepresence.RemoveDeviceRequest, opts ...grpc.CallOption) (*devicepresence.RemoveDeviceReply, error) {
+	m.removed <- in
+	return &devicepresence.RemoveDeviceReply{}, nil
+}
+
+type sseClient struct {
+	res    *http.Response
+	events *bufio.Reader
+}
+
+func subscribe(t *testing.T, url, token, lastID string) *sseClient {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sseClient{res: res, events: bufio.NewReader(res.Body)}
+}
+
+// next returns the id and data of the next event.
+func (c *sseClient) next(t *testing.T) (string, string) {
+	var id string
+	var data []string
+	for {
+		line, err := c.events.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Unable to read event: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if data != nil {
+				return id, strings.Join(data, "\n")
+			}
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func newSSE(p *PresenceMock) (*transport.SSE, *httptest.Server) {
+	s := transport.NewSSE(auth.StaticTokens{"token1": "user1"}, p, func(p *transport.SSEProperties) {
+		p.ReplaySize = 2
+		p.Linger = 50 * time.Millisecond
+	})
+	return s, httptest.NewServer(s)
+}
+
+func TestSSEDeliversToSubscribedDevice(t *testing.T) {
+	p := NewPresenceMock()
+	s, srv := newSSE(p)
+	defer srv.Close()
+	defer s.Close()
+
+	c := subscribe(t, srv.URL, "token1", "")
+	defer c.res.Body.Close()
+	if ct := c.res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Unexpected content type: %s", ct)
+	}
+	device := <-p.registered
+	if device.Type != devicepresence.Device_SSE || device.UserId != "user1" {
+		t.Errorf("Unexpected device registered: %+v", device)
+	}
+
+	if err := s.Send(context.Background(), device, transport.Message{Id: "m1", Data: []byte("line1\nline2")}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	id, data := c.next(t)
+	if id != "1" || data != "line1\nline2" {
+		t.Errorf("Unexpected event %s: %q", id, data)
+	}
+}
+
+func TestSSESplitsDataOnAllLineEndings(t *testing.T) {
+	p := NewPresenceMock()
+	s, srv := newSSE(p)
+	defer srv.Close()
+	defer s.Close()
+
+	c := subscribe(t, srv.URL, "token1", "")
+	defer c.res.Body.Close()
+	device := <-p.registered
+
+	if err := s.Send(context.Background(), device, transport.Message{Id: "m1", Data: []byte("a\r\nb\rc\nd")}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, data := c.next(t); data != "a\nb\nc\nd" {
+		t.Errorf("Unexpected event data: %q", data)
+	}
+}
+
+func TestSSECloseStopsServing(t *testing.T) {
+	p := NewPresenceMock()
+	s, _ := newSSE(p)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(l)
+	}()
+	c := subscribe(t, "http://"+l.Addr().String()+"/events", "token1", "")
+	defer c.res.Body.Close()
+	<-p.registered
+
+	s.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expecting Close to stop the server")
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("Expecting the listener to be closed")
+	}
+}
+
+func TestSSEResumesFromLastEventId(t *testing.T) {
+	p := NewPresenceMock()
+	s, srv := newSSE(p)
+	defer srv.Close()
+	defer s.Close()
+
+	c := subscribe(t, srv.URL, "token1", "")
+	device := <-p.registered
+	s.Send(context.Background(), device, transport.Message{Id: "m1", Data: []byte("one")})
+	c.next(t)
+	c.res.Body.Close()
+
+	// Messages sent while the client reconnects are buffered.
+	time.Sleep(10 * time.Millisecond)
+	for _, m := range []string{"two", "three", "four"} {
+		if err := s.Send(context.Background(), device, transport.Message{Id: m, Data: []byte(m)}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	c = subscribe(t, srv.URL, "token1", "1")
+	defer c.res.Body.Close()
+	// The replay buffer only holds the last two messages.
+	for _, expected := range []string{"three", "four"} {
+		if _, data := c.next(t); data != expected {
+			t.Errorf("Expecting %s but got %s", expected, data)
+		}
+	}
+}
+
+func TestSSEBuffersMessageOncePerUser(t *testing.T) {
+	p := NewPresenceMock()
+	s, srv := newSSE(p)
+	defer srv.Close()
+	defer s.Close()
+
+	c1 := subscribe(t, srv.URL, "token1", "")
+	defer c1.res.Body.Close()
+	d1 := <-p.registered
+	c2 := subscribe(t, srv.URL, "token1", "")
+	defer c2.res.Body.Close()
+	d2 := <-p.registered
+
+	s.Send(context.Background(), d1, transport.Message{Id: "m1", Data: []byte("one")})
+	s.Send(context.Background(), d2, transport.Message{Id: "m1", Data: []byte("one")})
+	s.Send(context.Background(), d2, transport.Message{Id: "m2", Data: []byte("two")})
+	for _, c := range []*sseClient{c1, c2} {
+		if id, _ := c.next(t); id != "1" {
+			t.Errorf("Unexpected event id: %s", id)
+		}
+		if id, _ := c.next(t); id != "2" {
+			t.Errorf("Unexpected event id: %s", id)
+		}
+	}
+}
+
+func TestSSEExpiresDisconnectedDevice(t *testing.T) {
+	p := NewPresenceMock()
+	s, srv := newSSE(p)
+	defer srv.Close()
+	defer s.Close()
+
+	c := subscribe(t, srv.URL, "token1", "")
+	device := <-p.registered
+	c.res.Body.Close()
+
+	select {
+	case r := <-p.removed:
+		if r.DeviceId != device.Id {
+			t.Errorf("Wrong device removed: %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Disconnected device not removed")
+	}
+	err := s.Send(context.Background(), device, transport.Message{})
+	if err != transport.ErrNotSubscribed {
+		t.Errorf("Expecting not subscribed error but got: %v", err)
+	}
+	if _, ok := err.(transport.InvalidDeviceError); !ok {
+		t.Error("Expecting the expired device to be reported as invalid")
+	}
+}
+
+func TestSSERequiresAuthentication(t *testing.T) {
+	p := NewPresenceMock()
+	s, srv := newSSE(p)
+	defer srv.Close()
+	defer s.Close()
+
+	c := subscribe(t, srv.URL, "wrong", "")
+	defer c.res.Body.Close()
+	if c.res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expecting unauthorized but got %d", c.res.StatusCode)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"golang.org/x/net/context"
+)
+
+// Message is the notification delivered to a single device.
+type Message struct {
+	Id     string
+	UserId string
+	// Data is the raw payload.
+	Data []byte
+	// Notification is the structured form of the message if given.
+	Notification *Notification
+
+	payloads *payloads
+}
+
+// Notification is a structured message each transport maps to its format.
+type Notification struct {
+	Title       string            `json:"title,omitempty"`
+	Body        string            `json:"body,omitempty"`
+	Category    string            `json:"category,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Data        map[string]string `json:"data,omitempty"`
+	CollapseKey string            `json:"collapse_key,omitempty"`
+	Badge       int               `json:"badge,omitempty"`
+}
+
+// Payload returns the bytes and their content type for transports
+// delivering opaque payloads. Messages without a notification keep their raw
+// data. Notifications are encoded as a JSON object carrying the raw data,
+// if any, base64 encoded in the "payload" field.
+func (m Message) Payload() ([]byte, string, error) {
+	if m.Notification == nil {
+		return m.Data, "application/octet-stream", nil
+	}
+	b, err := json.Marshal(struct {
+		*Notification
+		Payload []byte `json:"payload,omitempty"`
+	}{m.Notification, m.Data})
+	if err != nil {
+		return nil, "", err
+	}
+	return b, "application/json", nil
+}
+
+// title and body return the user visible text of the message. Raw data
+// is shown as the body of messages without a notification body.
+func (m Message) title(defaultTitle string) string {
+	if m.Notification != nil && m.Notification.Title != "" {
+		return m.Notification.Title
+	}
+	return defaultTitle
+}
+
+func (m Message) body() string {
+	if m.Notification != nil && m.Notification.Body != "" {
+		return m.Notification.Body
+	}
+	return string(m.Data)
+}
+
+func (m Message) notification() Notification {
+	if m.Notification == nil {
+		return Notification{}
+	}
+	return *m.Notification
+}
+
+// Transport delivers messages to devices of a single type.
+type Transport interface {
+	Send(ctx context.Context, device *devicepresence.Device, msg Message) error
+}
+
+// UnsupportedDeviceTypeError is returned when no transport is registered for
+// the type of the device.
+type UnsupportedDeviceTypeError struct {
+	Type devicepresence.Device_Type
+}
+
+func (e UnsupportedDeviceTypeError) Error() string {
+	return fmt.Sprintf("unsupported device type: %s", e.Type)
+}
+
+// Registry selects the transport by the type of the device.
+type Registry map[devicepresence.Device_Type]Transport
+
+func (r Registry) Send(ctx context.Context, device *devicepresence.Device, msg Message) error {
+	t, ok := r[device.Type]
+	if !ok {
+		return UnsupportedDeviceTypeError{device.Type}
+	}
+	return t.Send(ctx, device, msg)
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+)
+
+type TransportMock struct {
+	OnSend func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error
+}
+
+func (m TransportMock) Send(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+	return m.OnSend(ctx, device, msg)
+}
+
+func TestRegistrySelectsTransportByDeviceType(t *testing.T) {
+	var used string
+	r := transport.Registry{
+		devicepresence.Device_WS: TransportMock{
+			OnSend: func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+				used = "ws"
+				return nil
+			},
+		},
+		devicepresence.Device_EMAIL: TransportMock{
+			OnSend: func(ctx context.Context, device *devicepresence.Device, msg transport.Message) error {
+				used = "email"
+				return errors.New("error")
+			},
+		},
+	}
+	if err := r.Send(context.Background(), &devicepresence.Device{Type: devicepresence.Device_WS}, transport.Message{}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if used != "ws" {
+		t.Errorf("Wrong transport used: %s", used)
+	}
+	if err := r.Send(context.Background(), &devicepresence.Device{Type: devicepresence.Device_EMAIL}, transport.Message{}); err == nil {
+		t.Error("Expecting the transport error to be returned")
+	}
+	if used != "email" {
+		t.Errorf("Wrong transport used: %s", used)
+	}
+}
+
+func TestRegistryUnsupportedDeviceType(t *testing.T) {
+	err := transport.Registry{}.Send(context.Background(), &devicepresence.Device{Type: devicepresence.Device_SSE}, transport.Message{})
+	if _, ok := err.(transport.UnsupportedDeviceTypeError); !ok {
+		t.Errorf("Expecting unsupported device type error but got: %v", err)
+	}
+}
+
+func TestMessagePayload(t *testing.T) {
+	raw := transport.Message{Data: []byte("data")}
+	if b, ct, err := raw.Payload(); err != nil || string(b) != "data" || ct != "application/octet-stream" {
+		t.Errorf("Raw messages must be sent unchanged: %s %s", ct, b)
+	}
+
+	msg := transport.Message{
+		Data: []byte("data"),
+		Notification: &transport.Notification{
+			Title: "Your turn",
+			Data:  map[string]string{"game": "42"},
+		},
+	}
+	b, ct, err := msg.Payload()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ct != "application/json" {
+		t.Errorf("Unexpected content type: %s", ct)
+	}
+	if string(b) != `{"title":"Your turn","data":{"game":"42"},"payload":"ZGF0YQ=="}` {
+		t.Errorf("Unexpected payload: %s", b)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"golang.org/x/net/context"
+)
+
+// Headers set on every webhook request.
+const (
+	HeaderMessageId = "X-Notify-Message-Id"
+	HeaderTimestamp = "X-Notify-Timestamp"
+	HeaderSignature = "X-Notify-Signature"
+)
+
+// WebhookProperties configure a Webhook transport.
+type WebhookProperties struct {
+	// Timeout limits a single request attempt.
+	Timeout time.Duration
+	// MaxRetries is the number of times a request is retried after the
+	// endpoint answered with a 5xx or 429 status.
+	MaxRetries int
+	// Backoff is the delay before the first retry. It doubles for every
+	// following retry unless the endpoint asks for a delay with Retry-After.
+	Backoff time.Duration
+	// MaxRetryAfter caps the delay requested with Retry-After.
+	MaxRetryAfter time.Duration
+	// Encoding compresses request bodies of at least MinCompressSize bytes
+	// if set.
+	Encoding        string
+	MinCompressSize int
+	// AllowedHosts restricts the hosts device URLs may point to using
+	// path.Match patterns. Any host is allowed if empty.
+	AllowedHosts []string
+	// Client sends the requests. If not set a client is used that does not
+	// follow redirects and refuses to connect to loopback, private and
+	// link-local addresses.
+	Client *http.Client
+	// Now returns the current time used for the timestamp header.
+	Now func() time.Time
+}
+
+// Webhook delivers messages to WEBHOOK devices by POSTing the payload to the
+// URL stored as the device id.
+//
+// Requests are signed with HMAC-SHA256 over "<timestamp>.<body>" using the
+// shared key, where the body is compressed if Content-Encoding is set. The
+// hex encoded signature is sent as "sha256=<signature>" in the
+// X-Notify-Signature header and the unix timestamp in X-Notify-Timestamp,
+// allowing receivers to reject replayed requests.
+//
+// Device URLs are registered by clients, so only https URLs to allowed hosts
+// are requested.
+type Webhook struct {
+	key        []byte
+	properties *WebhookProperties
+}
+
+func NewWebhook(key []byte, conf ...func(*WebhookProperties)) *Webhook {
+	p := &WebhookProperties{
+		Timeout:       10 * time.Second,
+		MaxRetries:    3,
+		Backoff:       time.Second,
+		MaxRetryAfter: time.Minute,
+		Now:           time.Now,
+	}
+	for _, f := range conf {
+		f(p)
+	}
+	if p.Client == nil {
+		p.Client = newWebhookClient(p.Timeout)
+	}
+	return &Webhook{
+		key:        key,
+		properties: p,
+	}
+}
+
+// WebhookStatusError is returned when the endpoint does not accept the
+// message.
+type WebhookStatusError struct {
+	StatusCode int
+}
+
+func (e WebhookStatusError) Error() string {
+	return fmt.Sprintf("webhook responded with status %d", e.StatusCode)
+}
+
+func (w *Webhook) Send(ctx context.Context, device *devicepresence.Device, msg Message) error {
+	if err := w.checkURL(device.Id); err != nil {
+		return err
+	}
+	backoff := w.properties.Backoff
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := w.post(ctx, device.Id, msg)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(WebhookStatusError); !ok || retryAfter < 0 || attempt >= w.properties.MaxRetries {
+			return err
+		}
+		delay := backoff
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+		if delay > w.properties.MaxRetryAfter {
+			delay = w.properties.MaxRetryAfter
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// post makes a single request attempt. A negative retry delay means the
+// request must not be retried, zero means the default backoff applies.
+func (w *Webhook) post(ctx context.Context, url string, msg Message) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.properties.Timeout)
+	defer cancel()
+	data, contentType, encoding, err := msg.CompressedPayload(w.properties.Encoding, w.properties.MinCompressSize)
+	if err != nil {
+		return -1, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return -1, err
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	timestamp := strconv.FormatInt(w.properties.Now().Unix(), 10)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(HeaderMessageId, msg.Id)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, "sha256="+Signature(w.key, timestamp, data))
+
+	res, err := w.properties.Client.Do(req)
+	if err != nil {
+		return -1, err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return 0, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return retryAfter(res.Header.Get("Retry-After"), w.properties.Now()), WebhookStatusError{res.StatusCode}
+	}
+	return -1, WebhookStatusError{res.StatusCode}
+}
+
+// checkURL rejects device URLs that are not https or point to a host that is
+// not allowed.
+func (w *Webhook) checkURL(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return InvalidDeviceError{fmt.Sprintf("invalid webhook url: %s", err)}
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return InvalidDeviceError{"webhook url must be an absolute https url"}
+	}
+	if len(w.properties.AllowedHosts) == 0 {
+		return nil
+	}
+	for _, p := range w.properties.AllowedHosts {
+		if ok, _ := path.Match(p, u.Hostname()); ok {
+			return nil
+		}
+	}
+	return InvalidDeviceError{fmt.Sprintf("webhook host %s is not allowed", u.Hostname())}
+}
+
+// newWebhookClient returns a client that does not follow redirects and only
+// connects to public addresses. The address is checked after resolving the
+// host so names pointing at internal addresses are refused as well.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("webhook address %s is not public", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast()
+}
+
+// Signature returns the hex encoded HMAC-SHA256 of the timestamp and the
+// payload as sent in the X-Notify-Signature header.
+func Signature(key []byte, timestamp string, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryAfter parses a Retry-After header given either in seconds or as an
+// HTTP date.
+func retryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
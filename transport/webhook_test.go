@@ -0,0 +1,212 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-notify/devicepresence"
+	"github.com/protogalaxy/service-notify/transport"
+	"golang.org/x/net/context"
+)
+
+func webhookDevice(url string) *devicepresence.Device {
+	return &devicepresence.Device{Id: url, Type: devicepresence.Device_WEBHOOK}
+}
+
+func TestWebhookSignsPayload(t *testing.T) {
+	now := time.Unix(1445000000, 0)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "data" {
+			t.Errorf("Unexpected body: %s", body)
+		}
+		if ts := r.Header.Get(transport.HeaderTimestamp); ts != "1445000000" {
+			t.Errorf("Unexpected timestamp: %s", ts)
+		}
+		if id := r.Header.Get(transport.HeaderMessageId); id != "msg1" {
+			t.Errorf("Unexpected message id: %s", id)
+		}
+		expected := "sha256=" + transport.Signature([]byte("key"), "1445000000", body)
+		if sig := r.Header.Get(transport.HeaderSignature); sig != expected {
+			t.Errorf("Expecting signature %s but got %s", expected, sig)
+		}
+	}))
+	defer srv.Close()
+
+	w := transport.NewWebhook([]byte("key"), func(p *transport.WebhookProperties) {
+		p.Client = srv.Client()
+		p.Now = func() time.Time { return now }
+	})
+	err := w.Send(context.Background(), webhookDevice(srv.URL), transport.Message{Id: "msg1", Data: []byte("data")})
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestWebhookRetriesHonouringRetryAfter(t *testing.T) {
+	var calls int32
+	var first time.Time
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			first = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			if d := time.Since(first); d < time.Second {
+				t.Errorf("Retry-After not honoured, retried after %s", d)
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	w := transport.NewWebhook([]byte("key"), func(p *transport.WebhookProperties) {
+		p.Client = srv.Client()
+		p.Backoff = time.Millisecond
+	})
+	err := w.Send(context.Background(), webhookDevice(srv.URL), transport.Message{})
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expecting 3 attempts but got %d", calls)
+	}
+}
+
+func TestWebhookGivesUpAfterMaxRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	w := transport.NewWebhook([]byte("key"), func(p *transport.WebhookProperties) {
+		p.Client = srv.Client()
+		p.MaxRetries = 2
+		p.Backoff = time.Millisecond
+	})
+	err := w.Send(context.Background(), webhookDevice(srv.URL), transport.Message{})
+	if e, ok := err.(transport.WebhookStatusError); !ok || e.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expecting status error but got: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expecting 3 attempts but got %d", calls)
+	}
+}
+
+func TestWebhookDoesNotRetryClientErrors(t *testing.T) {
+	var calls int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	w := transport.NewWebhook([]byte("key"), func(p *transport.WebhookProperties) {
+		p.Client = srv.Client()
+	})
+	if err := w.Send(context.Background(), webhookDevice(srv.URL), transport.Message{}); err == nil {
+		t.Error("Expecting an error")
+	}
+	if calls != 1 {
+		t.Errorf("Expecting a single attempt but got %d", calls)
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	w := transport.NewWebhook([]byte("key"), func(p *transport.WebhookProperties) {
+		p.Client = srv.Client()
+		p.Timeout = 10 * time.Millisecond
+	})
+	if err := w.Send(context.Background(), webhookDevice(srv.URL), transport.Message{}); err == nil {
+		t.Error("Expecting a timeout error")
+	}
+}
+
+func TestWebhookCompressesLargePayloads(t *testing.T) {
+	data := bytes.Repeat([]byte("data"), 100)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("Unexpected content encoding: %s", r.Header.Get("Content-Encoding"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		expected := "sha256=" + transport.Signature([]byte("key"), r.Header.Get(transport.HeaderTimestamp), body)
+		if r.Header.Get(transport.HeaderSignature) != expected {
+			t.Error("Signature must cover the compressed body")
+		}
+		if !bytes.Equal(gunzip(t, body), data) {
+			t.Error("Unexpected body")
+		}
+	}))
+	defer srv.Close()
+
+	w := transport.NewWebhook([]byte("key"), func(p *transport.WebhookProperties) {
+		p.Client = srv.Client()
+		p.Encoding = transport.EncodingGzip
+		p.MinCompressSize = 100
+	})
+	if err := w.Send(context.Background(), webhookDevice(srv.URL), transport.NewMessage("id", "user1", data, nil)); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestWebhookRejectsInvalidURLs(t *testing.T) {
+	w := transport.NewWebhook([]byte("key"), func(p *transport.WebhookProperties) {
+		p.AllowedHosts = []string{"*.example.com"}
+	})
+	for _, url := range []string{
+		"http://hooks.example.com/notify",
+		"hooks.example.com/notify",
+		"https://internal.example.org/notify",
+	} {
+		err := w.Send(context.Background(), webhookDevice(url), transport.Message{})
+		if _, ok := err.(transport.InvalidDeviceError); !ok {
+			t.Errorf("Expecting an invalid device error for %s but got: %v", url, err)
+		}
+	}
+}
+
+func TestWebhookRefusesPrivateAddresses(t *testing.T) {
+	var calls int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer srv.Close()
+
+	w := transport.NewWebhook([]byte("key"))
+	if err := w.Send(context.Background(), webhookDevice(srv.URL), transport.Message{}); err == nil {
+		t.Error("Expecting an error for a loopback address")
+	}
+	if calls != 0 {
+		t.Errorf("Expecting no requests but got %d", calls)
+	}
+}